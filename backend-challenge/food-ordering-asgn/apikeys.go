@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/parvez0/food-ordering-asgn/pkg"
+)
+
+const apiKeysUsage = "usage: apikeys create <name> <scope,...> [expires-at] | list [unused-since] | " +
+	"rotate <name> [overlap] | revoke <name> | expire <name> <expires-at|never>"
+
+// runAPIKeys implements the apikeys command. Times are RFC 3339 timestamps and
+// overlaps durations like "1h".
+func runAPIKeys(keys pkg.APIKeyRepository, args []string) error {
+	err := manageAPIKeys(keys, args)
+	var invalid *pkg.OrderValidationError
+	if !errors.As(err, &invalid) {
+		return err
+	}
+	messages := make([]string, 0, len(invalid.Errors))
+	for _, field := range invalid.Errors {
+		messages = append(messages, field.Field+" "+field.Message)
+	}
+	return errors.New("invalid API key: " + strings.Join(messages, "; "))
+}
+
+func manageAPIKeys(keys pkg.APIKeyRepository, args []string) error {
+	if len(args) == 0 {
+		return errors.New(apiKeysUsage)
+	}
+	now := time.Now()
+
+	switch {
+	case args[0] == "create" && (len(args) == 3 || len(args) == 4):
+		req := pkg.CreateAPIKeyReq{Name: args[1]}
+		for _, scope := range strings.Split(args[2], ",") {
+			req.Scopes = append(req.Scopes, pkg.APIScope(strings.TrimSpace(scope)))
+		}
+		if len(args) == 4 {
+			expiresAt, err := parseTime(args[3])
+			if err != nil {
+				return err
+			}
+			req.ExpiresAt = &expiresAt
+		}
+		issued, err := pkg.IssueAPIKey(keys, req, now)
+		if err != nil {
+			return err
+		}
+		printIssuedAPIKey(issued)
+		return nil
+	case args[0] == "list" && len(args) <= 2:
+		var unusedSince *time.Time
+		if len(args) == 2 {
+			since, err := parseTime(args[1])
+			if err != nil {
+				return err
+			}
+			unusedSince = &since
+		}
+		listed, err := pkg.ListAPIKeys(keys, unusedSince, now)
+		if err != nil {
+			return err
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(out, "NAME\tSCOPES\tSTATUS\tEXPIRES AT\tLAST USED AT\tUSES\tCREATED AT")
+		for _, key := range listed {
+			scopes := make([]string, 0, len(key.Scopes))
+			for _, scope := range key.Scopes {
+				scopes = append(scopes, string(scope))
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", key.Name, strings.Join(scopes, ","), key.Status,
+				formatTime(key.ExpiresAt, "never"), formatTime(key.LastUsedAt, "never"), key.UseCount,
+				key.CreatedAt.Format(time.RFC3339))
+		}
+		return out.Flush()
+	case args[0] == "rotate" && (len(args) == 2 || len(args) == 3):
+		overlap := pkg.DefaultAPIKeyRotationOverlap
+		if len(args) == 3 {
+			value, err := time.ParseDuration(args[2])
+			if err != nil {
+				return fmt.Errorf("invalid overlap: %q", args[2])
+			}
+			overlap = value
+		}
+		issued, err := pkg.RotateAPIKey(keys, args[1], overlap, now)
+		if err != nil {
+			return err
+		}
+		printIssuedAPIKey(issued)
+		fmt.Printf("The previous key is accepted until %s\n", issued.PreviousExpiresAt.Format(time.RFC3339))
+		return nil
+	case args[0] == "revoke" && len(args) == 2:
+		if _, err := pkg.RevokeAPIKey(keys, args[1], now); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %s\n", args[1])
+		return nil
+	case args[0] == "expire" && len(args) == 3:
+		var expiresAt *time.Time
+		if args[2] != "never" {
+			value, err := parseTime(args[2])
+			if err != nil {
+				return err
+			}
+			expiresAt = &value
+		}
+		key, err := pkg.SetAPIKeyExpiry(keys, args[1], expiresAt, now)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("API key %s expires %s\n", key.Name, formatTime(key.ExpiresAt, "never"))
+		return nil
+	default:
+		return errors.New(apiKeysUsage)
+	}
+}
+
+// printIssuedAPIKey prints the value of a key, which can't be looked up again
+func printIssuedAPIKey(issued *pkg.IssuedAPIKey) {
+	fmt.Printf("API key %s: %s\n", issued.Name, issued.Key)
+	fmt.Println("Store the key now, it is not shown again")
+}
+
+func parseTime(value string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time, expected an RFC 3339 timestamp: %q", value)
+	}
+	return parsed, nil
+}
+
+func formatTime(value *time.Time, zero string) string {
+	if value == nil {
+		return zero
+	}
+	return value.Format(time.RFC3339)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"net/http"
 	"os"
+	"slices"
+	"time"
+	// Embeds the timezone database, so the store timezone loads on any host
+	_ "time/tzdata"
 
 	"github.com/parvez0/food-ordering-asgn/pkg"
 	"github.com/parvez0/food-ordering-asgn/utils"
@@ -11,21 +17,106 @@ import (
 func main() {
 	logger := utils.GetLogger()
 
-	db, err := pkg.NewDB(pkg.WithSqliteInMemoryDB())
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to the JSON configuration file")
+	flag.Parse()
+
+	config, err := pkg.LoadConfig(*configPath)
+	if err != nil {
+		logger.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dbEngine := pkg.WithSqliteInMemoryDB()
+	if config.DatabasePath != "" {
+		dbEngine = pkg.WithSqliteFileDB(config.DatabasePath)
+	}
+	db, err := pkg.NewDB(dbEngine)
 	if err != nil {
 		logger.Fatalf("Failed to setup database: %v", err)
 	}
 	logger.Infof("Database setup complete")
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(db, flag.Args()[1:]); err != nil {
+			logger.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
 	err = pkg.SeedDatabase(db)
 	if err != nil {
 		logger.Fatalf("Failed to seed database: %v", err)
 	}
 	logger.Infof("Database migration complete")
+	repos := pkg.NewGormRepositories(db)
+	tokenizer, err := config.CouponTokenizer()
+	if err != nil {
+		logger.Fatalf("Invalid coupon character classes: %v", err)
+	}
+	if err := pkg.ConfigureCouponLimits(repos.Coupons, tokenizer, config.CouponLimits); err != nil {
+		logger.Fatalf("Failed to configure coupon limits: %v", err)
+	}
+	if err := pkg.ConfigureAPIKeys(repos.APIKeys, config.APIKeys); err != nil {
+		logger.Fatalf("Failed to configure API keys: %v", err)
+	}
+	if err := pkg.ClaimLegacyRedemptions(repos.Coupons, repos.APIKeys); err != nil {
+		logger.Fatalf("Failed to claim legacy coupon redemptions: %v", err)
+	}
+	if flag.Arg(0) == "apikeys" {
+		if config.DatabasePath == "" {
+			logger.Fatalf("API keys can only be managed in a database file, set DATABASE_PATH")
+		}
+		if err := runAPIKeys(repos.APIKeys, flag.Args()[1:]); err != nil {
+			logger.Fatalf("API key command failed: %v", err)
+		}
+		return
+	}
 
-	requestHandler := pkg.NewRequestHandler(db)
+	indexBuilder := pkg.NewCouponIndexBuilder(
+		pkg.WithIndexWorkDir(config.IndexDir),
+		pkg.WithIndexTokenizer(tokenizer),
+		pkg.WithIndexWorkers(config.IndexWorkers),
+	)
+	couponIndex, err := pkg.NewCouponIndexWatcher(indexBuilder, config.DataDir,
+		pkg.WithWatchInterval(time.Duration(config.WatchInterval)),
+		pkg.WithReloadHook(func(index *pkg.CouponIndex) error {
+			logger.Infof("Coupon index built with %d codes", index.Len())
+			return pkg.SyncCouponSources(repos.Coupons, index)
+		}),
+	)
+	if err != nil {
+		logger.Fatalf("Failed to build coupon index: %v", err)
+	}
+	defer couponIndex.Close()
+	if config.WatchInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go couponIndex.Run(ctx)
+	}
+
+	location, err := config.StoreLocation()
+	if err != nil {
+		logger.Fatalf("Invalid store timezone: %v", err)
+	}
+	requestHandler := pkg.NewRequestHandler(repos,
+		pkg.WithCouponIndex(couponIndex),
+		pkg.WithCouponPolicy(config.CouponPolicy),
+		pkg.WithCouponSourceManager(couponIndex),
+		pkg.WithAdminToken(config.AdminToken),
+		pkg.WithStoreLocation(location),
+		pkg.WithOrderLimits(config.OrderLimits),
+		pkg.WithIdempotencyTTL(time.Duration(config.IdempotencyTTL)),
+	)
+	if config.AdminToken == "" {
+		logger.Warn("No admin token configured, the admin endpoints are disabled")
+	}
+	if keys, err := pkg.ListAPIKeys(repos.APIKeys, nil, time.Now()); err != nil {
+		logger.Warn("Failed to list API keys: ", err)
+	} else if !slices.ContainsFunc(keys, func(key pkg.APIKey) bool { return key.Status == pkg.APIKeyActive }) {
+		logger.Warn("No active API keys, orders can't be placed")
+	}
 
-	logger.Info("Starting server on port: 8080")
-	if err := http.ListenAndServe(":8080", requestHandler.ServeHTTP()); err != nil {
+	logger.Info("Starting server on: ", config.Addr)
+	if err := http.ListenAndServe(config.Addr, requestHandler.ServeHTTP()); err != nil {
 		logger.Info("Failed to terminate server gracefully:", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,151 @@
+package pkg
+
+// admin.go implements the admin endpoints used to manage the coupon sources while
+// the server is running. They are only served to requests carrying the admin token
+// as a bearer token.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+// CouponSourceManager adds and removes coupon sources, reloading the index afterwards
+type CouponSourceManager interface {
+	AddSource(name string, content io.Reader) error
+	RemoveSource(name string) error
+}
+
+// WithCouponSourceManager enables the admin endpoints managing the coupon sources
+func WithCouponSourceManager(manager CouponSourceManager) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		h.couponSources = manager
+	}
+}
+
+// WithAdminToken sets the bearer token required by the admin endpoints.
+// Without a token the admin endpoints reject every request.
+func WithAdminToken(token string) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		h.adminToken = token
+	}
+}
+
+func (h *RequestHandler) adminAuthMiddleware(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || h.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// couponSourcesMiddleware rejects requests when no CouponSourceManager is configured
+func (h *RequestHandler) couponSourcesMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.couponSources == nil {
+			http.Error(w, "Coupon sources can't be managed", http.StatusNotImplemented)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *RequestHandler) ListCouponSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	summaries, err := h.couponSourceSummaries()
+	if err != nil {
+		logger.Error("Failed to fetch coupon sources:", err)
+		http.Error(w, "Failed to fetch coupon sources", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// UploadCouponSourceHandler stores the request body, plain or gzip compressed, as a new source
+func (h *RequestHandler) UploadCouponSourceHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := h.couponSources.AddSource(name, r.Body); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCouponSourceName):
+			http.Error(w, "Invalid coupon source name", http.StatusBadRequest)
+		case errors.Is(err, ErrCouponSourceExists):
+			http.Error(w, "Coupon source already exists: "+name, http.StatusConflict)
+		case errors.Is(err, ErrCouponSourceRejected):
+			logger.Error("Rejected coupon source ", name, ": ", err)
+			http.Error(w, "Coupon source could not be indexed", http.StatusUnprocessableEntity)
+		default:
+			logger.Error("Failed to add coupon source:", err)
+			http.Error(w, "Failed to add coupon source", http.StatusInternalServerError)
+		}
+		return
+	}
+	logger.Infof("Coupon source %s was uploaded", name)
+
+	summaries, err := h.couponSourceSummaries()
+	if err != nil {
+		logger.Error("Failed to fetch coupon sources:", err)
+		http.Error(w, "Failed to fetch coupon sources", http.StatusInternalServerError)
+		return
+	}
+	for _, summary := range summaries {
+		if summary.Source == name {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(summary)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *RequestHandler) DeleteCouponSourceHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := h.couponSources.RemoveSource(name); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCouponSourceName):
+			http.Error(w, "Invalid coupon source name", http.StatusBadRequest)
+		case errors.Is(err, ErrCouponSourceNotFound):
+			http.Error(w, "No coupon source found with name: "+name, http.StatusNotFound)
+		default:
+			logger.Error("Failed to remove coupon source:", err)
+			http.Error(w, "Failed to remove coupon source", http.StatusInternalServerError)
+		}
+		return
+	}
+	logger.Infof("Coupon source %s was deleted", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// couponSourceSummaries lists the CouponSource records with the number of codes of every source
+func (h *RequestHandler) couponSourceSummaries() ([]CouponSourceSummary, error) {
+	sources, err := h.coupons.ListSources()
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to fetch coupon sources")
+	}
+	var codes map[string]int64
+	if h.couponIndex != nil {
+		h.couponIndex.WithIndex(func(index *CouponIndex) error {
+			codes = index.SourceCodes()
+			return nil
+		})
+	}
+	summaries := make([]CouponSourceSummary, 0, len(sources))
+	for _, source := range sources {
+		summaries = append(summaries, CouponSourceSummary{
+			ID:     source.ID,
+			Source: source.Source,
+			Codes:  codes[source.Source],
+		})
+	}
+	return summaries, nil
+}
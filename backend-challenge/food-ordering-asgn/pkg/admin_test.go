@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gormsqlite "gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+const testAdminToken = "secret"
+
+func newAdminTestServer(t *testing.T) (*httptest.Server, *gorm.DB) {
+	// A database of its own, so the synced sources don't affect the other tests
+	db, err := gorm.Open(gormsqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&CouponSource{}, &Coupon{}))
+	repos := NewGormRepositories(db)
+
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase1"), []byte("FIFTYOFF HAPPYHRS"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase2"), []byte("FIFTYOFF"), 0o644))
+
+	watcher, err := NewCouponIndexWatcher(NewCouponIndexBuilder(), dataDir,
+		WithReloadHook(func(index *CouponIndex) error {
+			return SyncCouponSources(repos.Coupons, index)
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { watcher.Close() })
+
+	handler := NewRequestHandler(repos,
+		WithCouponIndex(watcher),
+		WithCouponSourceManager(watcher),
+		WithAdminToken(testAdminToken),
+	)
+	server := httptest.NewServer(handler.ServeHTTP())
+	t.Cleanup(server.Close)
+	return server, db
+}
+
+func adminRequest(t *testing.T, method, url string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func listCouponSources(t *testing.T, url string) []CouponSourceSummary {
+	resp := adminRequest(t, http.MethodGet, url+"/admin/coupon-sources", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var summaries []CouponSourceSummary
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summaries))
+	return summaries
+}
+
+func checkCouponCode(t *testing.T, url, code string) CouponCheck {
+	resp, err := http.Get(url + "/coupon/" + code)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var check CouponCheck
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&check))
+	return check
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	server, _ := newAdminTestServer(t)
+
+	resp, err := http.Get(server.URL + "/admin/coupon-sources")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/admin/coupon-sources/couponbase1", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Len(t, listCouponSources(t, server.URL), 2)
+}
+
+func TestAdminManagesCouponSources(t *testing.T) {
+	server, db := newAdminTestServer(t)
+
+	assert.Equal(t, []CouponSourceSummary{
+		{ID: 1, Source: "couponbase1", Codes: 2},
+		{ID: 2, Source: "couponbase2", Codes: 1},
+	}, listCouponSources(t, server.URL))
+	assert.False(t, checkCouponCode(t, server.URL, "HAPPYHRS").Valid)
+
+	// Upload a gzip compressed source
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("HAPPYHRS NINTYOFF"))
+	require.NoError(t, gz.Close())
+	resp := adminRequest(t, http.MethodPost, server.URL+"/admin/coupon-sources/couponbase3.gz", &compressed)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created CouponSourceSummary
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, "couponbase3.gz", created.Source)
+	assert.Equal(t, int64(2), created.Codes)
+	assert.True(t, checkCouponCode(t, server.URL, "HAPPYHRS").Valid)
+
+	resp = adminRequest(t, http.MethodPost, server.URL+"/admin/coupon-sources/couponbase3.gz", bytes.NewReader([]byte("HAPPYHRS")))
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = adminRequest(t, http.MethodPost, server.URL+"/admin/coupon-sources/.hidden", bytes.NewReader([]byte("HAPPYHRS")))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Deleting a source cascades through the coupon_sources join table
+	coupon := Coupon{Code: "FIFTYOFF", SourceFile: []CouponSource{{ID: 1, Source: "couponbase1"}}}
+	require.NoError(t, db.Create(&coupon).Error)
+	resp = adminRequest(t, http.MethodDelete, server.URL+"/admin/coupon-sources/couponbase1", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var joined int64
+	require.NoError(t, db.Table("coupon_sources").Where("coupon_source_id = ?", 1).Count(&joined).Error)
+	assert.Zero(t, joined)
+	summaries := listCouponSources(t, server.URL)
+	assert.Len(t, summaries, 2)
+	for _, summary := range summaries {
+		assert.NotEqual(t, "couponbase1", summary.Source)
+	}
+
+	// The valid codes are recomputed without the deleted source
+	check := checkCouponCode(t, server.URL, "FIFTYOFF")
+	assert.False(t, check.Valid)
+	assert.Equal(t, CouponTooFewSources, check.Reason)
+	assert.False(t, checkCouponCode(t, server.URL, "HAPPYHRS").Valid)
+
+	resp = adminRequest(t, http.MethodDelete, server.URL+"/admin/coupon-sources/couponbase1", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
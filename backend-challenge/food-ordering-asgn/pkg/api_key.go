@@ -0,0 +1,240 @@
+package pkg
+
+// api_key.go authenticates clients by the api_key header, as declared by the security
+// scheme of the API. Keys are random tokens, only their SHA-256 hash is stored, so a
+// leaked database doesn't leak usable keys. Every key is granted scopes, and routes
+// declare the scope they require with requireScope.
+//
+// Keys are high entropy random values rather than passwords, so a single unsalted
+// hash is enough to look them up without making them guessable.
+//
+// A key can expire and be revoked. Rotating a key replaces its value while keeping the
+// key itself, the previous value is accepted until the end of the rotation overlap so
+// clients can switch over. Every use is recorded on the key, so keys which are no
+// longer used can be found and revoked.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyHeader = "api_key"
+	// apiKeyPrefix starts every key, so leaked keys are easy to search for
+	apiKeyPrefix = "fo_"
+)
+
+var (
+	ErrAPIKeyExists  = errors.New("API key already exists")
+	ErrAPIKeyRevoked = errors.New("API key was revoked")
+	ErrAPIKeyExpired = errors.New("API key expired")
+	// ErrAPIKeyRotated is returned for the previous value of a key once the rotation overlap ended
+	ErrAPIKeyRotated = errors.New("API key was rotated")
+)
+
+// apiKeyNamePattern restricts names to what can be used in a URL path without escaping
+var apiKeyNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// APIScope grants access to a group of routes
+type APIScope string
+
+const (
+	ScopeCreateOrder APIScope = "create_order"
+	// ScopeReadOrders grants reading every order, with its lines and refunds
+	ScopeReadOrders APIScope = "read_orders"
+)
+
+// apiScopes lists every scope
+var apiScopes = []APIScope{ScopeCreateOrder, ScopeReadOrders}
+
+// Valid reports whether the scope is one of the known scopes
+func (s APIScope) Valid() bool {
+	return slices.Contains(apiScopes, s)
+}
+
+// APIKeyStatus tells whether a key can be used
+type APIKeyStatus string
+
+const (
+	APIKeyActive  APIKeyStatus = "active"
+	APIKeyExpired APIKeyStatus = "expired"
+	APIKeyRevoked APIKeyStatus = "revoked"
+)
+
+// APIKey is a key clients authenticate with. Only the hash of the key is stored.
+type APIKey struct {
+	ID      uint       `gorm:"primaryKey" json:"id"`
+	Name    string     `gorm:"not null;uniqueIndex" json:"name"`
+	KeyHash string     `gorm:"not null;uniqueIndex" json:"-"`
+	Scopes  []APIScope `gorm:"not null;serializer:json" json:"scopes"`
+	// PreviousKeyHash is the hash of the value replaced by the last rotation, which is
+	// accepted until PreviousExpiresAt
+	PreviousKeyHash   *string    `gorm:"uniqueIndex" json:"-"`
+	PreviousExpiresAt *time.Time `json:"previousExpiresAt,omitempty"`
+	RotatedAt         *time.Time `json:"rotatedAt,omitempty"`
+	ExpiresAt         *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt         *time.Time `json:"revokedAt,omitempty"`
+	// LastUsedAt is the last use of the key, PreviousLastUsedAt the last use of its
+	// previous value since the rotation
+	LastUsedAt         *time.Time `json:"lastUsedAt,omitempty"`
+	PreviousLastUsedAt *time.Time `json:"previousLastUsedAt,omitempty"`
+	UseCount           int64      `gorm:"not null;default:0" json:"useCount"`
+	CreatedAt          time.Time  `gorm:"autoCreateTime" json:"createdAt"`
+
+	// Status is filled in when keys are listed
+	Status APIKeyStatus `gorm:"-" json:"status,omitempty"`
+}
+
+// HasScope reports whether the key was granted the scope
+func (k *APIKey) HasScope(scope APIScope) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// status returns whether the key can be used at now
+func (k *APIKey) status(now time.Time) APIKeyStatus {
+	switch {
+	case k.RevokedAt != nil:
+		return APIKeyRevoked
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return APIKeyExpired
+	default:
+		return APIKeyActive
+	}
+}
+
+// authenticate checks that the value hashed to keyHash can be used at now and
+// reports whether it is the previous value of the key
+func (k *APIKey) authenticate(keyHash string, now time.Time) (bool, error) {
+	previous := keyHash != k.KeyHash
+	switch {
+	case k.status(now) == APIKeyRevoked:
+		return previous, ErrAPIKeyRevoked
+	case k.status(now) == APIKeyExpired:
+		return previous, ErrAPIKeyExpired
+	case previous && (k.PreviousExpiresAt == nil || !now.Before(*k.PreviousExpiresAt)):
+		return previous, ErrAPIKeyRotated
+	}
+	return previous, nil
+}
+
+// unusedSince reports whether the key wasn't used since the time, keys which were never
+// used count from their creation
+func (k *APIKey) unusedSince(since time.Time) bool {
+	if k.LastUsedAt == nil {
+		return k.CreatedAt.Before(since)
+	}
+	return k.LastUsedAt.Before(since)
+}
+
+// reconfigure applies a configured key and reports whether its hash was ignored. Once
+// a key was rotated its value is managed by rotations only, so a restart never reverts
+// it to the configured hash.
+func (k *APIKey) reconfigure(configured APIKeyConfig) bool {
+	k.Scopes = configured.Scopes
+	hash := strings.ToLower(configured.KeyHash)
+	if hash == k.KeyHash {
+		return false
+	}
+	if k.RotatedAt != nil {
+		return true
+	}
+	k.KeyHash = hash
+	return false
+}
+
+// APIKeyConfig registers a key from the configuration, by the hash of the key
+type APIKeyConfig struct {
+	Name string `json:"name"`
+	// KeyHash is the hex encoded SHA-256 hash of the key
+	KeyHash string     `json:"keyHash"`
+	Scopes  []APIScope `json:"scopes"`
+}
+
+// Validate checks that the key can be registered
+func (c APIKeyConfig) Validate() error {
+	if !apiKeyNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("API key name must be 1 to 64 letters, digits, '.', '_' or '-', got %q", c.Name)
+	}
+	if hash, err := hex.DecodeString(c.KeyHash); err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("API key hash must be a hex encoded SHA-256 hash, got %q", c.KeyHash)
+	}
+	for _, scope := range c.Scopes {
+		if !scope.Valid() {
+			return fmt.Errorf("unknown API key scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// generateAPIKey returns a new random key
+func generateAPIKey() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+}
+
+// hashAPIKey returns the hash keys are stored and looked up by
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey returns the key the request was authenticated with, if any
+func requestAPIKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// requireScope only passes on requests carrying a known key granted the scope. The
+// key is attached to the request context.
+func (h *RequestHandler) requireScope(scope APIScope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		plain := r.Header.Get(apiKeyHeader)
+		if plain == "" {
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+		if h.apiKeys == nil {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		hash := hashAPIKey(plain)
+		key, err := h.apiKeys.FindAPIKey(hash)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		case err != nil:
+			logger.Error("Failed to fetch API key:", err)
+			http.Error(w, "Failed to authenticate request", http.StatusInternalServerError)
+			return
+		}
+		now := h.now()
+		previous, err := key.authenticate(hash, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// A key failing to be recorded is still accepted, it only looks less recently used
+		if err := h.apiKeys.RecordAPIKeyUse(key.ID, previous, now); err != nil {
+			logger.Error("Failed to record use of API key ", key.Name, ": ", err)
+		}
+		if !key.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("API key is missing the %s scope", scope), http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
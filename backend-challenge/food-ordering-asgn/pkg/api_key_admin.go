@@ -0,0 +1,301 @@
+package pkg
+
+// api_key_admin.go manages the lifecycle of API keys, for the admin endpoints and the
+// apikeys command. The value of a key is only returned when the key is created or
+// rotated, it can't be looked up afterwards.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// DefaultAPIKeyRotationOverlap is how long the previous value of a rotated key is accepted by default
+const DefaultAPIKeyRotationOverlap = 24 * time.Hour
+
+// IssuedAPIKey is a key along with its value
+type IssuedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKeyReq creates a key, which never expires without ExpiresAt
+type CreateAPIKeyReq struct {
+	Name      string     `json:"name"`
+	Scopes    []APIScope `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// RotateAPIKeyReq rotates a key, the previous value is accepted for a day without Overlap
+type RotateAPIKeyReq struct {
+	Overlap *Duration `json:"overlap"`
+}
+
+// APIKeyExpiryReq sets when a key expires, it never expires without ExpiresAt
+type APIKeyExpiryReq struct {
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// IssueAPIKey creates a key and returns it along with its value. It returns an
+// *OrderValidationError when the request is invalid and ErrAPIKeyExists when the
+// name is taken.
+func IssueAPIKey(keys APIKeyRepository, req CreateAPIKeyReq, now time.Time) (*IssuedAPIKey, error) {
+	invalid := &OrderValidationError{}
+	if !apiKeyNamePattern.MatchString(req.Name) {
+		invalid.add("name", "must be 1 to 64 letters, digits, '.', '_' or '-', got %q", req.Name)
+	}
+	if len(req.Scopes) == 0 {
+		invalid.add("scopes", "must not be empty")
+	}
+	for i, scope := range req.Scopes {
+		if !scope.Valid() {
+			invalid.add(fmt.Sprintf("scopes[%d]", i), "unknown scope %q", scope)
+		}
+	}
+	checkAPIKeyExpiry(invalid, req.ExpiresAt, now)
+	if len(invalid.Errors) > 0 {
+		return nil, invalid
+	}
+
+	value := generateAPIKey()
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	key := APIKey{
+		Name:      req.Name,
+		KeyHash:   hashAPIKey(value),
+		Scopes:    slices.Compact(scopes),
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: now,
+	}
+	if err := keys.CreateAPIKey(&key); err != nil {
+		return nil, err
+	}
+	key.Status = key.status(now)
+	return &IssuedAPIKey{APIKey: key, Key: value}, nil
+}
+
+// RotateAPIKey replaces the value of the key and returns the key along with its new
+// value. The previous value is accepted for the overlap, a value replaced by an
+// earlier rotation stops being accepted right away.
+func RotateAPIKey(keys APIKeyRepository, name string, overlap time.Duration, now time.Time) (*IssuedAPIKey, error) {
+	if overlap < 0 {
+		invalid := &OrderValidationError{}
+		invalid.add("overlap", "must not be negative, got %s", overlap)
+		return nil, invalid
+	}
+	value := generateAPIKey()
+	key, err := keys.UpdateAPIKey(name, func(key *APIKey) error {
+		if key.RevokedAt != nil {
+			return ErrAPIKeyRevoked
+		}
+		previous, until := key.KeyHash, now.Add(overlap)
+		key.KeyHash = hashAPIKey(value)
+		key.PreviousKeyHash, key.PreviousExpiresAt, key.PreviousLastUsedAt = &previous, &until, nil
+		key.RotatedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	key.Status = key.status(now)
+	return &IssuedAPIKey{APIKey: *key, Key: value}, nil
+}
+
+// RevokeAPIKey stops accepting every value of the key for good
+func RevokeAPIKey(keys APIKeyRepository, name string, now time.Time) (*APIKey, error) {
+	key, err := keys.UpdateAPIKey(name, func(key *APIKey) error {
+		if key.RevokedAt != nil {
+			return ErrAPIKeyRevoked
+		}
+		key.RevokedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	key.Status = key.status(now)
+	return key, nil
+}
+
+// SetAPIKeyExpiry sets when the key expires, a nil expiresAt removes the expiry. An
+// expired key can be extended, a revoked key can't.
+func SetAPIKeyExpiry(keys APIKeyRepository, name string, expiresAt *time.Time, now time.Time) (*APIKey, error) {
+	invalid := &OrderValidationError{}
+	if checkAPIKeyExpiry(invalid, expiresAt, now); len(invalid.Errors) > 0 {
+		return nil, invalid
+	}
+	key, err := keys.UpdateAPIKey(name, func(key *APIKey) error {
+		if key.RevokedAt != nil {
+			return ErrAPIKeyRevoked
+		}
+		key.ExpiresAt = expiresAt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	key.Status = key.status(now)
+	return key, nil
+}
+
+// ListAPIKeys returns the keys with their status at now, only the keys not used since
+// unusedSince when it is given
+func ListAPIKeys(keys APIKeyRepository, unusedSince *time.Time, now time.Time) ([]APIKey, error) {
+	stored, err := keys.ListAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]APIKey, 0, len(stored))
+	for _, key := range stored {
+		if unusedSince != nil && !key.unusedSince(*unusedSince) {
+			continue
+		}
+		key.Status = key.status(now)
+		listed = append(listed, key)
+	}
+	return listed, nil
+}
+
+func checkAPIKeyExpiry(invalid *OrderValidationError, expiresAt *time.Time, now time.Time) {
+	if expiresAt != nil && !expiresAt.After(now) {
+		invalid.add("expiresAt", "must be in the future, got %s", expiresAt.Format(time.RFC3339))
+	}
+}
+
+// ListAPIKeysHandler lists the keys, only the keys unused since the unusedSince date or
+// timestamp when it is given
+func (h *RequestHandler) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var unusedSince *time.Time
+	if value := r.URL.Query().Get("unusedSince"); value != "" {
+		since, err := parseOrderQueryTime(value, h.location, false)
+		if err != nil {
+			invalid := &OrderValidationError{}
+			invalid.add("unusedSince", "must be a date or an RFC 3339 timestamp, got %q", value)
+			writeValidationError(w, "Invalid API key query", invalid)
+			return
+		}
+		unusedSince = &since
+	}
+
+	keys, err := ListAPIKeys(h.apiKeys, unusedSince, h.now())
+	if err != nil {
+		logger.Error("Failed to fetch API keys:", err)
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateAPIKeyHandler creates a key and returns its value, which is only shown once
+func (h *RequestHandler) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("Failed to parse API key request body:", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	issued, err := IssueAPIKey(h.apiKeys, req, h.now())
+	if err != nil {
+		writeAPIKeyError(w, req.Name, err)
+		return
+	}
+	logger.Infof("API key %s was created", issued.Name)
+	writeIssuedAPIKey(w, http.StatusCreated, issued)
+}
+
+// RotateAPIKeyHandler replaces the value of a key and returns the new value, which is
+// only shown once. The request body is optional.
+func (h *RequestHandler) RotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req RotateAPIKeyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.Error("Failed to parse API key rotation request body:", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	overlap := DefaultAPIKeyRotationOverlap
+	if req.Overlap != nil {
+		overlap = time.Duration(*req.Overlap)
+	}
+
+	issued, err := RotateAPIKey(h.apiKeys, name, overlap, h.now())
+	if err != nil {
+		writeAPIKeyError(w, name, err)
+		return
+	}
+	logger.Infof("API key %s was rotated, the previous value is accepted until %s", name, issued.PreviousExpiresAt.Format(time.RFC3339))
+	writeIssuedAPIKey(w, http.StatusOK, issued)
+}
+
+func (h *RequestHandler) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	key, err := RevokeAPIKey(h.apiKeys, name, h.now())
+	if err != nil {
+		writeAPIKeyError(w, name, err)
+		return
+	}
+	logger.Infof("API key %s was revoked", name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(key)
+}
+
+func (h *RequestHandler) SetAPIKeyExpiryHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req APIKeyExpiryReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("Failed to parse API key expiry request body:", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, err := SetAPIKeyExpiry(h.apiKeys, name, req.ExpiresAt, h.now())
+	if err != nil {
+		writeAPIKeyError(w, name, err)
+		return
+	}
+	if key.ExpiresAt != nil {
+		logger.Infof("API key %s expires at %s", name, key.ExpiresAt.Format(time.RFC3339))
+	} else {
+		logger.Infof("API key %s no longer expires", name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(key)
+}
+
+// writeIssuedAPIKey returns a key along with its value, which must not be cached
+func writeIssuedAPIKey(w http.ResponseWriter, status int, issued *IssuedAPIKey) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(issued)
+}
+
+// writeAPIKeyError reports why the key with the name couldn't be changed
+func writeAPIKeyError(w http.ResponseWriter, name string, err error) {
+	var invalid *OrderValidationError
+	switch {
+	case errors.As(err, &invalid):
+		writeValidationError(w, "Invalid API key", err)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "No API key found with name: "+name, http.StatusNotFound)
+	case errors.Is(err, ErrAPIKeyExists):
+		http.Error(w, "API key already exists: "+name, http.StatusConflict)
+	case errors.Is(err, ErrAPIKeyRevoked):
+		http.Error(w, "API key was revoked: "+name, http.StatusConflict)
+	default:
+		logger.Error("Failed to update API key ", name, ": ", err)
+		http.Error(w, "Failed to update API key", http.StatusInternalServerError)
+	}
+}
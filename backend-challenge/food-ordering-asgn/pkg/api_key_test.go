@@ -0,0 +1,248 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyConfigValidate(t *testing.T) {
+	hash := hashAPIKey("fo_example")
+	assert.NoError(t, APIKeyConfig{Name: "shop", KeyHash: hash, Scopes: []APIScope{ScopeCreateOrder}}.Validate())
+	assert.NoError(t, APIKeyConfig{Name: "shop", KeyHash: strings.ToUpper(hash)}.Validate())
+	assert.Error(t, APIKeyConfig{Name: " ", KeyHash: hash}.Validate())
+	assert.Error(t, APIKeyConfig{Name: "shop", KeyHash: hash[:62]}.Validate())
+	assert.Error(t, APIKeyConfig{Name: "shop", KeyHash: "fo_example"}.Validate())
+	assert.Error(t, APIKeyConfig{Name: "shop", KeyHash: hash, Scopes: []APIScope{"delete_order"}}.Validate())
+}
+
+func (suite *HandlerTestSuite) TestCreateOrderRequiresAPIKey() {
+	jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "1", Quantity: 1}}})
+	require.NoError(suite.T(), err)
+	order := func(apiKey string) int {
+		req, err := http.NewRequest(http.MethodPost, suite.server.URL+"/order", bytes.NewBuffer(jsonData))
+		require.NoError(suite.T(), err)
+		if apiKey != "" {
+			req.Header.Set("api_key", apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(suite.T(), err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(suite.T(), http.StatusUnauthorized, order(""))
+	assert.Equal(suite.T(), http.StatusUnauthorized, order(generateAPIKey()))
+	assert.Equal(suite.T(), http.StatusForbidden, order(suite.createAPIKey("readonly")))
+	assert.Equal(suite.T(), http.StatusOK, order(suite.apiKey))
+
+	// Keys configured by their hash replace the keys with the same name
+	key := generateAPIKey()
+	err = ConfigureAPIKeys(suite.repos.APIKeys, []APIKeyConfig{{Name: "readonly", KeyHash: hashAPIKey(key), Scopes: []APIScope{ScopeCreateOrder}}})
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), http.StatusOK, order(key))
+}
+
+func (suite *HandlerTestSuite) TestReadOrdersRequiresAPIKey() {
+	jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "1", Quantity: 1}}})
+	require.NoError(suite.T(), err)
+	resp, err := suite.postOrder(jsonData)
+	require.NoError(suite.T(), err)
+	var placed Order
+	require.NoError(suite.T(), json.NewDecoder(resp.Body).Decode(&placed))
+	resp.Body.Close()
+
+	read := func(path, apiKey string) int {
+		req, err := http.NewRequest(http.MethodGet, suite.server.URL+path, nil)
+		require.NoError(suite.T(), err)
+		if apiKey != "" {
+			req.Header.Set("api_key", apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(suite.T(), err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	orderingOnly := suite.createAPIKey("ordering-only", ScopeCreateOrder)
+	for _, path := range []string{"/orders", "/order/" + placed.PublicID, "/order/" + placed.PublicID + "/refunds"} {
+		assert.Equal(suite.T(), http.StatusUnauthorized, read(path, ""), path)
+		assert.Equal(suite.T(), http.StatusForbidden, read(path, orderingOnly), path)
+		assert.Equal(suite.T(), http.StatusOK, read(path, suite.apiKey), path)
+	}
+}
+
+func (suite *HandlerTestSuite) TestClaimLegacyRedemptions() {
+	// Before keys were registered, redemptions were recorded by a digest of the api_key header
+	hash := hashAPIKey("fo_legacy_key")
+	order := &Order{
+		Status: OrderPlaced,
+		Items:  []OrderLine{{ProductID: 1, Name: "Margherita Pizza", UnitPrice: 12.99, Quantity: 1}},
+		Total:  12.99,
+	}
+	redemption := &CouponRedemption{Code: "LEGACY", Customer: "key:" + hash[:16]}
+	require.NoError(suite.T(), suite.repos.Orders.CreateOrder(order, redemption, CouponLimits{}))
+
+	require.NoError(suite.T(), ConfigureAPIKeys(suite.repos.APIKeys, []APIKeyConfig{{Name: "legacy", KeyHash: hash, Scopes: []APIScope{ScopeCreateOrder}}}))
+	require.NoError(suite.T(), ClaimLegacyRedemptions(suite.repos.Coupons, suite.repos.APIKeys))
+	key, err := suite.repos.APIKeys.FindAPIKey(hash)
+	require.NoError(suite.T(), err)
+	redemptions, err := suite.repos.Coupons.CountRedemptions("LEGACY", apiKeyCustomerKey(key.ID))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), redemptions)
+	redemptions, err = suite.repos.Coupons.CountRedemptions("LEGACY", "key:"+hash[:16])
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), redemptions)
+
+	// Claiming again moves nothing
+	require.NoError(suite.T(), ClaimLegacyRedemptions(suite.repos.Coupons, suite.repos.APIKeys))
+	redemptions, err = suite.repos.Coupons.CountRedemptions("LEGACY", "")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), redemptions)
+}
+
+func (suite *HandlerTestSuite) TestAPIKeyLifecycle() {
+	now := time.Date(2030, 5, 1, 9, 0, 0, 0, time.UTC)
+	handler := NewRequestHandler(suite.repos,
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+	).ServeHTTP()
+	admin := func(method, target string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			jsonData, err := json.Marshal(body)
+			require.NoError(suite.T(), err)
+			reader = bytes.NewBuffer(jsonData)
+		}
+		req := httptest.NewRequest(method, target, reader)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	order := func(apiKey string) *httptest.ResponseRecorder {
+		jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "1", Quantity: 1}}})
+		require.NoError(suite.T(), err)
+		req := httptest.NewRequest(http.MethodPost, "/order", bytes.NewBuffer(jsonData))
+		req.Header.Set("api_key", apiKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	lifecycleKey := func(query string) *APIKey {
+		rec := admin(http.MethodGet, "/admin/api-keys"+query, nil)
+		require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+		var keys []APIKey
+		require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&keys))
+		for _, key := range keys {
+			if key.Name == "lifecycle" {
+				return &key
+			}
+		}
+		return nil
+	}
+
+	// The key is only shown when it is created
+	rec := admin(http.MethodPost, "/admin/api-keys", CreateAPIKeyReq{Name: "lifecycle", Scopes: []APIScope{ScopeCreateOrder}})
+	require.Equal(suite.T(), http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(suite.T(), "no-store", rec.Header().Get("Cache-Control"))
+	var issued IssuedAPIKey
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&issued))
+	assert.True(suite.T(), strings.HasPrefix(issued.Key, apiKeyPrefix))
+	assert.Equal(suite.T(), APIKeyActive, issued.Status)
+	key := lifecycleKey("")
+	require.NotNil(suite.T(), key)
+	assert.NotContains(suite.T(), admin(http.MethodGet, "/admin/api-keys", nil).Body.String(), issued.Key)
+	assert.Nil(suite.T(), key.LastUsedAt)
+
+	assert.Equal(suite.T(), http.StatusConflict, admin(http.MethodPost, "/admin/api-keys", CreateAPIKeyReq{Name: "lifecycle", Scopes: []APIScope{ScopeCreateOrder}}).Code)
+	rec = admin(http.MethodPost, "/admin/api-keys", CreateAPIKeyReq{Name: "life cycle", Scopes: []APIScope{"delete_order"}})
+	assert.Equal(suite.T(), http.StatusBadRequest, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), `"field":"scopes[0]"`)
+
+	// Every use is recorded
+	assert.Equal(suite.T(), http.StatusOK, order(issued.Key).Code)
+	key = lifecycleKey("")
+	require.NotNil(suite.T(), key.LastUsedAt)
+	assert.True(suite.T(), now.Equal(*key.LastUsedAt))
+	assert.Equal(suite.T(), int64(1), key.UseCount)
+	assert.Nil(suite.T(), lifecycleKey("?unusedSince=2030-05-01T09:00:00Z"))
+	assert.NotNil(suite.T(), lifecycleKey("?unusedSince=2030-05-02"))
+
+	// Both values are accepted during the rotation overlap
+	now = now.Add(time.Hour)
+	rec = admin(http.MethodPost, "/admin/api-keys/lifecycle/rotate", map[string]string{"overlap": "1h"})
+	require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+	var rotated IssuedAPIKey
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&rotated))
+	assert.NotEqual(suite.T(), issued.Key, rotated.Key)
+	assert.Equal(suite.T(), issued.ID, rotated.ID)
+	assert.Equal(suite.T(), http.StatusOK, order(issued.Key).Code)
+	assert.Equal(suite.T(), http.StatusOK, order(rotated.Key).Code)
+	key = lifecycleKey("")
+	require.NotNil(suite.T(), key.PreviousLastUsedAt)
+	assert.True(suite.T(), now.Equal(*key.PreviousLastUsedAt))
+	assert.Equal(suite.T(), int64(3), key.UseCount)
+
+	now = now.Add(time.Hour)
+	rec = order(issued.Key)
+	assert.Equal(suite.T(), http.StatusUnauthorized, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), "API key was rotated")
+	assert.Equal(suite.T(), http.StatusOK, order(rotated.Key).Code)
+
+	// A restart doesn't bring back the value the key was rotated away from
+	err := ConfigureAPIKeys(suite.repos.APIKeys, []APIKeyConfig{{Name: "lifecycle", KeyHash: hashAPIKey(issued.Key), Scopes: []APIScope{ScopeCreateOrder}}})
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), http.StatusUnauthorized, order(issued.Key).Code)
+	assert.Equal(suite.T(), http.StatusOK, order(rotated.Key).Code)
+
+	// Nor does it once the configured value is neither the current nor the previous one
+	previous := rotated.Key
+	rec = admin(http.MethodPost, "/admin/api-keys/lifecycle/rotate", map[string]string{"overlap": "1h"})
+	require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&rotated))
+	rec = admin(http.MethodPost, "/admin/api-keys/lifecycle/rotate", map[string]string{"overlap": "1h"})
+	require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&rotated))
+	err = ConfigureAPIKeys(suite.repos.APIKeys, []APIKeyConfig{{Name: "lifecycle", KeyHash: hashAPIKey(issued.Key), Scopes: []APIScope{ScopeCreateOrder}}})
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), http.StatusUnauthorized, order(issued.Key).Code)
+	assert.Equal(suite.T(), http.StatusUnauthorized, order(previous).Code)
+	assert.Equal(suite.T(), http.StatusOK, order(rotated.Key).Code)
+
+	// Expired keys are rejected until their expiry is extended
+	expiresAt := now.Add(time.Hour)
+	rec = admin(http.MethodPut, "/admin/api-keys/lifecycle/expiry", APIKeyExpiryReq{ExpiresAt: &expiresAt})
+	require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+	now = expiresAt
+	rec = order(rotated.Key)
+	assert.Equal(suite.T(), http.StatusUnauthorized, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), "API key expired")
+	assert.Equal(suite.T(), APIKeyExpired, lifecycleKey("").Status)
+	assert.Equal(suite.T(), http.StatusBadRequest, admin(http.MethodPut, "/admin/api-keys/lifecycle/expiry", APIKeyExpiryReq{ExpiresAt: &expiresAt}).Code)
+	assert.Equal(suite.T(), http.StatusOK, admin(http.MethodPut, "/admin/api-keys/lifecycle/expiry", APIKeyExpiryReq{}).Code)
+	assert.Equal(suite.T(), http.StatusOK, order(rotated.Key).Code)
+
+	// Revoked keys are rejected for good
+	rec = admin(http.MethodPost, "/admin/api-keys/lifecycle/revoke", nil)
+	require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+	rec = order(rotated.Key)
+	assert.Equal(suite.T(), http.StatusUnauthorized, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), "API key was revoked")
+	assert.Equal(suite.T(), APIKeyRevoked, lifecycleKey("").Status)
+	assert.Equal(suite.T(), http.StatusConflict, admin(http.MethodPost, "/admin/api-keys/lifecycle/revoke", nil).Code)
+	assert.Equal(suite.T(), http.StatusConflict, admin(http.MethodPost, "/admin/api-keys/lifecycle/rotate", nil).Code)
+
+	assert.Equal(suite.T(), http.StatusNotFound, admin(http.MethodPost, "/admin/api-keys/missing/rotate", nil).Code)
+	req := httptest.NewRequest(http.MethodGet, "/admin/api-keys", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(suite.T(), http.StatusUnauthorized, rec.Code)
+}
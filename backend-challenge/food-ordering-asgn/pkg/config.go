@@ -0,0 +1,212 @@
+package pkg
+
+// config.go loads the server configuration. Settings are read from an optional JSON
+// file and can be overridden by environment variables, so different promotion rules
+// can be run without code changes.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+type Config struct {
+	// Addr is the address the server listens on
+	Addr string `json:"addr"`
+	// DatabasePath is the Sqlite database file, the database is kept in memory when empty
+	DatabasePath string `json:"databasePath"`
+	// DataDir holds the coupon source files
+	DataDir string `json:"dataDir"`
+	// IndexDir holds the coupon index snapshot
+	IndexDir string `json:"indexDir"`
+	// IndexWorkers is the number of coupon sources indexed concurrently, 0 uses one per CPU
+	IndexWorkers int `json:"indexWorkers"`
+	// WatchInterval is how often DataDir is checked for changed sources, 0 disables reloading
+	WatchInterval Duration `json:"watchInterval"`
+	// CouponCharClasses are the characters coupon codes are made of
+	CouponCharClasses []CouponCharClass `json:"couponCharClasses"`
+	// CouponPolicy decides which coupon codes are valid
+	CouponPolicy CouponPolicy `json:"couponPolicy"`
+	// StoreTimezone is the IANA timezone coupon schedules are evaluated in
+	StoreTimezone string `json:"storeTimezone"`
+	// CouponLimits caps the redemptions of coupons, keyed by code
+	CouponLimits map[string]CouponLimits `json:"couponLimits"`
+	// OrderLimits caps the quantities of an order
+	OrderLimits OrderLimits `json:"orderLimits"`
+	// IdempotencyTTL is how long the responses of requests with an Idempotency-Key are kept
+	IdempotencyTTL Duration `json:"idempotencyTTL"`
+	// AdminToken is the bearer token of the admin endpoints, which are disabled without it
+	AdminToken string `json:"adminToken"`
+	// APIKeys are the keys clients place orders with, registered by their hash
+	APIKeys []APIKeyConfig `json:"apiKeys"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:              ":8080",
+		IndexDir:          ".coupon-index",
+		WatchInterval:     Duration(defaultCouponWatchInterval),
+		StoreTimezone:     "UTC",
+		CouponCharClasses: slices.Clone(defaultCouponCharClasses),
+		CouponPolicy:      DefaultCouponPolicy(),
+		OrderLimits:       DefaultOrderLimits(),
+		IdempotencyTTL:    Duration(defaultIdempotencyKeyTTL),
+	}
+}
+
+// LoadConfig reads the configuration file at path, if any, on top of the defaults
+// and applies the overrides from the environment
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, utils.WrapError(err, "failed to read config file")
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, utils.WrapError(err, "failed to parse config file "+path)
+		}
+	}
+
+	if addr := os.Getenv("ADDR"); addr != "" {
+		config.Addr = addr
+	}
+	if path := os.Getenv("DATABASE_PATH"); path != "" {
+		config.DatabasePath = path
+	}
+	if dir := os.Getenv("COUPON_DATA_DIR"); dir != "" {
+		config.DataDir = dir
+	}
+	if dir := os.Getenv("COUPON_INDEX_DIR"); dir != "" {
+		config.IndexDir = dir
+	}
+	if timezone := os.Getenv("STORE_TIMEZONE"); timezone != "" {
+		config.StoreTimezone = timezone
+	}
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		config.AdminToken = token
+	}
+	if classes := os.Getenv("COUPON_CHAR_CLASSES"); classes != "" {
+		config.CouponCharClasses = ParseCouponCharClasses(classes)
+	}
+	if workers := os.Getenv("COUPON_INDEX_WORKERS"); workers != "" {
+		value, err := strconv.Atoi(workers)
+		if err != nil {
+			return nil, utils.WrapError(err, "invalid COUPON_INDEX_WORKERS")
+		}
+		config.IndexWorkers = value
+	}
+	if quantity := os.Getenv("MAX_LINE_QUANTITY"); quantity != "" {
+		value, err := strconv.Atoi(quantity)
+		if err != nil {
+			return nil, utils.WrapError(err, "invalid MAX_LINE_QUANTITY")
+		}
+		config.OrderLimits.MaxLineQuantity = value
+	}
+	if quantity := os.Getenv("MAX_ORDER_QUANTITY"); quantity != "" {
+		value, err := strconv.Atoi(quantity)
+		if err != nil {
+			return nil, utils.WrapError(err, "invalid MAX_ORDER_QUANTITY")
+		}
+		config.OrderLimits.MaxOrderQuantity = value
+	}
+
+	if interval := os.Getenv("COUPON_WATCH_INTERVAL"); interval != "" {
+		value, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, utils.WrapError(err, "invalid COUPON_WATCH_INTERVAL")
+		}
+		config.WatchInterval = Duration(value)
+	}
+	if ttl := os.Getenv("IDEMPOTENCY_TTL"); ttl != "" {
+		value, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, utils.WrapError(err, "invalid IDEMPOTENCY_TTL")
+		}
+		config.IdempotencyTTL = Duration(value)
+	}
+
+	if config.DataDir == "" {
+		dir, err := DefaultCouponDataDir()
+		if err != nil {
+			return nil, err
+		}
+		config.DataDir = dir
+	}
+	if err := config.CouponPolicy.Validate(); err != nil {
+		return nil, utils.WrapError(err, "invalid coupon policy")
+	}
+	for code, limits := range config.CouponLimits {
+		if err := limits.Validate(); err != nil {
+			return nil, utils.WrapError(err, "invalid limits for coupon "+code)
+		}
+	}
+	names := map[string]bool{}
+	for _, key := range config.APIKeys {
+		if err := key.Validate(); err != nil {
+			return nil, utils.WrapError(err, "invalid API key "+key.Name)
+		}
+		if names[key.Name] {
+			return nil, errors.New("duplicate API key " + key.Name)
+		}
+		names[key.Name] = true
+	}
+	if config.IdempotencyTTL <= 0 {
+		return nil, errors.New("idempotency TTL must be positive")
+	}
+	if err := config.OrderLimits.Validate(); err != nil {
+		return nil, utils.WrapError(err, "invalid order limits")
+	}
+	if _, err := config.CouponTokenizer(); err != nil {
+		return nil, utils.WrapError(err, "invalid coupon character classes")
+	}
+	if _, err := config.StoreLocation(); err != nil {
+		return nil, utils.WrapError(err, "invalid store timezone")
+	}
+	return &config, nil
+}
+
+// CouponTokenizer creates the tokenizer matching the configured codes
+func (c *Config) CouponTokenizer() (*CouponTokenizer, error) {
+	tokenizer, err := NewCouponTokenizer(c.CouponCharClasses...)
+	if err != nil {
+		return nil, err
+	}
+	if c.CouponPolicy.CaseInsensitive {
+		tokenizer = tokenizer.WithCaseFolding()
+	}
+	return tokenizer, nil
+}
+
+// StoreLocation loads the configured store timezone
+func (c *Config) StoreLocation() (*time.Location, error) {
+	return time.LoadLocation(c.StoreTimezone)
+}
+
+// Duration is a time.Duration written as a string like "10s" in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"couponCharClasses": ["upper", "digit"],
+		"couponPolicy": {"minSources": 1, "excludedSources": ["c1.txt"], "caseInsensitive": true}
+	}`), 0o644)
+	require.NoError(t, err)
+	t.Setenv("COUPON_INDEX_DIR", "/tmp/coupons")
+	t.Setenv("MAX_LINE_QUANTITY", "20")
+
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", config.Addr)
+	assert.Equal(t, "/tmp/coupons", config.IndexDir)
+	assert.NotEmpty(t, config.DataDir)
+	assert.Equal(t, OrderLimits{MaxLineQuantity: 20, MaxOrderQuantity: defaultMaxOrderQuantity}, config.OrderLimits)
+	assert.Equal(t, CouponPolicy{MinSources: 1, ExcludedSources: []string{"c1.txt"}, CaseInsensitive: true}, config.CouponPolicy)
+
+	tokenizer, err := config.CouponTokenizer()
+	require.NoError(t, err)
+	assert.True(t, tokenizer.IsCode("happy100"))
+	assert.Equal(t, "HAPPY100", tokenizer.Normalize("happy100"))
+
+	// Invalid policies and unknown settings are rejected
+	require.NoError(t, os.WriteFile(path, []byte(`{"couponPolicy": {"minSources": 0}}`), 0o644))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(`{"couponLimits": {"HAPPYHOURS": {"maxUses": -1}}}`), 0o644))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(`{"orderLimits": {"maxOrderQuantity": -1}}`), 0o644))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(`{"storeTimezone": "Mars/Olympus"}`), 0o644))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(`{"apiKeys": [{"name": "shop", "keyHash": "not-a-hash", "scopes": ["create_order"]}]}`), 0o644))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(`{"minSources": 2}`), 0o644))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestCaseInsensitiveCouponIndex(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("HappyHrs"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("HAPPYHRS"), 0o644))
+
+	index, err := NewCouponIndexBuilder(WithIndexTokenizer(defaultCouponTokenizer().WithCaseFolding())).Build(dir)
+	require.NoError(t, err)
+	defer index.Close()
+
+	sources, found, err := index.Lookup("happyhrs")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, sources)
+}
@@ -0,0 +1,631 @@
+package pkg
+
+// coupon_index.go implements the coupon index used to validate promo codes.
+//
+// The coupon sources are far too big to hold in memory or to store as one database
+// row per code, so the index is built on disk in two phases with bounded memory:
+//
+//  1. Every source is turned into a sorted set of unique codes. Codes are collected
+//     in chunks of at most chunkSize keys, each chunk is sorted and written as a run,
+//     and the runs are merged into the source's set file (external sort).
+//  2. The source sets are merged (k-way merge) into a single index file. Each record
+//     holds a code and a bitmask of the sources it was found in.
+//
+// The sets and the index are kept as a snapshot, see coupon_snapshot.go.
+//
+// Lookups binary search an in-memory sparse index holding the first key of every block,
+// then read and search that single block from disk.
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+const (
+	// maxCouponCodeLength is the width of a key in the index files
+	maxCouponCodeLength = 10
+	// maxCouponSources is the number of sources a record's bitmask can represent
+	maxCouponSources = 64
+
+	couponRecordSize      = maxCouponCodeLength + 8
+	couponRecordsPerBlock = 256
+	couponBlockSize       = couponRecordSize * couponRecordsPerBlock
+
+	defaultCouponChunkSize = 1 << 21
+	couponIndexFileName    = "coupons.idx"
+)
+
+// couponKey is a coupon code padded with zero bytes. Zero sorts before any
+// code character, so comparing keys orders codes lexicographically.
+type couponKey [maxCouponCodeLength]byte
+
+func newCouponKey(code string) (couponKey, bool) {
+	var key couponKey
+	if len(code) == 0 || len(code) > maxCouponCodeLength {
+		return key, false
+	}
+	copy(key[:], code)
+	return key, true
+}
+
+func (k couponKey) String() string {
+	return string(bytes.TrimRight(k[:], "\x00"))
+}
+
+func compareCouponKeys(a, b couponKey) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// CouponIndex answers which sources contain a coupon code
+type CouponIndex struct {
+	tokenizer *CouponTokenizer
+	sources   []string
+	file      *os.File
+	count     int64
+	blockKeys []couponKey
+	workDir   string
+	ownsDir   bool
+	// codeCounts holds the number of distinct codes of every source
+	codeCounts []int64
+	// rebuiltSources lists the sources which had to be scanned to build the index
+	rebuiltSources []string
+}
+
+type CouponIndexBuilder struct {
+	workDir          string
+	chunkSize        int
+	tokenizer        *CouponTokenizer
+	workers          int
+	progressInterval time.Duration
+}
+
+// WithIndexWorkDir sets the directory the index snapshot is kept in, so it can be
+// reused after a restart. By default a temporary directory is used and removed
+// when the index is closed.
+func WithIndexWorkDir(dir string) func(*CouponIndexBuilder) {
+	return func(b *CouponIndexBuilder) {
+		b.workDir = dir
+	}
+}
+
+// WithIndexChunkSize bounds the number of codes held in memory while sorting a source
+func WithIndexChunkSize(size int) func(*CouponIndexBuilder) {
+	return func(b *CouponIndexBuilder) {
+		if size > 0 {
+			b.chunkSize = size
+		}
+	}
+}
+
+// WithIndexTokenizer sets the tokenizer extracting the codes from the sources
+func WithIndexTokenizer(tokenizer *CouponTokenizer) func(*CouponIndexBuilder) {
+	return func(b *CouponIndexBuilder) {
+		if tokenizer != nil {
+			b.tokenizer = tokenizer
+		}
+	}
+}
+
+// WithIndexWorkers sets the number of sources scanned concurrently
+func WithIndexWorkers(workers int) func(*CouponIndexBuilder) {
+	return func(b *CouponIndexBuilder) {
+		if workers > 0 {
+			b.workers = workers
+		}
+	}
+}
+
+// WithIndexProgressInterval sets how often the ingestion progress is logged
+func WithIndexProgressInterval(interval time.Duration) func(*CouponIndexBuilder) {
+	return func(b *CouponIndexBuilder) {
+		if interval > 0 {
+			b.progressInterval = interval
+		}
+	}
+}
+
+func NewCouponIndexBuilder(opts ...func(*CouponIndexBuilder)) *CouponIndexBuilder {
+	builder := &CouponIndexBuilder{
+		chunkSize:        defaultCouponChunkSize,
+		tokenizer:        defaultCouponTokenizer(),
+		workers:          runtime.NumCPU(),
+		progressInterval: defaultIngestProgressInterval,
+	}
+	for _, opt := range opts {
+		opt(builder)
+	}
+	return builder
+}
+
+// Build indexes every file found in dirPath
+func (b *CouponIndexBuilder) Build(dirPath string) (*CouponIndex, error) {
+	files, err := getFilesInDirectory(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > maxCouponSources {
+		return nil, fmt.Errorf("too many coupon sources: %d, at most %d are supported", len(files), maxCouponSources)
+	}
+
+	workDir, ownsDir := b.workDir, false
+	if workDir == "" {
+		if workDir, err = os.MkdirTemp("", "coupon-index-*"); err != nil {
+			return nil, utils.WrapError(err, "failed to create coupon index directory")
+		}
+		ownsDir = true
+	} else if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return nil, utils.WrapError(err, "failed to create coupon index directory")
+	}
+
+	index, err := b.build(files, workDir)
+	if err != nil {
+		if ownsDir {
+			os.RemoveAll(workDir)
+		}
+		return nil, err
+	}
+	index.workDir, index.ownsDir = workDir, ownsDir
+	return index, nil
+}
+
+func (b *CouponIndexBuilder) build(files []string, workDir string) (*CouponIndex, error) {
+	sources, err := describeSources(files)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		names = append(names, source.Name)
+	}
+
+	previous := loadSnapshotManifest(workDir, b.tokenizer)
+	if previous != nil && previous.matches(sources, workDir) {
+		index, err := openCouponIndex(filepath.Join(workDir, previous.Index), names, b.tokenizer)
+		if err == nil {
+			index.codeCounts = countSetCodes(sources, workDir)
+			logger.Infof("Loaded coupon index snapshot from %s", workDir)
+			return index, nil
+		}
+		logger.Warn("Failed to load coupon index snapshot, rebuilding: ", err)
+	}
+
+	var (
+		rebuilt []string
+		pending []couponSnapshotSource
+	)
+	setPaths := make([]string, 0, len(sources))
+	queued := make(map[string]bool)
+	for _, source := range sources {
+		setPaths = append(setPaths, filepath.Join(workDir, source.Set))
+		if previous != nil && previous.hasSet(source, workDir) {
+			continue
+		}
+		rebuilt = append(rebuilt, source.Name)
+		// Sources with identical content share their set
+		if !queued[source.Set] {
+			queued[source.Set] = true
+			pending = append(pending, source)
+		}
+	}
+
+	progress := newIngestProgress(pending)
+	stopReporting := progress.report(b.progressInterval)
+	err = b.buildSourceSets(pending, workDir, progress)
+	stopReporting()
+	if err != nil {
+		return nil, err
+	}
+
+	indexPath := filepath.Join(workDir, couponIndexFileName)
+	if err := mergeSourceSets(setPaths, indexPath+".tmp"); err != nil {
+		return nil, utils.WrapError(err, "failed to merge coupon sources")
+	}
+	if err := os.Rename(indexPath+".tmp", indexPath); err != nil {
+		return nil, utils.WrapError(err, "failed to store coupon index")
+	}
+	index, err := openCouponIndex(indexPath, names, b.tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	index.rebuiltSources = rebuilt
+	index.codeCounts = countSetCodes(sources, workDir)
+
+	manifest := couponSnapshotManifest{
+		Version:   couponSnapshotVersion,
+		Tokenizer: b.tokenizer.String(),
+		Sources:   sources,
+		Index:     couponIndexFileName,
+		IndexSize: index.count * couponRecordSize,
+	}
+	if err := writeSnapshotManifest(workDir, manifest); err != nil {
+		index.Close()
+		return nil, err
+	}
+	removeStaleSets(workDir, sources)
+	logger.Infof("Built coupon index in %s, rebuilt sources: %v", workDir, rebuilt)
+	return index, nil
+}
+
+// buildSourceSet writes the sorted set of unique codes found in a single source
+func (b *CouponIndexBuilder) buildSourceSet(file string, setPath string, progress *ingestProgress) error {
+	reader, err := openCouponSource(file, &progress.bytesRead)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var runs []string
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+
+	chunk := make([]couponKey, 0, min(b.chunkSize, 1<<16))
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		run := fmt.Sprintf("%s.run-%d", setPath, len(runs))
+		runs = append(runs, run)
+		slices.SortFunc(chunk, compareCouponKeys)
+		chunk = slices.Compact(chunk)
+		if err := writeKeys(run, chunk); err != nil {
+			return err
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+
+	tokens := 0
+	scanner := fileScanner(reader, b.tokenizer)
+	for scanner.Scan() {
+		key, ok := newCouponKey(b.tokenizer.Normalize(scanner.Text()))
+		if !ok {
+			continue
+		}
+		if tokens++; tokens == ingestTokenBatch {
+			progress.tokensSeen.Add(int64(tokens))
+			tokens = 0
+		}
+		chunk = append(chunk, key)
+		if len(chunk) >= b.chunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	progress.tokensSeen.Add(int64(tokens))
+	if err := scanner.Err(); err != nil {
+		return utils.WrapError(err, "error reading file")
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	streams := make([]*keyStream, 0, len(runs))
+	for _, run := range runs {
+		stream, err := openKeyStream(run, 0)
+		if err != nil {
+			closeKeyStreams(streams)
+			return err
+		}
+		streams = append(streams, stream)
+	}
+	defer closeKeyStreams(streams)
+
+	out, err := newKeyWriter(setPath, false)
+	if err != nil {
+		return err
+	}
+	if err := mergeKeyStreams(streams, func(key couponKey, _ uint64) error {
+		return out.write(key, 0)
+	}); err != nil {
+		out.close()
+		return err
+	}
+	return out.close()
+}
+
+// mergeSourceSets merges the source sets into the index file, recording in
+// every record the sources the code was found in
+func mergeSourceSets(setPaths []string, indexPath string) error {
+	streams := make([]*keyStream, 0, len(setPaths))
+	for i, path := range setPaths {
+		stream, err := openKeyStream(path, 1<<uint(i))
+		if err != nil {
+			closeKeyStreams(streams)
+			return err
+		}
+		streams = append(streams, stream)
+	}
+	defer closeKeyStreams(streams)
+
+	out, err := newKeyWriter(indexPath, true)
+	if err != nil {
+		return err
+	}
+	if err := mergeKeyStreams(streams, out.write); err != nil {
+		out.close()
+		return err
+	}
+	return out.close()
+}
+
+// openCouponIndex opens an index file and loads its sparse block index
+func openCouponIndex(indexPath string, sources []string, tokenizer *CouponTokenizer) (*CouponIndex, error) {
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to open coupon index")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, utils.WrapError(err, "failed to stat coupon index")
+	}
+	if info.Size()%couponRecordSize != 0 {
+		file.Close()
+		return nil, fmt.Errorf("coupon index %s is corrupt: size %d", indexPath, info.Size())
+	}
+
+	index := &CouponIndex{
+		tokenizer: tokenizer,
+		sources:   sources,
+		file:      file,
+		count:     info.Size() / couponRecordSize,
+	}
+	var key couponKey
+	for offset := int64(0); offset < info.Size(); offset += couponBlockSize {
+		if _, err := file.ReadAt(key[:], offset); err != nil {
+			file.Close()
+			return nil, utils.WrapError(err, "failed to load coupon index")
+		}
+		index.blockKeys = append(index.blockKeys, key)
+	}
+	return index, nil
+}
+
+// Sources returns the names of the indexed sources
+func (idx *CouponIndex) Sources() []string {
+	return slices.Clone(idx.sources)
+}
+
+// Len returns the number of distinct codes in the index
+func (idx *CouponIndex) Len() int64 {
+	return idx.count
+}
+
+// SourceCodes returns the number of distinct codes found in every source
+func (idx *CouponIndex) SourceCodes() map[string]int64 {
+	counts := make(map[string]int64, len(idx.sources))
+	for i, source := range idx.sources {
+		if i < len(idx.codeCounts) {
+			counts[source] = idx.codeCounts[i]
+		}
+	}
+	return counts
+}
+
+// Tokenizer returns the tokenizer the index was built with
+func (idx *CouponIndex) Tokenizer() *CouponTokenizer {
+	return idx.tokenizer
+}
+
+// Lookup returns the names of the sources containing the code
+func (idx *CouponIndex) Lookup(code string) ([]string, bool, error) {
+	mask, found, err := idx.lookupMask(code)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	sources := make([]string, 0, bits.OnesCount64(mask))
+	for i, source := range idx.sources {
+		if mask&(1<<uint(i)) != 0 {
+			sources = append(sources, source)
+		}
+	}
+	return sources, true, nil
+}
+
+func (idx *CouponIndex) lookupMask(code string) (uint64, bool, error) {
+	if !idx.tokenizer.IsCode(code) {
+		return 0, false, nil
+	}
+	key, ok := newCouponKey(idx.tokenizer.Normalize(code))
+	if !ok || len(idx.blockKeys) == 0 {
+		return 0, false, nil
+	}
+
+	// Find the last block starting at or before the key
+	block, exact := slices.BinarySearchFunc(idx.blockKeys, key, compareCouponKeys)
+	if !exact {
+		if block == 0 {
+			return 0, false, nil
+		}
+		block--
+	}
+
+	var buf [couponBlockSize]byte
+	n, err := idx.file.ReadAt(buf[:], int64(block)*couponBlockSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, false, utils.WrapError(err, "failed to read coupon index")
+	}
+	records := n / couponRecordSize
+	recordKey := func(i int) []byte {
+		return buf[i*couponRecordSize : i*couponRecordSize+maxCouponCodeLength]
+	}
+	i := sort.Search(records, func(i int) bool {
+		return bytes.Compare(recordKey(i), key[:]) >= 0
+	})
+	if i == records || !bytes.Equal(recordKey(i), key[:]) {
+		return 0, false, nil
+	}
+	offset := i*couponRecordSize + maxCouponCodeLength
+	return binary.LittleEndian.Uint64(buf[offset : offset+8]), true, nil
+}
+
+// Close releases the index file and removes the index directory if it was temporary
+func (idx *CouponIndex) Close() error {
+	err := idx.file.Close()
+	if idx.ownsDir {
+		if rmErr := os.RemoveAll(idx.workDir); rmErr != nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// keyStream reads sorted keys from a set file, tagging each of them with the stream's mask
+type keyStream struct {
+	file   *os.File
+	reader *bufio.Reader
+	mask   uint64
+	key    couponKey
+}
+
+func openKeyStream(path string, mask uint64) (*keyStream, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to open coupon set")
+	}
+	return &keyStream{
+		file:   file,
+		reader: bufio.NewReaderSize(file, couponReadBufferSize),
+		mask:   mask,
+	}, nil
+}
+
+// next advances the stream, returning false once it is exhausted
+func (s *keyStream) next() (bool, error) {
+	if _, err := io.ReadFull(s.reader, s.key[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, utils.WrapError(err, "failed to read coupon set")
+	}
+	return true, nil
+}
+
+func closeKeyStreams(streams []*keyStream) {
+	for _, stream := range streams {
+		stream.file.Close()
+	}
+}
+
+// keyHeap orders streams by their current key
+type keyHeap []*keyStream
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return compareCouponKeys(h[i].key, h[j].key) < 0 }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(*keyStream)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	stream := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return stream
+}
+
+// mergeKeyStreams emits every distinct key of the sorted streams in order,
+// together with the union of the masks it was read with
+func mergeKeyStreams(streams []*keyStream, emit func(couponKey, uint64) error) error {
+	h := make(keyHeap, 0, len(streams))
+	for _, stream := range streams {
+		ok, err := stream.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, stream)
+		}
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		key, mask := h[0].key, uint64(0)
+		for h.Len() > 0 && h[0].key == key {
+			mask |= h[0].mask
+			ok, err := h[0].next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		if err := emit(key, mask); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyWriter writes keys, and optionally their masks, to a set or index file
+type keyWriter struct {
+	file     *os.File
+	writer   *bufio.Writer
+	withMask bool
+}
+
+func newKeyWriter(path string, withMask bool) (*keyWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to create coupon set")
+	}
+	return &keyWriter{
+		file:     file,
+		writer:   bufio.NewWriterSize(file, couponReadBufferSize),
+		withMask: withMask,
+	}, nil
+}
+
+func (w *keyWriter) write(key couponKey, mask uint64) error {
+	if _, err := w.writer.Write(key[:]); err != nil {
+		return utils.WrapError(err, "failed to write coupon set")
+	}
+	if w.withMask {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], mask)
+		if _, err := w.writer.Write(buf[:]); err != nil {
+			return utils.WrapError(err, "failed to write coupon set")
+		}
+	}
+	return nil
+}
+
+func (w *keyWriter) close() error {
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return utils.WrapError(err, "failed to flush coupon set")
+	}
+	return w.file.Close()
+}
+
+func writeKeys(path string, keys []couponKey) error {
+	out, err := newKeyWriter(path, false)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := out.write(key, 0); err != nil {
+			out.close()
+			return err
+		}
+	}
+	return out.close()
+}
@@ -0,0 +1,348 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gormsqlite "gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func writeGzipFile(t testing.TB, path string, content string) {
+	fd, err := os.Create(path)
+	require.NoError(t, err)
+	defer fd.Close()
+	gz := gzip.NewWriter(fd)
+	_, err = gz.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+}
+
+func TestCouponIndexBuild(t *testing.T) {
+	dataDir, err := DefaultCouponDataDir()
+	require.NoError(t, err)
+
+	index, err := NewCouponIndexBuilder().Build(dataDir)
+	require.NoError(t, err)
+	defer index.Close()
+
+	assert.Equal(t, []string{"c1.txt", "c2.txt", "c3.txt"}, index.Sources())
+
+	tests := []struct {
+		code    string
+		found   bool
+		sources []string
+	}{
+		{code: "FIFTYOFF", found: true, sources: []string{"c1.txt", "c2.txt", "c3.txt"}},
+		{code: "HAPPYHRS", found: true, sources: []string{"c2.txt", "c3.txt"}},
+		{code: "NINTYOFF", found: true, sources: []string{"c3.txt"}},
+		{code: "TENOFF60", found: false},
+		{code: "SUPER100", found: false},
+		{code: "", found: false},
+		{code: "WAYTOOLONGCODE", found: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.code, func(t *testing.T) {
+			sources, found, err := index.Lookup(tc.code)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.found, found)
+			assert.Equal(t, tc.sources, sources)
+		})
+	}
+}
+
+func TestCouponIndexExternalSort(t *testing.T) {
+	dir := t.TempDir()
+	corpus := writeCouponCorpus(t, dir, 3, 5000)
+
+	// A tiny chunk size forces many runs per source
+	index, err := NewCouponIndexBuilder(WithIndexChunkSize(64)).Build(dir)
+	require.NoError(t, err)
+	defer index.Close()
+
+	assert.Equal(t, int64(len(corpus)), index.Len())
+	for code, expected := range corpus {
+		sources, found, err := index.Lookup(code)
+		require.NoError(t, err)
+		require.True(t, found, code)
+		require.Equal(t, expected, len(sources), code)
+	}
+}
+
+func TestCouponIndexGzipSources(t *testing.T) {
+	dir := t.TempDir()
+	// Detected by extension
+	writeGzipFile(t, filepath.Join(dir, "gzipbase1.gz"), "GZIPCODE\nONLYINONE\n")
+	// Detected by magic bytes, with a line longer than the scanner's buffer
+	longLine := strings.Repeat("X", 2*couponReadBufferSize+10)
+	writeGzipFile(t, filepath.Join(dir, "gzipbase2"), longLine+"\nGZIPCODE\n")
+
+	index, err := NewCouponIndexBuilder().Build(dir)
+	require.NoError(t, err)
+	defer index.Close()
+
+	sources, found, err := index.Lookup("GZIPCODE")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.ElementsMatch(t, []string{"gzipbase1.gz", "gzipbase2"}, sources)
+
+	sources, found, err = index.Lookup("ONLYINONE")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"gzipbase1.gz"}, sources)
+}
+
+func TestCouponIndexCloseRemovesTemporaryDir(t *testing.T) {
+	dataDir, err := DefaultCouponDataDir()
+	require.NoError(t, err)
+
+	index, err := NewCouponIndexBuilder().Build(dataDir)
+	require.NoError(t, err)
+	workDir := index.workDir
+	require.NoError(t, index.Close())
+
+	_, err = os.Stat(workDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCouponIndexSnapshot(t *testing.T) {
+	dataDir, workDir := t.TempDir(), t.TempDir()
+	writeSource := func(name, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, name), []byte(content), 0o644))
+	}
+	writeSource("couponbase1", "FIFTYOFF\nHAPPYHRS\n")
+	writeSource("couponbase2", "FIFTYOFF\n")
+	writeSource("couponbase3", "HAPPYHRS\n")
+
+	build := func() *CouponIndex {
+		index, err := NewCouponIndexBuilder(WithIndexWorkDir(workDir)).Build(dataDir)
+		require.NoError(t, err)
+		return index
+	}
+
+	index := build()
+	assert.Equal(t, []string{"couponbase1", "couponbase2", "couponbase3"}, index.rebuiltSources)
+	require.NoError(t, index.Close())
+
+	// Unchanged sources are loaded from the snapshot
+	index = build()
+	assert.Empty(t, index.rebuiltSources)
+	sources, found, err := index.Lookup("HAPPYHRS")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"couponbase1", "couponbase3"}, sources)
+	require.NoError(t, index.Close())
+
+	// Only the changed source is rescanned
+	writeSource("couponbase2", "FIFTYOFF\nHAPPYHRS\nNINTYOFF\n")
+	index = build()
+	assert.Equal(t, []string{"couponbase2"}, index.rebuiltSources)
+	sources, _, err = index.Lookup("HAPPYHRS")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"couponbase1", "couponbase2", "couponbase3"}, sources)
+	require.NoError(t, index.Close())
+
+	// Snapshots of another version are rebuilt from scratch
+	manifest := loadSnapshotManifest(workDir, defaultCouponTokenizer())
+	require.NotNil(t, manifest)
+	manifest.Version = couponSnapshotVersion + 1
+	require.NoError(t, writeSnapshotManifest(workDir, *manifest))
+	index = build()
+	assert.Len(t, index.rebuiltSources, 3)
+	require.NoError(t, index.Close())
+
+	// Set files of replaced sources are cleaned up
+	sets, err := filepath.Glob(filepath.Join(workDir, "*"+couponSetFileSuffix))
+	assert.NoError(t, err)
+	assert.Len(t, sets, 3)
+}
+
+func TestCouponIndexParallelIngestion(t *testing.T) {
+	dir := t.TempDir()
+	corpus := writeCouponCorpus(t, dir, 5, 3000)
+
+	serial, err := NewCouponIndexBuilder(WithIndexWorkers(1), WithIndexChunkSize(500)).Build(dir)
+	require.NoError(t, err)
+	defer serial.Close()
+	parallel, err := NewCouponIndexBuilder(WithIndexWorkers(4), WithIndexChunkSize(500)).Build(dir)
+	require.NoError(t, err)
+	defer parallel.Close()
+
+	assert.Equal(t, serial.Len(), parallel.Len())
+	for code := range corpus {
+		expected, _, err := serial.Lookup(code)
+		require.NoError(t, err)
+		actual, _, err := parallel.Lookup(code)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, code)
+	}
+}
+
+func TestCouponIngestProgress(t *testing.T) {
+	dir, workDir := t.TempDir(), t.TempDir()
+	writeCouponCorpus(t, dir, 3, 1000)
+	files, err := getFilesInDirectory(dir)
+	require.NoError(t, err)
+	sources, err := describeSources(files)
+	require.NoError(t, err)
+
+	builder := NewCouponIndexBuilder(WithIndexWorkers(3))
+	progress := newIngestProgress(sources)
+	require.NoError(t, builder.buildSourceSets(sources, workDir, progress))
+
+	assert.Equal(t, progress.totalBytes, progress.bytesRead.Load())
+	assert.Equal(t, int64(3000), progress.tokensSeen.Load())
+}
+
+// writeCouponCorpus writes files of random codes, some of them shared between files,
+// and returns the number of files each code was written to
+func writeCouponCorpus(t testing.TB, dir string, files int, codesPerFile int) map[string]int {
+	rng := rand.New(rand.NewSource(42))
+	randomCode := func() string {
+		code := make([]byte, 8+rng.Intn(3))
+		for i := range code {
+			code[i] = byte('A' + rng.Intn(26))
+		}
+		return string(code)
+	}
+
+	shared := make([]string, codesPerFile/10)
+	for i := range shared {
+		shared[i] = randomCode()
+	}
+
+	corpus := make(map[string]int)
+	for f := 0; f < files; f++ {
+		seen := make(map[string]bool)
+		var content strings.Builder
+		for i := 0; i < codesPerFile; i++ {
+			code := randomCode()
+			if i%2 == 0 {
+				code = shared[rng.Intn(len(shared))]
+			}
+			content.WriteString(code + "\n")
+			if !seen[code] {
+				seen[code] = true
+				corpus[code]++
+			}
+		}
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("couponbase%d", f+1)), []byte(content.String()), 0o644)
+		require.NoError(t, err)
+	}
+	return corpus
+}
+
+// seedCouponsWithGorm is the previous coupon seeding path which stored one row
+// and one association per code. It is kept to benchmark the index against.
+func seedCouponsWithGorm(dirPath string, db *gorm.DB) error {
+	files, err := getFilesInDirectory(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		source := &CouponSource{Source: filepath.Base(file)}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(source).Error; err != nil {
+			return err
+		}
+		reader, err := openCouponSource(file, nil)
+		if err != nil {
+			return err
+		}
+		scanner := fileScanner(reader, defaultCouponTokenizer())
+		for scanner.Scan() {
+			code := scanner.Text()
+			var coupon Coupon
+			if err := db.Where(Coupon{Code: code}).FirstOrCreate(&coupon).Error; err != nil {
+				reader.Close()
+				return err
+			}
+			if err := db.Model(&coupon).Association("SourceFile").Append(source); err != nil {
+				reader.Close()
+				return err
+			}
+		}
+		reader.Close()
+	}
+	return nil
+}
+
+func newBenchmarkDB(b *testing.B) *gorm.DB {
+	db, err := gorm.Open(gormsqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", b.Name())), &gorm.Config{})
+	require.NoError(b, err)
+	require.NoError(b, db.AutoMigrate(&CouponSource{}, &Coupon{}))
+	return db
+}
+
+const benchmarkCodesPerFile = 2000
+
+func BenchmarkCouponIndexBuild(b *testing.B) {
+	dir := b.TempDir()
+	writeCouponCorpus(b, dir, 3, benchmarkCodesPerFile)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index, err := NewCouponIndexBuilder().Build(dir)
+		require.NoError(b, err)
+		index.Close()
+	}
+}
+
+func BenchmarkGormCouponSeed(b *testing.B) {
+	dir := b.TempDir()
+	writeCouponCorpus(b, dir, 3, benchmarkCodesPerFile)
+	db := newBenchmarkDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		require.NoError(b, db.Exec("DELETE FROM coupon_sources").Error)
+		require.NoError(b, db.Exec("DELETE FROM coupons").Error)
+		require.NoError(b, db.Exec("DELETE FROM coupon_source").Error)
+		b.StartTimer()
+		require.NoError(b, seedCouponsWithGorm(dir, db))
+	}
+}
+
+func BenchmarkCouponIndexLookup(b *testing.B) {
+	dir := b.TempDir()
+	corpus := writeCouponCorpus(b, dir, 3, benchmarkCodesPerFile)
+	codes := make([]string, 0, len(corpus))
+	for code := range corpus {
+		codes = append(codes, code)
+	}
+	index, err := NewCouponIndexBuilder().Build(dir)
+	require.NoError(b, err)
+	defer index.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, found, err := index.Lookup(codes[i%len(codes)]); err != nil || !found {
+			b.Fatalf("lookup failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkGormCouponLookup(b *testing.B) {
+	dir := b.TempDir()
+	corpus := writeCouponCorpus(b, dir, 3, benchmarkCodesPerFile)
+	codes := make([]string, 0, len(corpus))
+	for code := range corpus {
+		codes = append(codes, code)
+	}
+	db := newBenchmarkDB(b)
+	require.NoError(b, seedCouponsWithGorm(dir, db))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var coupon Coupon
+		if err := db.Preload("SourceFile").Where("code = ?", codes[i%len(codes)]).First(&coupon).Error; err != nil {
+			b.Fatalf("lookup failed: %v", err)
+		}
+	}
+}
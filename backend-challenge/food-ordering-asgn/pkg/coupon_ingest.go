@@ -0,0 +1,147 @@
+package pkg
+
+// coupon_ingest.go scans the coupon sources concurrently. Every source needing a
+// rebuild is handed to a pool of workers, each sorting one source into its set,
+// and the sets are then merged by a single merger into the index. While the
+// workers run, the overall progress is logged periodically.
+//
+// Every worker holds at most chunkSize codes in memory, so ingestion needs
+// roughly workers * chunkSize * maxCouponCodeLength bytes.
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+const (
+	defaultIngestProgressInterval = 5 * time.Second
+	// ingestTokenBatch is the number of tokens a worker counts before publishing them
+	ingestTokenBatch = 4096
+)
+
+// ingestProgress tracks the work done by the ingestion workers
+type ingestProgress struct {
+	totalBytes int64
+	bytesRead  atomic.Int64
+	tokensSeen atomic.Int64
+	started    time.Time
+}
+
+func newIngestProgress(sources []couponSnapshotSource) *ingestProgress {
+	progress := &ingestProgress{started: time.Now()}
+	for _, source := range sources {
+		progress.totalBytes += source.Size
+	}
+	return progress
+}
+
+// log writes the current progress through the package logger
+func (p *ingestProgress) log(message string) {
+	elapsed := time.Since(p.started).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1e-9
+	}
+	bytesRead, tokens := p.bytesRead.Load(), p.tokensSeen.Load()
+	percent := 100.0
+	if p.totalBytes > 0 {
+		percent = float64(bytesRead) * 100 / float64(p.totalBytes)
+	}
+	logger.Infof("%s: %.1f/%.1f MB read (%.1f%%), %d tokens seen, %.1f MB/s, %.0f tokens/s",
+		message, float64(bytesRead)/(1<<20), float64(p.totalBytes)/(1<<20), percent,
+		tokens, float64(bytesRead)/(1<<20)/elapsed, float64(tokens)/elapsed)
+}
+
+// report logs the progress every interval until the returned function is called
+func (p *ingestProgress) report(interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.log("Coupon ingestion in progress")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		p.log("Coupon ingestion finished")
+	}
+}
+
+// countingReader counts the bytes read from the underlying source file
+type countingReader struct {
+	io.Reader
+	count *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count.Add(int64(n))
+	return n, err
+}
+
+// buildSourceSets sorts every source into its set file using the worker pool.
+// The first error stops the remaining sources from being scanned.
+func (b *CouponIndexBuilder) buildSourceSets(sources []couponSnapshotSource, workDir string, progress *ingestProgress) error {
+	jobs := make(chan couponSnapshotSource)
+	errs := make(chan error, len(sources))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+
+	for w := 0; w < min(b.workers, len(sources)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range jobs {
+				if err := b.buildSourceSetFile(source, workDir, progress); err != nil {
+					failed.Store(true)
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	for _, source := range sources {
+		if failed.Load() {
+			break
+		}
+		jobs <- source
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	var collected []error
+	for err := range errs {
+		collected = append(collected, err)
+	}
+	return errors.Join(collected...)
+}
+
+// buildSourceSetFile builds the set of a single source and moves it in place once complete
+func (b *CouponIndexBuilder) buildSourceSetFile(source couponSnapshotSource, workDir string, progress *ingestProgress) error {
+	setPath := filepath.Join(workDir, source.Set)
+	if err := b.buildSourceSet(source.path, setPath+".tmp", progress); err != nil {
+		os.Remove(setPath + ".tmp")
+		return utils.WrapError(err, "failed to index coupon source: "+source.path)
+	}
+	if err := os.Rename(setPath+".tmp", setPath); err != nil {
+		return utils.WrapError(err, "failed to store coupon set: "+source.path)
+	}
+	logger.Infof("Indexed coupon source %s", source.Name)
+	return nil
+}
@@ -0,0 +1,103 @@
+package pkg
+
+// coupon_policy.go decides whether a coupon code is valid based on the sources it was found in.
+// The challenge's rule, "found in at least two files", is the default policy.
+
+import (
+	"fmt"
+	"slices"
+)
+
+// CouponRejection is a machine readable reason for rejecting a coupon code
+type CouponRejection string
+
+const (
+	// CouponInvalidFormat is returned for codes of the wrong length or with invalid characters
+	CouponInvalidFormat CouponRejection = "invalid_format"
+	// CouponNotFound is returned for codes which are not in any source
+	CouponNotFound CouponRejection = "not_found"
+	// CouponTooFewSources is returned for codes found in less than MinSources sources
+	CouponTooFewSources CouponRejection = "too_few_sources"
+	// CouponMissingRequiredSource is returned for codes missing from a required source
+	CouponMissingRequiredSource CouponRejection = "missing_required_source"
+	// CouponInsufficientWeight is returned for codes whose sources weigh less than MinWeight
+	CouponInsufficientWeight CouponRejection = "insufficient_weight"
+)
+
+// CouponPolicy configures which coupon codes are valid
+type CouponPolicy struct {
+	// MinSources is the number of sources a code has to be found in
+	MinSources int `json:"minSources"`
+	// RequiredSources must all contain the code
+	RequiredSources []string `json:"requiredSources,omitempty"`
+	// ExcludedSources are ignored when looking for a code
+	ExcludedSources []string `json:"excludedSources,omitempty"`
+	// SourceWeights weighs the sources, sources not listed weigh 1
+	SourceWeights map[string]float64 `json:"sourceWeights,omitempty"`
+	// MinWeight is the total weight of the sources a code has to be found in, 0 disables the check
+	MinWeight float64 `json:"minWeight,omitempty"`
+	// CaseInsensitive matches codes regardless of their case
+	CaseInsensitive bool `json:"caseInsensitive,omitempty"`
+}
+
+// DefaultCouponPolicy accepts codes found in at least two sources
+func DefaultCouponPolicy() CouponPolicy {
+	return CouponPolicy{MinSources: 2}
+}
+
+// Validate checks that the policy can be satisfied
+func (p CouponPolicy) Validate() error {
+	if p.MinSources < 1 {
+		return fmt.Errorf("coupon policy must require at least one source, got %d", p.MinSources)
+	}
+	for _, source := range p.RequiredSources {
+		if slices.Contains(p.ExcludedSources, source) {
+			return fmt.Errorf("coupon source %s can't be both required and excluded", source)
+		}
+	}
+	for source, weight := range p.SourceWeights {
+		if weight < 0 {
+			return fmt.Errorf("weight of coupon source %s must not be negative, got %v", source, weight)
+		}
+	}
+	if p.MinWeight < 0 {
+		return fmt.Errorf("coupon policy minimum weight must not be negative, got %v", p.MinWeight)
+	}
+	return nil
+}
+
+// Evaluate decides whether a code found in the given sources is valid
+func (p CouponPolicy) Evaluate(sources []string) (bool, CouponRejection) {
+	counted := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if !slices.Contains(p.ExcludedSources, source) {
+			counted = append(counted, source)
+		}
+	}
+	if len(counted) == 0 {
+		return false, CouponNotFound
+	}
+
+	for _, required := range p.RequiredSources {
+		if !slices.Contains(counted, required) {
+			return false, CouponMissingRequiredSource
+		}
+	}
+	if len(counted) < p.MinSources {
+		return false, CouponTooFewSources
+	}
+	if p.MinWeight > 0 {
+		var weight float64
+		for _, source := range counted {
+			if w, ok := p.SourceWeights[source]; ok {
+				weight += w
+			} else {
+				weight++
+			}
+		}
+		if weight < p.MinWeight {
+			return false, CouponInsufficientWeight
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCouponPolicyEvaluate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CouponPolicy
+		sources []string
+		valid   bool
+		reason  CouponRejection
+	}{
+		{
+			name:    "default policy accepts two sources",
+			policy:  DefaultCouponPolicy(),
+			sources: []string{"couponbase1.gz", "couponbase2.gz"},
+			valid:   true,
+		},
+		{
+			name:    "default policy rejects a single source",
+			policy:  DefaultCouponPolicy(),
+			sources: []string{"couponbase1.gz"},
+			reason:  CouponTooFewSources,
+		},
+		{
+			name:    "one of three",
+			policy:  CouponPolicy{MinSources: 1},
+			sources: []string{"couponbase3.gz"},
+			valid:   true,
+		},
+		{
+			name:    "excluded sources are not counted",
+			policy:  CouponPolicy{MinSources: 2, ExcludedSources: []string{"couponbase2.gz"}},
+			sources: []string{"couponbase1.gz", "couponbase2.gz"},
+			reason:  CouponTooFewSources,
+		},
+		{
+			name:    "only excluded sources",
+			policy:  CouponPolicy{MinSources: 1, ExcludedSources: []string{"couponbase2.gz"}},
+			sources: []string{"couponbase2.gz"},
+			reason:  CouponNotFound,
+		},
+		{
+			name:    "required source missing",
+			policy:  CouponPolicy{MinSources: 2, RequiredSources: []string{"couponbase1.gz"}},
+			sources: []string{"couponbase2.gz", "couponbase3.gz"},
+			reason:  CouponMissingRequiredSource,
+		},
+		{
+			name:    "required source present",
+			policy:  CouponPolicy{MinSources: 2, RequiredSources: []string{"couponbase1.gz"}},
+			sources: []string{"couponbase1.gz", "couponbase3.gz"},
+			valid:   true,
+		},
+		{
+			name: "weighted sources reach the minimum weight",
+			policy: CouponPolicy{
+				MinSources:    1,
+				SourceWeights: map[string]float64{"couponbase1.gz": 2},
+				MinWeight:     2,
+			},
+			sources: []string{"couponbase1.gz"},
+			valid:   true,
+		},
+		{
+			name: "weighted sources below the minimum weight",
+			policy: CouponPolicy{
+				MinSources:    1,
+				SourceWeights: map[string]float64{"couponbase1.gz": 0.5},
+				MinWeight:     2,
+			},
+			sources: []string{"couponbase1.gz", "couponbase2.gz"},
+			reason:  CouponInsufficientWeight,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			valid, reason := tc.policy.Evaluate(tc.sources)
+			assert.Equal(t, tc.valid, valid)
+			assert.Equal(t, tc.reason, reason)
+		})
+	}
+}
+
+func TestCouponPolicyValidate(t *testing.T) {
+	assert.NoError(t, DefaultCouponPolicy().Validate())
+	assert.Error(t, CouponPolicy{}.Validate())
+	assert.Error(t, CouponPolicy{MinSources: 1, RequiredSources: []string{"a"}, ExcludedSources: []string{"a"}}.Validate())
+	assert.Error(t, CouponPolicy{MinSources: 1, SourceWeights: map[string]float64{"a": -1}}.Validate())
+	assert.Error(t, CouponPolicy{MinSources: 1, MinWeight: -1}.Validate())
+}
@@ -0,0 +1,148 @@
+package pkg
+
+// coupon_redemption.go records which orders a coupon was applied to and enforces
+// the usage limits of coupons. The limits are checked once more by the order
+// repository, in the transaction storing the order right before the redemption is
+// written, so the order and its redemption are only stored together and only while
+// the coupon may still be used.
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// CouponNotStarted is returned for coupons which can't be redeemed yet
+	CouponNotStarted CouponRejection = "not_started"
+	// CouponExpired is returned for coupons which can't be redeemed anymore
+	CouponExpired CouponRejection = "expired"
+	// CouponUsageLimitReached is returned for coupons redeemed MaxUses times
+	CouponUsageLimitReached CouponRejection = "usage_limit_reached"
+	// CouponCustomerLimitReached is returned for coupons the customer redeemed MaxUsesPerCustomer times
+	CouponCustomerLimitReached CouponRejection = "customer_usage_limit_reached"
+	// CouponCustomerRequired is returned when a per customer limit applies but the customer is unknown
+	CouponCustomerRequired CouponRejection = "customer_required"
+)
+
+// CouponLimits is embedded into Coupon and caps when and how often the coupon can be redeemed.
+// Zero values mean no limit.
+type CouponLimits struct {
+	MaxUses            int        `gorm:"column:max_uses;not null;default:0" json:"maxUses,omitempty"`
+	MaxUsesPerCustomer int        `gorm:"column:max_uses_per_customer;not null;default:0" json:"maxUsesPerCustomer,omitempty"`
+	StartsAt           *time.Time `gorm:"column:starts_at" json:"startsAt,omitempty"`
+	ExpiresAt          *time.Time `gorm:"column:expires_at" json:"expiresAt,omitempty"`
+	// Schedule restricts the coupon to recurring or one-off windows
+	Schedule *CouponSchedule `gorm:"column:schedule;serializer:json" json:"schedule,omitempty"`
+}
+
+// Validate checks that the limits can be satisfied
+func (l CouponLimits) Validate() error {
+	if l.MaxUses < 0 || l.MaxUsesPerCustomer < 0 {
+		return fmt.Errorf("coupon usage limits must not be negative, got %d and %d", l.MaxUses, l.MaxUsesPerCustomer)
+	}
+	if l.StartsAt != nil && l.ExpiresAt != nil && !l.StartsAt.Before(*l.ExpiresAt) {
+		return fmt.Errorf("coupon must start before it expires, got %s and %s", l.StartsAt, l.ExpiresAt)
+	}
+	if l.Schedule != nil {
+		return l.Schedule.Validate()
+	}
+	return nil
+}
+
+// checkPeriod returns why the coupon can't be redeemed at the given time, if it can't.
+// now must be in the store's timezone for the schedule to be evaluated correctly.
+func (l CouponLimits) checkPeriod(now time.Time) CouponRejection {
+	if l.StartsAt != nil && now.Before(*l.StartsAt) {
+		return CouponNotStarted
+	}
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return CouponExpired
+	}
+	if l.Schedule != nil && !l.Schedule.Contains(now) {
+		return CouponOutsideSchedule
+	}
+	return ""
+}
+
+// CouponRedemption records a coupon applied to an order. Redemptions are keyed by
+// the normalized code, so coupons without a database record are tracked as well.
+type CouponRedemption struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Code      string    `gorm:"not null;index" json:"code"`
+	OrderID   uint      `gorm:"not null;index" json:"orderId"`
+	Customer  string    `gorm:"not null;default:'';index" json:"-"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// CouponRejectedError aborts the order transaction when the coupon can't be redeemed
+type CouponRejectedError struct {
+	Reason CouponRejection
+}
+
+func (e *CouponRejectedError) Error() string {
+	return "coupon rejected: " + string(e.Reason)
+}
+
+// customerKey identifies the customer placing an order by the API key the request was
+// authenticated with. Keys are identified by their id rather than their value, which
+// is never stored.
+func customerKey(r *http.Request) string {
+	key := requestAPIKey(r)
+	if key == nil {
+		return ""
+	}
+	return apiKeyCustomerKey(key.ID)
+}
+
+// apiKeyCustomerKey is the customer key of the API key with the id
+func apiKeyCustomerKey(id uint) string {
+	return fmt.Sprintf("api_key:%d", id)
+}
+
+// legacyCustomerKey is how customers were identified before API keys were registered,
+// by the first 8 bytes of the SHA-256 hash of the api_key header
+func legacyCustomerKey(keyHash string) string {
+	return "key:" + keyHash[:16]
+}
+
+// checkCouponUsage returns why the coupon can't be redeemed once more, if it can't.
+// count returns the number of redemptions of a code, by a single customer when one
+// is given. The per customer limit is only checked when checkCustomer is set.
+func checkCouponUsage(limits CouponLimits, code, customer string, checkCustomer bool, count func(code, customer string) (int64, error)) (CouponRejection, error) {
+	if limits.MaxUses > 0 {
+		uses, err := count(code, "")
+		if err != nil {
+			return "", err
+		}
+		if uses >= int64(limits.MaxUses) {
+			return CouponUsageLimitReached, nil
+		}
+	}
+	if checkCustomer && limits.MaxUsesPerCustomer > 0 {
+		if customer == "" {
+			return CouponCustomerRequired, nil
+		}
+		uses, err := count(code, customer)
+		if err != nil {
+			return "", err
+		}
+		if uses >= int64(limits.MaxUsesPerCustomer) {
+			return CouponCustomerLimitReached, nil
+		}
+	}
+	return "", nil
+}
+
+// checkRedemption returns a *CouponRejectedError when the limits don't allow the
+// redemption. Repositories call it right before recording the redemption.
+func checkRedemption(limits CouponLimits, redemption *CouponRedemption, count func(code, customer string) (int64, error)) error {
+	reason, err := checkCouponUsage(limits, redemption.Code, redemption.Customer, true, count)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return &CouponRejectedError{Reason: reason}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gormsqlite "gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+func TestCouponLimitsPeriod(t *testing.T) {
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	tests := []struct {
+		name   string
+		limits CouponLimits
+		now    time.Time
+		want   CouponRejection
+	}{
+		{name: "unlimited", now: start},
+		{name: "before start", limits: CouponLimits{StartsAt: &start}, now: start.Add(-time.Second), want: CouponNotStarted},
+		{name: "at start", limits: CouponLimits{StartsAt: &start}, now: start},
+		{name: "before expiry", limits: CouponLimits{ExpiresAt: &end}, now: end.Add(-time.Second)},
+		{name: "at expiry", limits: CouponLimits{ExpiresAt: &end}, now: end, want: CouponExpired},
+		{name: "within period", limits: CouponLimits{StartsAt: &start, ExpiresAt: &end}, now: start.AddDate(0, 0, 10)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.limits.checkPeriod(tc.now))
+		})
+	}
+}
+
+func TestCouponLimitsValidate(t *testing.T) {
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, CouponLimits{MaxUses: 10, MaxUsesPerCustomer: 1}.Validate())
+	assert.Error(t, CouponLimits{MaxUses: -1}.Validate())
+	assert.Error(t, CouponLimits{MaxUsesPerCustomer: -1}.Validate())
+	assert.Error(t, CouponLimits{StartsAt: &start, ExpiresAt: &start}.Validate())
+}
+
+func TestConfigureCouponLimits(t *testing.T) {
+	repos, err := NewMemoryRepositories()
+	require.NoError(t, err)
+	folding := defaultCouponTokenizer().WithCaseFolding()
+
+	// Limits are stored under the code coupons are looked up by
+	require.NoError(t, ConfigureCouponLimits(repos.Coupons, folding, map[string]CouponLimits{"happyhrs": {MaxUses: 3}}))
+	coupon, err := repos.Coupons.GetCoupon("HAPPYHRS")
+	require.NoError(t, err)
+	assert.Equal(t, 3, coupon.Limits.MaxUses)
+	_, err = repos.Coupons.GetCoupon("happyhrs")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	err = ConfigureCouponLimits(repos.Coupons, folding, map[string]CouponLimits{"happyhrs": {MaxUses: 1}, "HAPPYHRS": {MaxUses: 2}})
+	assert.ErrorContains(t, err, "apply to the same code HAPPYHRS")
+	err = ConfigureCouponLimits(repos.Coupons, folding, map[string]CouponLimits{"HAPPYHRS": {MaxUses: -1}})
+	assert.Error(t, err)
+	err = ConfigureCouponLimits(repos.Coupons, folding, map[string]CouponLimits{"HAPPY-HRS": {MaxUses: 1}})
+	assert.ErrorContains(t, err, "not a coupon code")
+}
+
+func TestRedeemCoupon(t *testing.T) {
+	gormRepos := func(t *testing.T) Repositories {
+		db, err := gorm.Open(gormsqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+		require.NoError(t, err)
+		_, err = NewMigrator(db).Up()
+		require.NoError(t, err)
+		return NewGormRepositories(db)
+	}
+	memoryRepos := func(t *testing.T) Repositories {
+		repos, err := NewMemoryRepositories()
+		require.NoError(t, err)
+		return repos
+	}
+
+	for name, newRepos := range map[string]func(t *testing.T) Repositories{"gorm": gormRepos, "memory": memoryRepos} {
+		t.Run(name, func(t *testing.T) {
+			repos := newRepos(t)
+			limits := CouponLimits{MaxUses: 3, MaxUsesPerCustomer: 2}
+			redeem := func(customer string) error {
+				order := &Order{Items: []OrderLine{{ProductID: 1, Name: "Margherita Pizza", UnitPrice: 12.99, Quantity: 1}}, Total: 12.99}
+				err := repos.Orders.CreateOrder(order, &CouponRedemption{Code: "HAPPYHRS", Customer: customer}, limits)
+				if err == nil {
+					assert.NotZero(t, order.ID)
+				}
+				return err
+			}
+			rejection := func(err error) CouponRejection {
+				rejected, ok := err.(*CouponRejectedError)
+				require.True(t, ok, "expected a rejection, got %v", err)
+				return rejected.Reason
+			}
+
+			require.NoError(t, redeem("alice"))
+			require.NoError(t, redeem("alice"))
+			assert.Equal(t, CouponCustomerLimitReached, rejection(redeem("alice")))
+			assert.Equal(t, CouponCustomerRequired, rejection(redeem("")))
+			require.NoError(t, redeem("bob"))
+			assert.Equal(t, CouponUsageLimitReached, rejection(redeem("carol")))
+
+			redemptions, err := repos.Coupons.CountRedemptions("HAPPYHRS", "")
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), redemptions)
+			redemptions, err = repos.Coupons.CountRedemptions("HAPPYHRS", "alice")
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), redemptions)
+
+			// Orders rejected for their coupon are not stored
+			orders, err := repos.Orders.FindOrders(OrderQuery{})
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), orders.Total)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package pkg
+
+// coupon_schedule.go restricts coupons to time windows, e.g. a happy hour on weekdays.
+// A schedule combines recurring windows, weekdays and a time of day range, with
+// one-off date ranges. Both are evaluated in the store's timezone: the caller
+// converts the current time into the store location before checking a schedule.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CouponOutsideSchedule is returned for coupons redeemed outside of their schedule
+	CouponOutsideSchedule CouponRejection = "outside_schedule"
+
+	scheduleDateLayout = "2006-01-02"
+	scheduleTimeLayout = "15:04"
+)
+
+// CouponSchedule lists the windows a coupon can be redeemed in. A coupon without
+// any window is not restricted.
+type CouponSchedule struct {
+	// Recurring windows repeat every week
+	Recurring []RecurringWindow `json:"recurring,omitempty"`
+	// Dates are one-off date ranges
+	Dates []DateRange `json:"dates,omitempty"`
+}
+
+// RecurringWindow is a time of day range, e.g. "17:00" to "19:00", on some weekdays.
+// A range ending before it starts spans midnight and belongs to the day it starts on.
+type RecurringWindow struct {
+	// Weekdays are abbreviated day names, e.g. "mon". Empty means every day.
+	Weekdays []string `json:"weekdays,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+}
+
+// DateRange is an inclusive range of dates, e.g. "2025-12-24" to "2025-12-26"
+type DateRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Validate checks that every window is well formed
+func (s CouponSchedule) Validate() error {
+	for _, window := range s.Recurring {
+		for _, day := range window.Weekdays {
+			if _, ok := parseWeekday(day); !ok {
+				return fmt.Errorf("unknown weekday: %q", day)
+			}
+		}
+		// Times are compared as strings, so they must be zero padded
+		start, err := time.Parse(scheduleTimeLayout, window.Start)
+		if err != nil || start.Format(scheduleTimeLayout) != window.Start {
+			return fmt.Errorf("invalid start time %q, expected HH:MM", window.Start)
+		}
+		end, err := time.Parse(scheduleTimeLayout, window.End)
+		if err != nil || end.Format(scheduleTimeLayout) != window.End {
+			return fmt.Errorf("invalid end time %q, expected HH:MM", window.End)
+		}
+		if start.Equal(end) {
+			return fmt.Errorf("recurring window from %s to %s is empty", window.Start, window.End)
+		}
+	}
+	for _, dates := range s.Dates {
+		from, err := time.Parse(scheduleDateLayout, dates.From)
+		if err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", dates.From)
+		}
+		to, err := time.Parse(scheduleDateLayout, dates.To)
+		if err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", dates.To)
+		}
+		if to.Before(from) {
+			return fmt.Errorf("date range from %s to %s ends before it starts", dates.From, dates.To)
+		}
+	}
+	return nil
+}
+
+// Contains reports whether now, in the store's timezone, is within one of the windows
+func (s CouponSchedule) Contains(now time.Time) bool {
+	if len(s.Recurring) == 0 && len(s.Dates) == 0 {
+		return true
+	}
+	for _, window := range s.Recurring {
+		if window.contains(now) {
+			return true
+		}
+	}
+	// ISO dates sort chronologically, so they can be compared as strings
+	today := now.Format(scheduleDateLayout)
+	for _, dates := range s.Dates {
+		if dates.From <= today && today <= dates.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (w RecurringWindow) contains(now time.Time) bool {
+	clock := now.Format(scheduleTimeLayout)
+	day := now.Weekday()
+	if w.End < w.Start {
+		// Past midnight the window belongs to the previous day
+		if clock < w.End {
+			return w.onDay((day + 6) % 7)
+		}
+		return clock >= w.Start && w.onDay(day)
+	}
+	return clock >= w.Start && clock < w.End && w.onDay(day)
+}
+
+func (w RecurringWindow) onDay(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, name := range w.Weekdays {
+		if weekday, ok := parseWeekday(name); ok && weekday == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWeekday accepts English day names and their three letter abbreviations
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) < 3 {
+		return 0, false
+	}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCouponScheduleContains(t *testing.T) {
+	weekdays := RecurringWindow{Weekdays: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "17:00", End: "19:00"}
+	lateNight := RecurringWindow{Weekdays: []string{"Friday"}, Start: "22:00", End: "02:00"}
+	holidays := DateRange{From: "2025-12-24", To: "2025-12-26"}
+	// 2025-06-06 is a Friday
+	at := func(day int, clock string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", fmt.Sprintf("2025-06-%02d %s", day, clock))
+		return t
+	}
+
+	tests := []struct {
+		name     string
+		schedule CouponSchedule
+		now      time.Time
+		want     bool
+	}{
+		{name: "no windows", now: at(6, "03:00"), want: true},
+		{name: "within recurring window", schedule: CouponSchedule{Recurring: []RecurringWindow{weekdays}}, now: at(6, "17:00"), want: true},
+		{name: "window end is exclusive", schedule: CouponSchedule{Recurring: []RecurringWindow{weekdays}}, now: at(6, "19:00")},
+		{name: "outside of weekdays", schedule: CouponSchedule{Recurring: []RecurringWindow{weekdays}}, now: at(7, "18:00")},
+		{name: "before midnight", schedule: CouponSchedule{Recurring: []RecurringWindow{lateNight}}, now: at(6, "23:30"), want: true},
+		{name: "past midnight", schedule: CouponSchedule{Recurring: []RecurringWindow{lateNight}}, now: at(7, "01:59"), want: true},
+		{name: "past midnight of another day", schedule: CouponSchedule{Recurring: []RecurringWindow{lateNight}}, now: at(6, "01:00")},
+		{name: "within date range", schedule: CouponSchedule{Dates: []DateRange{holidays}}, now: time.Date(2025, 12, 26, 23, 59, 0, 0, time.UTC), want: true},
+		{name: "after date range", schedule: CouponSchedule{Dates: []DateRange{holidays}}, now: time.Date(2025, 12, 27, 0, 0, 0, 0, time.UTC)},
+		{
+			name:     "date range or recurring window",
+			schedule: CouponSchedule{Recurring: []RecurringWindow{weekdays}, Dates: []DateRange{holidays}},
+			now:      time.Date(2025, 12, 24, 9, 0, 0, 0, time.UTC),
+			want:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.schedule.Contains(tc.now))
+		})
+	}
+}
+
+func TestCouponScheduleUsesStoreTimezone(t *testing.T) {
+	schedule := CouponSchedule{Recurring: []RecurringWindow{{Start: "17:00", End: "19:00"}}}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.NoError(t, err)
+
+	// 09:00 UTC is 18:00 in Tokyo
+	now := time.Date(2025, 6, 6, 9, 0, 0, 0, time.UTC)
+	assert.False(t, schedule.Contains(now))
+	assert.True(t, schedule.Contains(now.In(tokyo)))
+}
+
+func TestCouponScheduleValidate(t *testing.T) {
+	assert.NoError(t, CouponSchedule{
+		Recurring: []RecurringWindow{{Weekdays: []string{"Mon", "sunday"}, Start: "22:00", End: "02:00"}},
+		Dates:     []DateRange{{From: "2025-12-24", To: "2025-12-24"}},
+	}.Validate())
+
+	invalid := []CouponSchedule{
+		{Recurring: []RecurringWindow{{Weekdays: []string{"someday"}, Start: "17:00", End: "19:00"}}},
+		{Recurring: []RecurringWindow{{Start: "9:00", End: "19:00"}}},
+		{Recurring: []RecurringWindow{{Start: "17:00", End: "24:00"}}},
+		{Recurring: []RecurringWindow{{Start: "17:00", End: "17:00"}}},
+		{Dates: []DateRange{{From: "2025-12-26", To: "2025-12-24"}}},
+		{Dates: []DateRange{{From: "24.12.2025", To: "2025-12-26"}}},
+	}
+	for _, schedule := range invalid {
+		assert.Error(t, schedule.Validate(), "%+v", schedule)
+	}
+}
@@ -0,0 +1,176 @@
+package pkg
+
+// coupon_snapshot.go persists the coupon index between restarts.
+//
+// Next to the index file the builder keeps the sorted set of every source and a
+// manifest describing the sources (size and sha256 checksum) the snapshot was built
+// from. When the sources are unchanged the index is opened as is, otherwise only the
+// sets of the changed sources are rebuilt before merging them into a new index.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+const (
+	// couponSnapshotVersion must be bumped whenever the layout of the index or
+	// set files, or the way codes are extracted from the sources changes
+	couponSnapshotVersion = 2
+
+	couponManifestFileName = "manifest.json"
+	couponSetFileSuffix    = ".set"
+)
+
+// couponSnapshotSource identifies the exact content of a coupon source
+type couponSnapshotSource struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"sha256"`
+	Set      string `json:"set"`
+
+	path string
+}
+
+// couponSnapshotManifest describes the sources an index snapshot was built from
+type couponSnapshotManifest struct {
+	Version   int                    `json:"version"`
+	Tokenizer string                 `json:"tokenizer"`
+	Sources   []couponSnapshotSource `json:"sources"`
+	Index     string                 `json:"index"`
+	IndexSize int64                  `json:"indexSize"`
+}
+
+// describeSources computes the size and checksum of every source file
+func describeSources(files []string) ([]couponSnapshotSource, error) {
+	sources := make([]couponSnapshotSource, 0, len(files))
+	for _, file := range files {
+		fd, err := os.Open(file)
+		if err != nil {
+			return nil, utils.WrapError(err, "failed to open coupon source: "+file)
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, fd)
+		fd.Close()
+		if err != nil {
+			return nil, utils.WrapError(err, "failed to checksum coupon source: "+file)
+		}
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		sources = append(sources, couponSnapshotSource{
+			Name:     filepath.Base(file),
+			Size:     size,
+			Checksum: checksum,
+			Set:      fmt.Sprintf("source-%s-%d%s", checksum[:16], size, couponSetFileSuffix),
+			path:     file,
+		})
+	}
+	return sources, nil
+}
+
+// loadSnapshotManifest returns the manifest stored in workDir, or nil when there is
+// no snapshot built by this version with the same tokenizer
+func loadSnapshotManifest(workDir string, tokenizer *CouponTokenizer) *couponSnapshotManifest {
+	data, err := os.ReadFile(filepath.Join(workDir, couponManifestFileName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Failed to read coupon index manifest: ", err)
+		}
+		return nil
+	}
+	var manifest couponSnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		logger.Warn("Ignoring corrupt coupon index manifest: ", err)
+		return nil
+	}
+	if manifest.Version != couponSnapshotVersion {
+		logger.Infof("Ignoring coupon index snapshot with version %d, expected %d", manifest.Version, couponSnapshotVersion)
+		return nil
+	}
+	if manifest.Tokenizer != tokenizer.String() {
+		logger.Infof("Ignoring coupon index snapshot built with tokenizer %q, expected %q", manifest.Tokenizer, tokenizer.String())
+		return nil
+	}
+	return &manifest
+}
+
+// matches reports whether the snapshot was built from exactly these sources
+func (m *couponSnapshotManifest) matches(sources []couponSnapshotSource, workDir string) bool {
+	if len(m.Sources) != len(sources) {
+		return false
+	}
+	for i, source := range sources {
+		if m.Sources[i].Name != source.Name || !m.hasSet(source, workDir) {
+			return false
+		}
+	}
+	info, err := os.Stat(filepath.Join(workDir, m.Index))
+	return err == nil && info.Size() == m.IndexSize
+}
+
+// hasSet reports whether the set of a source with the same content is still available
+func (m *couponSnapshotManifest) hasSet(source couponSnapshotSource, workDir string) bool {
+	for _, previous := range m.Sources {
+		if previous.Size == source.Size && previous.Checksum == source.Checksum && previous.Set == source.Set {
+			_, err := os.Stat(filepath.Join(workDir, source.Set))
+			return err == nil
+		}
+	}
+	return false
+}
+
+// countSetCodes returns the number of codes in the set of every source. Sets hold
+// one key per code, so the count follows from their size.
+func countSetCodes(sources []couponSnapshotSource, workDir string) []int64 {
+	counts := make([]int64, len(sources))
+	for i, source := range sources {
+		info, err := os.Stat(filepath.Join(workDir, source.Set))
+		if err != nil {
+			logger.Warn("Failed to stat coupon set: ", err)
+			continue
+		}
+		counts[i] = info.Size() / maxCouponCodeLength
+	}
+	return counts
+}
+
+// writeSnapshotManifest atomically replaces the manifest in workDir
+func writeSnapshotManifest(workDir string, manifest couponSnapshotManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return utils.WrapError(err, "failed to encode coupon index manifest")
+	}
+	path := filepath.Join(workDir, couponManifestFileName)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return utils.WrapError(err, "failed to write coupon index manifest")
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// removeStaleSets deletes set files which are not part of the current snapshot
+func removeStaleSets(workDir string, sources []couponSnapshotSource) {
+	current := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		current[source.Set] = true
+	}
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		logger.Warn("Failed to list coupon index directory: ", err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, couponSetFileSuffix) && !current[name] {
+			if err := os.Remove(filepath.Join(workDir, name)); err != nil {
+				logger.Warn("Failed to remove stale coupon set: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package pkg
+
+// coupon_tokenizer.go splits the random text of the coupon sources into candidate codes.
+//
+// A token is a maximal run of code characters, delimited by any other character.
+// Which characters are code characters depends on the configured classes: with the
+// default letter classes digits are delimiters, so "SUPERSAVER12" yields SUPERSAVER
+// and "TENOFF60" yields the too short TENOFF, while with the digit class both are
+// single tokens. Only tokens whose whole length is within [minCouponCodeLength,
+// maxCouponCodeLength] are candidates, so a run of code characters longer than a code
+// never yields a shorter code hidden inside it. Runs are never buffered beyond
+// maxCouponCodeLength, which keeps memory bounded no matter how long the lines of a
+// source are.
+
+import (
+	"bufio"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const minCouponCodeLength = 8
+
+type CouponCharClass string
+
+const (
+	CouponCharUpper CouponCharClass = "upper"
+	CouponCharLower CouponCharClass = "lower"
+	CouponCharDigit CouponCharClass = "digit"
+)
+
+// defaultCouponCharClasses are the characters coupon codes are made of unless configured otherwise
+var defaultCouponCharClasses = []CouponCharClass{CouponCharUpper, CouponCharLower}
+
+// CouponTokenizer extracts candidate coupon codes from text
+type CouponTokenizer struct {
+	classes  []CouponCharClass
+	codeChar [256]bool
+	foldCase bool
+}
+
+// NewCouponTokenizer creates a tokenizer treating the given character classes as code characters
+func NewCouponTokenizer(classes ...CouponCharClass) (*CouponTokenizer, error) {
+	if len(classes) == 0 {
+		classes = defaultCouponCharClasses
+	}
+	tokenizer := &CouponTokenizer{}
+	for _, class := range classes {
+		var from, to byte
+		switch class {
+		case CouponCharUpper:
+			from, to = 'A', 'Z'
+		case CouponCharLower:
+			from, to = 'a', 'z'
+		case CouponCharDigit:
+			from, to = '0', '9'
+		default:
+			return nil, fmt.Errorf("unknown coupon character class: %q", class)
+		}
+		for c := from; c <= to; c++ {
+			tokenizer.codeChar[c] = true
+		}
+		if !slices.Contains(tokenizer.classes, class) {
+			tokenizer.classes = append(tokenizer.classes, class)
+		}
+	}
+	slices.Sort(tokenizer.classes)
+	return tokenizer, nil
+}
+
+// ParseCouponCharClasses parses a comma separated list of character classes, e.g. "upper,digit"
+func ParseCouponCharClasses(value string) []CouponCharClass {
+	var classes []CouponCharClass
+	for _, class := range strings.Split(value, ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			classes = append(classes, CouponCharClass(strings.ToLower(class)))
+		}
+	}
+	return classes
+}
+
+// WithCaseFolding returns a copy of the tokenizer matching codes regardless of their case.
+// Letters of either case are code characters and codes are normalized to upper case.
+func (t *CouponTokenizer) WithCaseFolding() *CouponTokenizer {
+	folded := *t
+	folded.classes = slices.Clone(t.classes)
+	folded.foldCase = true
+	if folded.codeChar['A'] || folded.codeChar['a'] {
+		for c := byte('A'); c <= 'Z'; c++ {
+			folded.codeChar[c] = true
+			folded.codeChar[c+'a'-'A'] = true
+		}
+	}
+	return &folded
+}
+
+// Normalize returns the form a code is indexed and looked up in
+func (t *CouponTokenizer) Normalize(code string) string {
+	if t.foldCase {
+		return strings.ToUpper(code)
+	}
+	return code
+}
+
+func defaultCouponTokenizer() *CouponTokenizer {
+	tokenizer, _ := NewCouponTokenizer()
+	return tokenizer
+}
+
+// String identifies the tokenizer configuration, so indexes built with another
+// configuration can be told apart
+func (t *CouponTokenizer) String() string {
+	classes := make([]string, 0, len(t.classes))
+	for _, class := range t.classes {
+		classes = append(classes, string(class))
+	}
+	fingerprint := fmt.Sprintf("%s;%d-%d", strings.Join(classes, ","), minCouponCodeLength, maxCouponCodeLength)
+	if t.foldCase {
+		fingerprint += ";fold"
+	}
+	return fingerprint
+}
+
+// IsCode reports whether the whole value is a well formed coupon code
+func (t *CouponTokenizer) IsCode(value string) bool {
+	if len(value) < minCouponCodeLength || len(value) > maxCouponCodeLength {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if !t.codeChar[value[i]] {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitFunc returns a bufio.SplitFunc yielding the candidate codes of a stream.
+// The returned function keeps state and must only be used by a single scanner.
+func (t *CouponTokenizer) SplitFunc() bufio.SplitFunc {
+	// skipping is set while inside a run which is already too long to be a code
+	skipping := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		i := 0
+		for i < len(data) {
+			for i < len(data) && !t.codeChar[data[i]] {
+				skipping = false
+				i++
+			}
+			start := i
+			for i < len(data) && t.codeChar[data[i]] && i-start <= maxCouponCodeLength {
+				i++
+			}
+			if i-start > maxCouponCodeLength {
+				skipping = true
+				continue
+			}
+			if i == len(data) && !atEOF {
+				if skipping {
+					return len(data), nil, nil
+				}
+				// The run might continue in the next read
+				return start, nil, nil
+			}
+			if skipping {
+				skipping = false
+				continue
+			}
+			if i-start >= minCouponCodeLength {
+				return i, data[start:i], nil
+			}
+		}
+		return len(data), nil, nil
+	}
+}
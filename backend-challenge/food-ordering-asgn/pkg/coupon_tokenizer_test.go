@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+func tokenize(t *testing.T, tokenizer *CouponTokenizer, content string) []string {
+	scanner := fileScanner(strings.NewReader(content), tokenizer)
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	return tokens
+}
+
+func TestCouponTokenizerGolden(t *testing.T) {
+	tokenizers := map[string][]CouponCharClass{
+		"letters":      {CouponCharUpper, CouponCharLower},
+		"alphanumeric": {CouponCharUpper, CouponCharLower, CouponCharDigit},
+	}
+	corpora, err := filepath.Glob(filepath.Join("testdata", "coupons", "*.txt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, corpora)
+
+	for name, classes := range tokenizers {
+		tokenizer, err := NewCouponTokenizer(classes...)
+		require.NoError(t, err)
+		for _, corpus := range corpora {
+			base := strings.TrimSuffix(filepath.Base(corpus), ".txt")
+			t.Run(name+"/"+base, func(t *testing.T) {
+				content, err := os.ReadFile(corpus)
+				require.NoError(t, err)
+				actual := strings.Join(tokenize(t, tokenizer, string(content)), "\n") + "\n"
+
+				golden := filepath.Join("testdata", "golden", base+"."+name+".golden")
+				if *updateGolden {
+					require.NoError(t, os.WriteFile(golden, []byte(actual), 0o644))
+				}
+				expected, err := os.ReadFile(golden)
+				require.NoError(t, err)
+				assert.Equal(t, string(expected), actual)
+			})
+		}
+	}
+}
+
+func TestCouponTokenizerValidation(t *testing.T) {
+	for _, classes := range [][]CouponCharClass{
+		{CouponCharUpper, CouponCharLower},
+		{CouponCharUpper, CouponCharLower, CouponCharDigit},
+	} {
+		tokenizer, err := NewCouponTokenizer(classes...)
+		require.NoError(t, err)
+		index, err := NewCouponIndexBuilder(WithIndexTokenizer(tokenizer)).Build(filepath.Join("testdata", "coupons"))
+		require.NoError(t, err)
+
+		// The examples given by the challenge
+		for code, valid := range map[string]bool{
+			"HAPPYHRS": true,
+			"FIFTYOFF": true,
+			"SUPER100": false,
+		} {
+			sources, _, err := index.Lookup(code)
+			assert.NoError(t, err)
+			assert.Equal(t, valid, len(sources) >= 2, "%s with %s", code, tokenizer)
+		}
+		require.NoError(t, index.Close())
+	}
+}
+
+func TestCouponTokenizerSplitsAcrossReads(t *testing.T) {
+	tokenizer := defaultCouponTokenizer()
+	// Tokens and over long runs straddling the scanner's buffer boundary
+	content := strings.Repeat(" ", couponReadBufferSize-4) + "HAPPYHRS " +
+		strings.Repeat("Z", couponReadBufferSize) + " FIFTYOFF"
+	assert.Equal(t, []string{"HAPPYHRS", "FIFTYOFF"}, tokenize(t, tokenizer, content))
+}
+
+func TestCouponTokenizerIsCode(t *testing.T) {
+	tokenizer := defaultCouponTokenizer()
+	assert.True(t, tokenizer.IsCode("HAPPYHRS"))
+	assert.True(t, tokenizer.IsCode("HAPPYHOURS"))
+	assert.False(t, tokenizer.IsCode("SUPER100"))
+	assert.False(t, tokenizer.IsCode("SHORT"))
+	assert.False(t, tokenizer.IsCode("MUCHTOOLONGCODE"))
+
+	_, err := NewCouponTokenizer("symbols")
+	assert.Error(t, err)
+	assert.Equal(t, []CouponCharClass{CouponCharUpper, CouponCharDigit}, ParseCouponCharClasses(" Upper, digit,"))
+}
@@ -0,0 +1,302 @@
+package pkg
+
+// coupon_watcher.go keeps the coupon index in sync with the data directory while the
+// server is running. The directory is polled for added, changed and removed files;
+// on a change the index is rebuilt, rescanning only the affected sources thanks to
+// the snapshot, and swapped in atomically. Lookups hold a read lock for as long as
+// they use an index, so a request never sees two different indexes and an index is
+// only closed once nobody uses it anymore.
+//
+// Sources can also be added and removed through the watcher, which reloads the
+// index right away instead of waiting for the next poll.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+const defaultCouponWatchInterval = 10 * time.Second
+
+var (
+	ErrInvalidCouponSourceName = errors.New("invalid coupon source name")
+	ErrCouponSourceExists      = errors.New("coupon source already exists")
+	ErrCouponSourceNotFound    = errors.New("coupon source not found")
+	ErrCouponSourceRejected    = errors.New("coupon source could not be indexed")
+)
+
+// CouponIndexProvider gives access to the current coupon index
+type CouponIndexProvider interface {
+	// WithIndex calls fn with the current index, which stays valid until fn returns
+	WithIndex(fn func(*CouponIndex) error) error
+}
+
+// WithIndex implements CouponIndexProvider for an index which never changes
+func (idx *CouponIndex) WithIndex(fn func(*CouponIndex) error) error {
+	return fn(idx)
+}
+
+// couponFileState is what the watcher compares to detect changed sources
+type couponFileState struct {
+	size    int64
+	modTime int64
+}
+
+// CouponIndexWatcher rebuilds the coupon index whenever the data directory changes
+type CouponIndexWatcher struct {
+	builder  *CouponIndexBuilder
+	dirPath  string
+	interval time.Duration
+	onReload []func(*CouponIndex) error
+	// tempDir is the work directory created for a builder without one, it is kept
+	// across reloads so only changed sources are rescanned
+	tempDir string
+
+	mu     sync.RWMutex
+	index  *CouponIndex
+	files  map[string]couponFileState
+	reload sync.Mutex
+}
+
+// WithWatchInterval sets how often the data directory is checked for changes
+func WithWatchInterval(interval time.Duration) func(*CouponIndexWatcher) {
+	return func(w *CouponIndexWatcher) {
+		if interval > 0 {
+			w.interval = interval
+		}
+	}
+}
+
+// WithReloadHook registers a function called with every newly built index before it
+// is swapped in. An error keeps the previous index in place.
+func WithReloadHook(hook func(*CouponIndex) error) func(*CouponIndexWatcher) {
+	return func(w *CouponIndexWatcher) {
+		w.onReload = append(w.onReload, hook)
+	}
+}
+
+// NewCouponIndexWatcher builds the initial index of dirPath. Without a work directory
+// set on the builder, a temporary one is used until the watcher is closed.
+func NewCouponIndexWatcher(builder *CouponIndexBuilder, dirPath string, opts ...func(*CouponIndexWatcher)) (*CouponIndexWatcher, error) {
+	watcher := &CouponIndexWatcher{
+		builder:  builder,
+		dirPath:  dirPath,
+		interval: defaultCouponWatchInterval,
+	}
+	for _, opt := range opts {
+		opt(watcher)
+	}
+	if builder.workDir == "" {
+		tempDir, err := os.MkdirTemp("", "coupon-index-*")
+		if err != nil {
+			return nil, utils.WrapError(err, "failed to create coupon index directory")
+		}
+		withWorkDir := *builder
+		withWorkDir.workDir = tempDir
+		watcher.builder, watcher.tempDir = &withWorkDir, tempDir
+	}
+	if err := watcher.Reload(); err != nil {
+		if watcher.tempDir != "" {
+			os.RemoveAll(watcher.tempDir)
+		}
+		return nil, err
+	}
+	return watcher, nil
+}
+
+func (w *CouponIndexWatcher) WithIndex(fn func(*CouponIndex) error) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return fn(w.index)
+}
+
+// Run polls the data directory until the context is cancelled
+func (w *CouponIndexWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := w.changed()
+			if err != nil {
+				logger.Error("Failed to check coupon sources for changes: ", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if err := w.Reload(); err != nil {
+				logger.Error("Failed to reload coupon index, keeping the previous one: ", err)
+			}
+		}
+	}
+}
+
+// Reload rebuilds the index and swaps it in
+func (w *CouponIndexWatcher) Reload() error {
+	w.reload.Lock()
+	defer w.reload.Unlock()
+	return w.rebuild()
+}
+
+// rebuild must be called with the reload lock held
+func (w *CouponIndexWatcher) rebuild() error {
+	files, err := scanCouponFiles(w.dirPath)
+	if err != nil {
+		return err
+	}
+	index, err := w.builder.Build(w.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, hook := range w.onReload {
+		if err := hook(index); err != nil {
+			index.Close()
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	previous, previousFiles := w.index, w.files
+	w.index, w.files = index, files
+	w.mu.Unlock()
+
+	if previous != nil {
+		logCouponSourceChanges(previousFiles, files)
+		if err := previous.Close(); err != nil {
+			logger.Warn("Failed to close the previous coupon index: ", err)
+		}
+	}
+	return nil
+}
+
+// AddSource streams content into a new source of the data directory and reloads
+// the index. Sources are stored as uploaded, plain or gzip compressed. When the
+// index can't be built with the new source, e.g. because its content is corrupt,
+// the source is removed again.
+func (w *CouponIndexWatcher) AddSource(name string, content io.Reader) error {
+	if !isCouponSourceName(name) {
+		return ErrInvalidCouponSourceName
+	}
+	// Uploads are hidden until complete, so a reload never sees a partial source
+	upload, err := os.CreateTemp(w.dirPath, ".upload-*")
+	if err != nil {
+		return utils.WrapError(err, "failed to create coupon source")
+	}
+	defer os.Remove(upload.Name())
+	if _, err := io.Copy(upload, content); err != nil {
+		upload.Close()
+		return utils.WrapError(err, "failed to write coupon source")
+	}
+	if err := upload.Close(); err != nil {
+		return utils.WrapError(err, "failed to write coupon source")
+	}
+
+	w.reload.Lock()
+	defer w.reload.Unlock()
+
+	path := filepath.Join(w.dirPath, name)
+	if _, err := os.Stat(path); err == nil {
+		return ErrCouponSourceExists
+	}
+	if err := os.Rename(upload.Name(), path); err != nil {
+		return utils.WrapError(err, "failed to store coupon source")
+	}
+	if err := w.rebuild(); err != nil {
+		os.Remove(path)
+		return errors.Join(ErrCouponSourceRejected, err)
+	}
+	return nil
+}
+
+// RemoveSource deletes a source from the data directory and reloads the index
+func (w *CouponIndexWatcher) RemoveSource(name string) error {
+	if !isCouponSourceName(name) {
+		return ErrInvalidCouponSourceName
+	}
+
+	w.reload.Lock()
+	defer w.reload.Unlock()
+
+	if err := os.Remove(filepath.Join(w.dirPath, name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrCouponSourceNotFound
+		}
+		return utils.WrapError(err, "failed to remove coupon source")
+	}
+	return w.rebuild()
+}
+
+// isCouponSourceName reports whether name can be used as the file name of a source
+func isCouponSourceName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && filepath.Base(name) == name &&
+		!strings.ContainsAny(name, `/\`)
+}
+
+// Close releases the current index and removes the temporary work directory
+func (w *CouponIndexWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.index.Close()
+	if w.tempDir != "" {
+		if rmErr := os.RemoveAll(w.tempDir); rmErr != nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// changed reports whether a source was added, changed or removed since the last reload
+func (w *CouponIndexWatcher) changed() (bool, error) {
+	files, err := scanCouponFiles(w.dirPath)
+	if err != nil {
+		return false, err
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return !maps.Equal(files, w.files), nil
+}
+
+func scanCouponFiles(dirPath string) (map[string]couponFileState, error) {
+	paths, err := getFilesInDirectory(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]couponFileState, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, utils.WrapError(err, "failed to stat coupon source: "+path)
+		}
+		files[filepath.Base(path)] = couponFileState{size: info.Size(), modTime: info.ModTime().UnixNano()}
+	}
+	return files, nil
+}
+
+func logCouponSourceChanges(previous, current map[string]couponFileState) {
+	for _, name := range slices.Sorted(maps.Keys(current)) {
+		state, existed := previous[name]
+		switch {
+		case !existed:
+			logger.Infof("Coupon source %s was added", name)
+		case state != current[name]:
+			logger.Infof("Coupon source %s was changed", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(previous)) {
+		if _, exists := current[name]; !exists {
+			logger.Infof("Coupon source %s was removed", name)
+		}
+	}
+}
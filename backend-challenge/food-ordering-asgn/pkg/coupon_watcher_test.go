@@ -0,0 +1,200 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCouponIndexWatcherReloads(t *testing.T) {
+	dataDir, workDir := t.TempDir(), t.TempDir()
+	writeSource := func(name, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, name), []byte(content), 0o644))
+	}
+	writeSource("couponbase1", "FIFTYOFF HAPPYHRS")
+	writeSource("couponbase2", "FIFTYOFF")
+
+	var reloads atomic.Int32
+	watcher, err := NewCouponIndexWatcher(
+		NewCouponIndexBuilder(WithIndexWorkDir(workDir)), dataDir,
+		WithWatchInterval(10*time.Millisecond),
+		WithReloadHook(func(*CouponIndex) error {
+			reloads.Add(1)
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.Equal(t, int32(1), reloads.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.Run(ctx)
+
+	lookup := func(code string) (sources []string, rebuilt []string) {
+		err := watcher.WithIndex(func(index *CouponIndex) error {
+			var err error
+			sources, _, err = index.Lookup(code)
+			rebuilt = index.rebuiltSources
+			return err
+		})
+		require.NoError(t, err)
+		return sources, rebuilt
+	}
+
+	// A changed source is the only one rescanned
+	writeSource("couponbase2", "FIFTYOFF HAPPYHRS NINTYOFF")
+	require.Eventually(t, func() bool {
+		sources, _ := lookup("HAPPYHRS")
+		return len(sources) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	_, rebuilt := lookup("HAPPYHRS")
+	assert.Equal(t, []string{"couponbase2"}, rebuilt)
+
+	// Added sources are indexed
+	writeSource("couponbase3", "NINTYOFF")
+	require.Eventually(t, func() bool {
+		sources, _ := lookup("NINTYOFF")
+		return len(sources) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Removed sources no longer count
+	require.NoError(t, os.Remove(filepath.Join(dataDir, "couponbase1")))
+	require.Eventually(t, func() bool {
+		sources, _ := lookup("FIFTYOFF")
+		return len(sources) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, reloads.Load(), int32(4))
+}
+
+func TestCouponIndexWatcherKeepsTemporaryWorkDir(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase1"), []byte("FIFTYOFF"), 0o644))
+
+	watcher, err := NewCouponIndexWatcher(NewCouponIndexBuilder(), dataDir)
+	require.NoError(t, err)
+	workDir := watcher.tempDir
+	require.NotEmpty(t, workDir)
+
+	// Reloads reuse the snapshot of the temporary work directory
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase2"), []byte("HAPPYHRS"), 0o644))
+	require.NoError(t, watcher.Reload())
+	err = watcher.WithIndex(func(index *CouponIndex) error {
+		assert.Equal(t, workDir, index.workDir)
+		assert.Equal(t, []string{"couponbase2"}, index.rebuiltSources)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, watcher.Close())
+	_, err = os.Stat(workDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCouponIndexWatcherKeepsIndexWhileInUse(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase1"), []byte("FIFTYOFF"), 0o644))
+
+	watcher, err := NewCouponIndexWatcher(NewCouponIndexBuilder(), dataDir)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	inUse, reloaded := make(chan struct{}), make(chan error)
+	go func() {
+		<-inUse
+		reloaded <- watcher.Reload()
+	}()
+
+	err = watcher.WithIndex(func(index *CouponIndex) error {
+		close(inUse)
+		// The reload can't swap the index while it is being used
+		select {
+		case err := <-reloaded:
+			t.Errorf("index was swapped while in use: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		_, found, err := index.Lookup("FIFTYOFF")
+		assert.True(t, found)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, <-reloaded)
+}
+
+func TestCouponIndexWatcherKeepsIndexOnFailedReload(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase1"), []byte("FIFTYOFF"), 0o644))
+
+	failing := false
+	watcher, err := NewCouponIndexWatcher(NewCouponIndexBuilder(), dataDir,
+		WithReloadHook(func(*CouponIndex) error {
+			if failing {
+				return assert.AnError
+			}
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase2"), []byte("FIFTYOFF"), 0o644))
+	failing = true
+	assert.Error(t, watcher.Reload())
+
+	err = watcher.WithIndex(func(index *CouponIndex) error {
+		assert.Equal(t, []string{"couponbase1"}, index.Sources())
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestCouponIndexWatcherManagesSources(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "couponbase1"), []byte("FIFTYOFF"), 0o644))
+
+	watcher, err := NewCouponIndexWatcher(NewCouponIndexBuilder(), dataDir)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	sources := func() (names []string, codes map[string]int64) {
+		watcher.WithIndex(func(index *CouponIndex) error {
+			names, codes = index.Sources(), index.SourceCodes()
+			return nil
+		})
+		return names, codes
+	}
+
+	require.NoError(t, watcher.AddSource("couponbase2", strings.NewReader("FIFTYOFF HAPPYHRS")))
+	names, codes := sources()
+	assert.Equal(t, []string{"couponbase1", "couponbase2"}, names)
+	assert.Equal(t, map[string]int64{"couponbase1": 1, "couponbase2": 2}, codes)
+
+	assert.ErrorIs(t, watcher.AddSource("couponbase2", strings.NewReader("NINTYOFF")), ErrCouponSourceExists)
+	assert.ErrorIs(t, watcher.AddSource("../couponbase3", strings.NewReader("NINTYOFF")), ErrInvalidCouponSourceName)
+	assert.ErrorIs(t, watcher.AddSource(".couponbase3", strings.NewReader("NINTYOFF")), ErrInvalidCouponSourceName)
+
+	// A corrupt source is removed again and the index is left untouched
+	corrupt := append([]byte{0x1f, 0x8b}, "FIFTYOFF"...)
+	assert.ErrorIs(t, watcher.AddSource("couponbase3.gz", bytes.NewReader(corrupt)), ErrCouponSourceRejected)
+	assert.NoFileExists(t, filepath.Join(dataDir, "couponbase3.gz"))
+	names, _ = sources()
+	assert.Equal(t, []string{"couponbase1", "couponbase2"}, names)
+
+	require.NoError(t, watcher.RemoveSource("couponbase1"))
+	names, _ = sources()
+	assert.Equal(t, []string{"couponbase2"}, names)
+	assert.ErrorIs(t, watcher.RemoveSource("couponbase1"), ErrCouponSourceNotFound)
+
+	// No upload leftovers remain in the data directory
+	entries, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -4,14 +4,29 @@ package pkg
 // It provides functions to initialize the database, create tables, and manage connections.
 
 import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"time"
 
 	"github.com/parvez0/food-ordering-asgn/utils"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	gormsqlite "gorm.io/driver/sqlite"
 	gorm "gorm.io/gorm"
 )
 
+const (
+	defaultSqliteBusyTimeout  = 5 * time.Second
+	defaultSqliteMaxOpenConns = 8
+	defaultSqliteMaxIdleConns = 8
+
+	// busyRetries is the number of times an operation failing with SQLITE_BUSY is retried
+	busyRetries      = 5
+	busyRetryBackoff = 20 * time.Millisecond
+)
+
 var (
 	logger = utils.GetLogger()
 )
@@ -27,6 +42,103 @@ func WithSqliteInMemoryDB() func() (*gorm.DB, error) {
 	}
 }
 
+// sqliteFileConfig configures a file backed Sqlite database
+type sqliteFileConfig struct {
+	busyTimeout  time.Duration
+	maxOpenConns int
+	maxIdleConns int
+}
+
+// WithSqliteBusyTimeout sets how long a connection waits for a lock held by another one
+func WithSqliteBusyTimeout(timeout time.Duration) func(*sqliteFileConfig) {
+	return func(c *sqliteFileConfig) {
+		if timeout > 0 {
+			c.busyTimeout = timeout
+		}
+	}
+}
+
+// WithSqliteMaxOpenConns limits the number of open connections
+func WithSqliteMaxOpenConns(conns int) func(*sqliteFileConfig) {
+	return func(c *sqliteFileConfig) {
+		if conns > 0 {
+			c.maxOpenConns = conns
+		}
+	}
+}
+
+// WithSqliteMaxIdleConns limits the number of idle connections kept in the pool
+func WithSqliteMaxIdleConns(conns int) func(*sqliteFileConfig) {
+	return func(c *sqliteFileConfig) {
+		if conns > 0 {
+			c.maxIdleConns = conns
+		}
+	}
+}
+
+// WithSqliteFileDB stores the database in the file at path, so it survives restarts.
+// The database runs in WAL mode with foreign keys enforced. Transactions take the
+// write lock when they begin, so concurrent writers wait for each other up to the
+// busy timeout instead of failing while upgrading their lock.
+func WithSqliteFileDB(path string, opts ...func(*sqliteFileConfig)) func() (*gorm.DB, error) {
+	return func() (*gorm.DB, error) {
+		config := &sqliteFileConfig{
+			busyTimeout:  defaultSqliteBusyTimeout,
+			maxOpenConns: defaultSqliteMaxOpenConns,
+			maxIdleConns: defaultSqliteMaxIdleConns,
+		}
+		for _, opt := range opts {
+			opt(config)
+		}
+
+		logger.Debugf("Setting up Sqlite database in %s", path)
+		params := url.Values{}
+		params.Set("_journal_mode", "WAL")
+		params.Set("_foreign_keys", "on")
+		params.Set("_busy_timeout", fmt.Sprint(config.busyTimeout.Milliseconds()))
+		params.Set("_txlock", "immediate")
+		db, err := gorm.Open(gormsqlite.Open("file:"+path+"?"+params.Encode()), &gorm.Config{})
+		if err != nil {
+			return nil, utils.WrapError(err, "Failed to setup Sqlite database")
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, utils.WrapError(err, "Failed to setup Sqlite database")
+		}
+		sqlDB.SetMaxOpenConns(config.maxOpenConns)
+		sqlDB.SetMaxIdleConns(min(config.maxIdleConns, config.maxOpenConns))
+		if err := sqlDB.Ping(); err != nil {
+			return nil, utils.WrapError(err, "Failed to open Sqlite database "+path)
+		}
+		return db, nil
+	}
+}
+
 func NewDB(dbEngine func() (*gorm.DB, error)) (*gorm.DB, error) {
 	return dbEngine()
-}
\ No newline at end of file
+}
+
+// isBusyError reports whether err is Sqlite failing to get a lock in time
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// retryOnBusy runs fn again, with a growing and jittered delay, as long as it fails
+// because the database is locked by another connection
+func retryOnBusy(fn func() error) error {
+	backoff := busyRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusyError(err) || attempt > busyRetries {
+			return err
+		}
+		logger.Warnf("Database is busy, retrying in %s (attempt %d/%d)", backoff, attempt, busyRetries)
+		time.Sleep(backoff/2 + rand.N(backoff))
+		backoff *= 2
+	}
+}
@@ -1,11 +1,14 @@
 package pkg
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
-	"runtime"
 	"testing"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	suite "github.com/stretchr/testify/suite"
 	gorm "gorm.io/gorm"
 )
@@ -21,14 +24,8 @@ func (dbSuite *DBTestSuite) SetupTest() {
 
 	assert.NoError(dbSuite.T(), err)
 
-	err = dbSuite.dbInstance.AutoMigrate(
-		&Product{},
-		&Order{},
-		&OrderItem{},
-		&Coupon{},
-		&CouponSource{},
-	)
-	
+	_, err = NewMigrator(dbSuite.dbInstance).Up()
+
 	assert.NoError(dbSuite.T(), err)
 }
 
@@ -42,32 +39,66 @@ func (dbSuite *DBTestSuite) TestDBProductSeed() {
 	assert.Equal(dbSuite.T(), len(product), 6)
 }
 
-func (dbSuite *DBTestSuite) TestCouponSeeding() {
-	// Test coupon seeding
-	_, file, _, ok := runtime.Caller(0)
-	assert.True(dbSuite.T(), ok, "Expected to find caller file name")
-	err := seedCoupons(filepath.Join(filepath.Dir(file), "../data"), dbSuite.dbInstance)
-	assert.NoError(dbSuite.T(), err)
+func TestSqliteFileDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.db")
+	db, err := NewDB(WithSqliteFileDB(path))
+	require.NoError(t, err)
+	require.NoError(t, SeedDatabase(db))
 
-	// Verify coupons were created
-	var coupons []Coupon
-	err = dbSuite.dbInstance.Preload("SourceFile").Find(&coupons).Error
-	assert.NoError(dbSuite.T(), err)
-	assert.Greater(dbSuite.T(), len(coupons), 0)
+	var journalMode string
+	require.NoError(t, db.Raw("PRAGMA journal_mode").Scan(&journalMode).Error)
+	assert.Equal(t, "wal", journalMode)
+	var foreignKeys int
+	require.NoError(t, db.Raw("PRAGMA foreign_keys").Scan(&foreignKeys).Error)
+	assert.Equal(t, 1, foreignKeys)
+	var busyTimeout int
+	require.NoError(t, db.Raw("PRAGMA busy_timeout").Scan(&busyTimeout).Error)
+	assert.Equal(t, int(defaultSqliteBusyTimeout.Milliseconds()), busyTimeout)
 
-	// Verify coupon sources were created
-	var sources []CouponSource
-	err = dbSuite.dbInstance.Find(&sources).Error
-	assert.NoError(dbSuite.T(), err)
-	assert.Greater(dbSuite.T(), len(sources), 0)
-
-	// Verify coupon-source associations
-	for _, coupon := range coupons {
-		assert.Greater(dbSuite.T(), len(coupon.SourceFile), 0, "Coupon should have at least one source file")
-	}
-
-	// Test coupon validation by checking source files
-	for _, coupon := range coupons {
-		assert.GreaterOrEqual(dbSuite.T(), len(coupon.SourceFile), 1, "Coupon should have at least one source files to be valid")
-	}
-}
\ No newline at end of file
+	require.NoError(t, db.Create(&Order{Total: 10}).Error)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqlDB.Close())
+
+	// Orders survive a restart, which doesn't seed the products again
+	db, err = NewDB(WithSqliteFileDB(path))
+	require.NoError(t, err)
+	require.NoError(t, SeedDatabase(db))
+	var orders, products int64
+	require.NoError(t, db.Model(&Order{}).Count(&orders).Error)
+	assert.Equal(t, int64(1), orders)
+	require.NoError(t, db.Model(&Product{}).Count(&products).Error)
+	assert.Equal(t, int64(6), products)
+}
+
+func TestRetryOnBusy(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+
+	attempts := 0
+	err := retryOnBusy(func() error {
+		if attempts++; attempts < 3 {
+			return busy
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// Other errors are not retried
+	attempts = 0
+	err = retryOnBusy(func() error {
+		attempts++
+		return errors.New("constraint failed")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	// A database which stays busy eventually fails
+	attempts = 0
+	err = retryOnBusy(func() error {
+		attempts++
+		return fmt.Errorf("failed to create order: %w", busy)
+	})
+	assert.True(t, isBusyError(err))
+	assert.Equal(t, busyRetries+1, attempts)
+}
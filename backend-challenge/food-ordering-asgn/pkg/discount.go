@@ -0,0 +1,97 @@
+package pkg
+
+// discount.go implements the discount rules a coupon can carry and evaluates
+// them against a priced order. A rule can optionally be scoped to a single
+// product category, in which case only the lines of that category are considered.
+
+import (
+	"fmt"
+	"strings"
+)
+
+type DiscountRuleType string
+
+const (
+	// DiscountNone marks a coupon which is accepted but does not change the price
+	DiscountNone DiscountRuleType = ""
+	// DiscountPercentage takes Value percent off the order
+	DiscountPercentage DiscountRuleType = "percentage"
+	// DiscountFixedAmount takes Value off the order
+	DiscountFixedAmount DiscountRuleType = "fixed_amount"
+	// DiscountCheapestItemFree gives one unit of the lowest priced item for free,
+	// provided at least two units are ordered
+	DiscountCheapestItemFree DiscountRuleType = "cheapest_item_free"
+)
+
+// DiscountRule is embedded into Coupon and describes how the coupon affects the order price
+type DiscountRule struct {
+	Type     DiscountRuleType `gorm:"column:discount_type;not null;default:''" json:"type"`
+	Value    float64          `gorm:"column:discount_value;not null;default:0" json:"value,omitempty"`
+	Category string           `gorm:"column:discount_category;not null;default:''" json:"category,omitempty"`
+}
+
+// builtinDiscountRules are the promotions offered by the store out of the box
+var builtinDiscountRules = map[string]DiscountRule{
+	"HAPPYHOURS": {Type: DiscountPercentage, Value: 18},
+	"BUYGETONE":  {Type: DiscountCheapestItemFree},
+}
+
+// Validate checks that the rule is well formed
+func (r DiscountRule) Validate() error {
+	switch r.Type {
+	case DiscountNone, DiscountCheapestItemFree:
+		return nil
+	case DiscountPercentage:
+		if r.Value <= 0 || r.Value > 100 {
+			return fmt.Errorf("percentage discount must be within (0, 100], got %v", r.Value)
+		}
+		return nil
+	case DiscountFixedAmount:
+		if r.Value <= 0 {
+			return fmt.Errorf("fixed discount must be greater than zero, got %v", r.Value)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown discount rule type: %q", r.Type)
+	}
+}
+
+// Evaluate returns the discount amount the rule grants on the given order lines.
+// The amount never exceeds the subtotal of the lines the rule applies to.
+func (r DiscountRule) Evaluate(lines []PricedLine) float64 {
+	var (
+		scopeTotal float64
+		units      int
+		cheapest   *PricedLine
+	)
+	for i := range lines {
+		line := &lines[i]
+		if r.Category != "" && !strings.EqualFold(line.Product.Category, r.Category) {
+			continue
+		}
+		scopeTotal += line.Amount
+		units += line.Quantity
+		if cheapest == nil || line.Product.Price < cheapest.Product.Price {
+			cheapest = line
+		}
+	}
+	if scopeTotal <= 0 {
+		return 0
+	}
+
+	var discount float64
+	switch r.Type {
+	case DiscountPercentage:
+		discount = scopeTotal * r.Value / 100
+	case DiscountFixedAmount:
+		discount = r.Value
+	case DiscountCheapestItemFree:
+		if units >= 2 {
+			discount = cheapest.Product.Price
+		}
+	}
+	if discount > scopeTotal {
+		discount = scopeTotal
+	}
+	return roundAmount(discount)
+}
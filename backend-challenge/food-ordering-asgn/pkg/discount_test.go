@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscountRuleEvaluate(t *testing.T) {
+	pizza := Product{ID: 1, Name: "Margherita Pizza", Price: 12.99, Category: "Pizza"}
+	bread := Product{ID: 2, Name: "Garlic Bread", Price: 4.99, Category: "Sides"}
+	cake := Product{ID: 3, Name: "Chocolate Cake", Price: 6.99, Category: "Dessert"}
+
+	line := func(product Product, quantity int) PricedLine {
+		return PricedLine{Product: product, Quantity: quantity, Amount: roundAmount(product.Price * float64(quantity))}
+	}
+
+	tests := []struct {
+		name     string
+		rule     DiscountRule
+		lines    []PricedLine
+		expected float64
+	}{
+		{
+			name:     "no rule",
+			rule:     DiscountRule{},
+			lines:    []PricedLine{line(pizza, 2)},
+			expected: 0,
+		},
+		{
+			name:     "happy hours takes 18 percent off the order",
+			rule:     builtinDiscountRules["HAPPYHOURS"],
+			lines:    []PricedLine{line(pizza, 2), line(bread, 1)},
+			expected: 5.57,
+		},
+		{
+			name:     "buy get one gives the cheapest item for free",
+			rule:     builtinDiscountRules["BUYGETONE"],
+			lines:    []PricedLine{line(pizza, 1), line(cake, 1), line(bread, 1)},
+			expected: 4.99,
+		},
+		{
+			name:     "buy get one with two units of the same item",
+			rule:     builtinDiscountRules["BUYGETONE"],
+			lines:    []PricedLine{line(pizza, 2)},
+			expected: 12.99,
+		},
+		{
+			name:     "buy get one needs at least two units",
+			rule:     builtinDiscountRules["BUYGETONE"],
+			lines:    []PricedLine{line(pizza, 1)},
+			expected: 0,
+		},
+		{
+			name:     "fixed amount off",
+			rule:     DiscountRule{Type: DiscountFixedAmount, Value: 5},
+			lines:    []PricedLine{line(pizza, 1)},
+			expected: 5,
+		},
+		{
+			name:     "fixed amount is capped at the order subtotal",
+			rule:     DiscountRule{Type: DiscountFixedAmount, Value: 50},
+			lines:    []PricedLine{line(bread, 2)},
+			expected: 9.98,
+		},
+		{
+			name:     "category scoped percentage only discounts matching lines",
+			rule:     DiscountRule{Type: DiscountPercentage, Value: 50, Category: "pizza"},
+			lines:    []PricedLine{line(pizza, 2), line(bread, 1)},
+			expected: 12.99,
+		},
+		{
+			name:     "category scoped cheapest item ignores other categories",
+			rule:     DiscountRule{Type: DiscountCheapestItemFree, Category: "Pizza"},
+			lines:    []PricedLine{line(pizza, 2), line(bread, 1)},
+			expected: 12.99,
+		},
+		{
+			name:     "category scoped rule without matching lines",
+			rule:     DiscountRule{Type: DiscountFixedAmount, Value: 3, Category: "Salad"},
+			lines:    []PricedLine{line(pizza, 1)},
+			expected: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.rule.Evaluate(tc.lines))
+		})
+	}
+}
+
+func TestDiscountRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    DiscountRule
+		wantErr bool
+	}{
+		{name: "no rule", rule: DiscountRule{}},
+		{name: "percentage", rule: DiscountRule{Type: DiscountPercentage, Value: 18}},
+		{name: "percentage above hundred", rule: DiscountRule{Type: DiscountPercentage, Value: 120}, wantErr: true},
+		{name: "zero fixed amount", rule: DiscountRule{Type: DiscountFixedAmount}, wantErr: true},
+		{name: "cheapest item free", rule: DiscountRule{Type: DiscountCheapestItemFree}},
+		{name: "unknown type", rule: DiscountRule{Type: "half_price"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rule.Validate()
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
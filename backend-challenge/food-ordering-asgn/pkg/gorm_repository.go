@@ -0,0 +1,536 @@
+package pkg
+
+// gorm_repository.go implements the repositories on top of gorm
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+type gormProductRepository struct {
+	db *gorm.DB
+}
+
+type gormOrderRepository struct {
+	db *gorm.DB
+}
+
+type gormCouponRepository struct {
+	db *gorm.DB
+}
+
+type gormIdempotencyRepository struct {
+	db *gorm.DB
+}
+
+type gormAPIKeyRepository struct {
+	db *gorm.DB
+}
+
+// NewGormRepositories creates repositories storing their records in the database
+func NewGormRepositories(db *gorm.DB) Repositories {
+	return Repositories{
+		Products:    &gormProductRepository{db: db},
+		Orders:      &gormOrderRepository{db: db},
+		Coupons:     &gormCouponRepository{db: db},
+		APIKeys:     &gormAPIKeyRepository{db: db},
+		Idempotency: &gormIdempotencyRepository{db: db},
+	}
+}
+
+func (r *gormProductRepository) ListProducts() ([]Product, error) {
+	var products []Product
+	if err := r.db.Find(&products).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to fetch products")
+	}
+	return products, nil
+}
+
+func (r *gormProductRepository) GetProduct(id uint) (*Product, error) {
+	var product Product
+	if err := r.db.First(&product, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, utils.WrapError(err, "failed to fetch product")
+	}
+	return &product, nil
+}
+
+func (r *gormProductRepository) FindProducts(ids []uint) ([]Product, error) {
+	var products []Product
+	if err := r.db.Where("id IN ?", ids).Find(&products).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to fetch products")
+	}
+	return products, nil
+}
+
+// preloadOrders loads the lines and status history along with the orders
+func preloadOrders(db *gorm.DB) *gorm.DB {
+	byID := func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}
+	return db.Preload("Items", byID).Preload("StatusHistory", byID)
+}
+
+func (r *gormOrderRepository) GetOrder(publicID string) (*Order, error) {
+	var order Order
+	if err := preloadOrders(r.db).Where("public_id = ?", publicID).First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, utils.WrapError(err, "failed to fetch order")
+	}
+	return &order, nil
+}
+
+// FindOrders seeks to the page with the cursor. Timestamps are compared with julianday,
+// as they are stored as text with the offset of the timezone they were created in.
+// The order of the cursor is looked up by its public id: the page is empty when it
+// doesn't exist.
+func (r *gormOrderRepository) FindOrders(query OrderQuery) (OrderPage, error) {
+	filter := func(db *gorm.DB) *gorm.DB {
+		db = db.Model(&Order{})
+		if query.From != nil {
+			db = db.Where("julianday(created_at) >= julianday(?)", query.From.UTC())
+		}
+		if query.To != nil {
+			db = db.Where("julianday(created_at) < julianday(?)", query.To.UTC())
+		}
+		if len(query.Statuses) > 0 {
+			db = db.Where("status IN ?", query.Statuses)
+		}
+		if len(query.ProductIDs) > 0 {
+			db = db.Where("EXISTS (SELECT 1 FROM order_lines WHERE order_lines.order_id = orders.id AND order_lines.product_id IN ?)", query.ProductIDs)
+		}
+		return db
+	}
+
+	var page OrderPage
+	if err := filter(r.db).Count(&page.Total).Error; err != nil {
+		return OrderPage{}, utils.WrapError(err, "failed to count orders")
+	}
+
+	direction, seek := "ASC", ">"
+	if query.Sort.Descending() {
+		direction, seek = "DESC", "<"
+	}
+	find := filter(r.db).Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	})
+	if query.After != nil {
+		var cursorOrderIDs []uint
+		err := r.db.Model(&Order{}).Where("public_id = ?", query.After.ID).Limit(1).Pluck("id", &cursorOrderIDs).Error
+		if err != nil {
+			return OrderPage{}, utils.WrapError(err, "failed to fetch cursor order")
+		}
+		if len(cursorOrderIDs) == 0 {
+			return page, nil
+		}
+		cursorOrderID := cursorOrderIDs[0]
+		if query.Sort.byTotal() {
+			find = find.Where("total "+seek+" ? OR (total = ? AND id "+seek+" ?)", query.After.Total, query.After.Total, cursorOrderID)
+		} else {
+			find = find.Where("id "+seek+" ?", cursorOrderID)
+		}
+	}
+	if query.Sort.byTotal() {
+		find = find.Order("total " + direction)
+	}
+	find = find.Order("id " + direction)
+	if query.Limit > 0 {
+		find = find.Limit(query.Limit + 1)
+	}
+	if err := find.Find(&page.Orders).Error; err != nil {
+		return OrderPage{}, utils.WrapError(err, "failed to fetch orders")
+	}
+	if query.Limit > 0 && len(page.Orders) > query.Limit {
+		page.Orders, page.More = page.Orders[:query.Limit], true
+	}
+	return page, nil
+}
+
+// CreateOrder stores the order with its lines in a transaction, which is retried as
+// a whole when it fails because the database is busy
+func (r *gormOrderRepository) CreateOrder(order *Order, redemption *CouponRedemption, limits CouponLimits) error {
+	placed := *order
+	if placed.CreatedAt.IsZero() {
+		placed.CreatedAt = time.Now()
+	}
+	if placed.PublicID == "" {
+		placed.PublicID = newOrderID(placed.CreatedAt)
+	}
+	return retryOnBusy(func() error {
+		*order = placed
+		order.Items = make([]OrderLine, 0, len(placed.Items))
+		for _, line := range placed.Items {
+			line.ID, line.OrderID, line.Product = 0, 0, nil
+			order.Items = append(order.Items, line)
+		}
+		order.StatusHistory = make([]OrderStatusChange, 0, len(placed.StatusHistory))
+		for _, change := range placed.StatusHistory {
+			change.ID, change.OrderID = 0, 0
+			order.StatusHistory = append(order.StatusHistory, change)
+		}
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(order).Error; err != nil {
+				return err
+			}
+
+			// The redemption is only recorded together with the order
+			if redemption == nil {
+				return nil
+			}
+			err := checkRedemption(limits, redemption, func(code, customer string) (int64, error) {
+				return countCouponRedemptions(tx, code, customer)
+			})
+			if err != nil {
+				return err
+			}
+			redemption.ID, redemption.OrderID = 0, order.ID
+			if err := tx.Create(redemption).Error; err != nil {
+				return utils.WrapError(err, "failed to record coupon redemption")
+			}
+			return nil
+		})
+	})
+}
+
+// UpdateOrderStatus changes the status in a transaction. The update is conditional on
+// the status the transition was checked against, so concurrent changes can't both apply.
+// A rejected order releases its coupon redemption in the same transaction.
+func (r *gormOrderRepository) UpdateOrderStatus(publicID string, change *OrderStatusChange) (*Order, error) {
+	requested := *change
+	err := retryOnBusy(func() error {
+		*change = requested
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var order Order
+			if err := tx.Where("public_id = ?", publicID).First(&order).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrNotFound
+				}
+				return utils.WrapError(err, "failed to fetch order")
+			}
+			if err := checkTransition(order.Status, change); err != nil {
+				return err
+			}
+			result := tx.Model(&Order{}).Where("id = ? AND status = ?", order.ID, order.Status).Update("status", change.To)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return &OrderTransitionError{From: order.Status, To: change.To}
+			}
+			change.OrderID = order.ID
+			if err := tx.Create(change).Error; err != nil {
+				return err
+			}
+			if change.To != OrderRejected {
+				return nil
+			}
+			if err := tx.Where("order_id = ?", order.ID).Delete(&CouponRedemption{}).Error; err != nil {
+				return utils.WrapError(err, "failed to release coupon redemption")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetOrder(publicID)
+}
+
+// RefundOrder touches the order before reading it, which takes the write lock of the
+// database, so concurrent refunds of an order are applied one after the other
+func (r *gormOrderRepository) RefundOrder(publicID string, refund *Refund) (*Order, error) {
+	requested := *refund
+	err := retryOnBusy(func() error {
+		*refund = requested
+		refund.Lines = slices.Clone(requested.Lines)
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&Order{}).Where("public_id = ?", publicID).UpdateColumn("updated_at", time.Now())
+			if result.Error != nil {
+				return utils.WrapError(result.Error, "failed to lock order")
+			}
+			if result.RowsAffected == 0 {
+				return ErrNotFound
+			}
+			var order Order
+			err := tx.Preload("Items", func(db *gorm.DB) *gorm.DB {
+				return db.Order("id")
+			}).Where("public_id = ?", publicID).First(&order).Error
+			if err != nil {
+				return utils.WrapError(err, "failed to fetch order")
+			}
+			status := order.Status
+			if err := applyRefund(&order, refund); err != nil {
+				return err
+			}
+
+			refund.OrderID = order.ID
+			if err := tx.Create(refund).Error; err != nil {
+				return utils.WrapError(err, "failed to record refund")
+			}
+			for _, line := range refund.Lines {
+				err := tx.Model(&OrderLine{}).Where("id = ?", line.OrderLineID).
+					UpdateColumn("refunded_quantity", gorm.Expr("refunded_quantity + ?", line.Quantity)).Error
+				if err != nil {
+					return utils.WrapError(err, "failed to refund order line")
+				}
+			}
+			err = tx.Model(&Order{}).Where("id = ?", order.ID).
+				Updates(map[string]any{"refunded": order.Refunded, "status": order.Status}).Error
+			if err != nil {
+				return utils.WrapError(err, "failed to refund order")
+			}
+			if !refund.Full {
+				return nil
+			}
+
+			change := refund.cancellation(status)
+			change.OrderID = order.ID
+			if err := tx.Create(&change).Error; err != nil {
+				return utils.WrapError(err, "failed to record order cancellation")
+			}
+			if err := tx.Where("order_id = ?", order.ID).Delete(&CouponRedemption{}).Error; err != nil {
+				return utils.WrapError(err, "failed to release coupon redemption")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetOrder(publicID)
+}
+
+func (r *gormOrderRepository) ListRefunds(publicID string) ([]Refund, error) {
+	var order Order
+	if err := r.db.Select("id").Where("public_id = ?", publicID).First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, utils.WrapError(err, "failed to fetch order")
+	}
+	refunds := []Refund{}
+	err := r.db.Preload("Lines", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where("order_id = ?", order.ID).Order("id").Find(&refunds).Error
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to fetch refunds")
+	}
+	return refunds, nil
+}
+
+func (r *gormCouponRepository) GetCoupon(code string) (*Coupon, error) {
+	var coupons []Coupon
+	if err := r.db.Where("code = ?", code).Limit(1).Find(&coupons).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to fetch coupon")
+	}
+	if len(coupons) == 0 {
+		return nil, ErrNotFound
+	}
+	return &coupons[0], nil
+}
+
+func (r *gormCouponRepository) UpdateCoupon(code string, update func(*Coupon)) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		coupon := Coupon{Code: code}
+		if err := tx.Where("code = ?", code).Limit(1).Find(&coupon).Error; err != nil {
+			return utils.WrapError(err, "failed to fetch coupon")
+		}
+		update(&coupon)
+		if err := tx.Omit("SourceFile").Save(&coupon).Error; err != nil {
+			return utils.WrapError(err, "failed to save coupon")
+		}
+		return nil
+	})
+}
+
+func (r *gormCouponRepository) CountRedemptions(code, customer string) (int64, error) {
+	return countCouponRedemptions(r.db, code, customer)
+}
+
+func (r *gormCouponRepository) MoveRedemptions(from, to string) (int64, error) {
+	result := r.db.Model(&CouponRedemption{}).Where("customer = ?", from).Update("customer", to)
+	if result.Error != nil {
+		return 0, utils.WrapError(result.Error, "failed to move coupon redemptions")
+	}
+	return result.RowsAffected, nil
+}
+
+func countCouponRedemptions(db *gorm.DB, code, customer string) (int64, error) {
+	query := db.Model(&CouponRedemption{}).Where("code = ?", code)
+	if customer != "" {
+		query = query.Where("customer = ?", customer)
+	}
+	var uses int64
+	if err := query.Count(&uses).Error; err != nil {
+		return 0, utils.WrapError(err, "failed to count coupon redemptions")
+	}
+	return uses, nil
+}
+
+func (r *gormCouponRepository) ListSources() ([]CouponSource, error) {
+	var sources []CouponSource
+	if err := r.db.Order("source").Find(&sources).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to fetch coupon sources")
+	}
+	return sources, nil
+}
+
+func (r *gormCouponRepository) FindSources(names []string) ([]CouponSource, error) {
+	var sources []CouponSource
+	if err := r.db.Where("source IN ?", names).Find(&sources).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to fetch coupon sources")
+	}
+	return sources, nil
+}
+
+func (r *gormCouponRepository) SyncSources(names []string) error {
+	for _, name := range names {
+		source := &CouponSource{
+			Source: name,
+		}
+		if err := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(source).Error; err != nil {
+			return utils.WrapError(err, "failed to create couponSource record")
+		}
+	}
+
+	var stale []CouponSource
+	query := r.db.Model(&CouponSource{})
+	if len(names) > 0 {
+		query = query.Where("source NOT IN ?", names)
+	}
+	if err := query.Find(&stale).Error; err != nil {
+		return utils.WrapError(err, "failed to fetch stale couponSource records")
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		ids := make([]uint, 0, len(stale))
+		for _, source := range stale {
+			ids = append(ids, source.ID)
+		}
+		// SQLite only enforces the cascade with foreign keys enabled, so the
+		// coupon_sources join rows are removed explicitly
+		if err := tx.Exec("DELETE FROM coupon_sources WHERE coupon_source_id IN ?", ids).Error; err != nil {
+			return utils.WrapError(err, "failed to remove stale coupon_sources records")
+		}
+		if err := tx.Delete(&CouponSource{}, ids).Error; err != nil {
+			return utils.WrapError(err, "failed to remove stale couponSource records")
+		}
+		return nil
+	})
+}
+
+func (r *gormIdempotencyRepository) GetIdempotencyRecord(customer, key string) (*IdempotencyRecord, error) {
+	var records []IdempotencyRecord
+	err := r.db.Where("idempotency_key = ? AND customer = ?", key, customer).Limit(1).Find(&records).Error
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to fetch idempotency record")
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return &records[0], nil
+}
+
+func (r *gormIdempotencyRepository) SaveIdempotencyRecord(record *IdempotencyRecord, now time.Time) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at <= ?", now).Delete(&IdempotencyRecord{}).Error; err != nil {
+			return utils.WrapError(err, "failed to remove expired idempotency records")
+		}
+		if err := tx.Create(record).Error; err != nil {
+			return utils.WrapError(err, "failed to save idempotency record")
+		}
+		return nil
+	})
+}
+
+func (r *gormAPIKeyRepository) FindAPIKey(keyHash string) (*APIKey, error) {
+	var keys []APIKey
+	err := r.db.Where("key_hash = ? OR previous_key_hash = ?", keyHash, keyHash).Limit(1).Find(&keys).Error
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to fetch API key")
+	}
+	if len(keys) == 0 {
+		return nil, ErrNotFound
+	}
+	return &keys[0], nil
+}
+
+func (r *gormAPIKeyRepository) ListAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	if err := r.db.Order("name").Find(&keys).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to fetch API keys")
+	}
+	return keys, nil
+}
+
+func (r *gormAPIKeyRepository) CreateAPIKey(key *APIKey) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var count int64
+			if err := tx.Model(&APIKey{}).Where("name = ?", key.Name).Count(&count).Error; err != nil {
+				return utils.WrapError(err, "failed to fetch API key")
+			}
+			if count > 0 {
+				return ErrAPIKeyExists
+			}
+			if err := tx.Create(key).Error; err != nil {
+				return utils.WrapError(err, "failed to save API key")
+			}
+			return nil
+		})
+	})
+}
+
+func (r *gormAPIKeyRepository) UpdateAPIKey(name string, update func(*APIKey) error) (*APIKey, error) {
+	var key APIKey
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			key = APIKey{}
+			if err := tx.Where("name = ?", name).First(&key).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrNotFound
+				}
+				return utils.WrapError(err, "failed to fetch API key")
+			}
+			if err := update(&key); err != nil {
+				return err
+			}
+			if err := tx.Save(&key).Error; err != nil {
+				return utils.WrapError(err, "failed to save API key")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *gormAPIKeyRepository) RecordAPIKeyUse(id uint, previous bool, usedAt time.Time) error {
+	updates := map[string]any{"last_used_at": usedAt, "use_count": gorm.Expr("use_count + 1")}
+	if previous {
+		updates["previous_last_used_at"] = usedAt
+	}
+	return retryOnBusy(func() error {
+		err := r.db.Model(&APIKey{}).Where("id = ?", id).UpdateColumns(updates).Error
+		if err != nil {
+			return utils.WrapError(err, "failed to record API key use")
+		}
+		return nil
+	})
+}
@@ -5,28 +5,88 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
 	"time"
 
-	"gorm.io/gorm"
+	"github.com/parvez0/food-ordering-asgn/utils"
 )
 
 type RequestHandler struct {
-	db *gorm.DB
+	products      ProductRepository
+	orders        OrderRepository
+	coupons       CouponRepository
+	apiKeys       APIKeyRepository
+	idempotency   IdempotencyRepository
+	couponIndex   CouponIndexProvider
+	couponPolicy  CouponPolicy
+	couponSources CouponSourceManager
+	adminToken    string
+	orderLimits   OrderLimits
+	// idempotencyLocks serializes the requests sharing an Idempotency-Key
+	idempotencyLocks keyedMutex
+	idempotencyTTL   time.Duration
+	clock            func() time.Time
+	location         *time.Location
 }
 
-func NewRequestHandler(db *gorm.DB) *RequestHandler {
-	return &RequestHandler{db: db}
+// WithCouponIndex sets the index used to validate coupon codes, either a
+// *CouponIndex or a *CouponIndexWatcher keeping it up to date
+func WithCouponIndex(index CouponIndexProvider) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		h.couponIndex = index
+	}
 }
 
-func authorisationMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// if key := r.Header.Get("Authorization"); key != "apitest" {
-		// 	w.WriteHeader(http.StatusUnauthorized)
-		// 	w.Write([]byte("Unauthorized"))
-		// 	return
-		// }
-		next.ServeHTTP(w, r)
-	})
+// WithCouponPolicy sets the policy deciding which coupon codes are valid
+func WithCouponPolicy(policy CouponPolicy) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		h.couponPolicy = policy
+	}
+}
+
+// WithOrderLimits sets the largest quantities accepted per product and per order
+func WithOrderLimits(limits OrderLimits) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		h.orderLimits = limits
+	}
+}
+
+// WithClock sets the clock coupons are redeemed against, so schedules can be tested
+func WithClock(clock func() time.Time) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		if clock != nil {
+			h.clock = clock
+		}
+	}
+}
+
+// WithStoreLocation sets the timezone coupon schedules are evaluated in
+func WithStoreLocation(location *time.Location) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		if location != nil {
+			h.location = location
+		}
+	}
+}
+
+func NewRequestHandler(repos Repositories, opts ...func(*RequestHandler)) *RequestHandler {
+	handler := &RequestHandler{
+		products:       repos.Products,
+		orders:         repos.Orders,
+		coupons:        repos.Coupons,
+		apiKeys:        repos.APIKeys,
+		idempotency:    repos.Idempotency,
+		couponPolicy:   DefaultCouponPolicy(),
+		orderLimits:    DefaultOrderLimits(),
+		idempotencyTTL: defaultIdempotencyKeyTTL,
+		clock:          time.Now,
+		location:       time.UTC,
+	}
+	for _, opt := range opts {
+		opt(handler)
+	}
+	return handler
 }
 
 func urlLoggingMiddleware(next http.Handler) http.Handler {
@@ -41,14 +101,29 @@ func (h *RequestHandler) ServeHTTP() http.Handler {
 	mux := http.NewServeMux()
 
 	// Apply middleware chain
-	handler := urlLoggingMiddleware(authorisationMiddleware(mux))
+	handler := urlLoggingMiddleware(mux)
 
 	// Register routes
 	mux.HandleFunc("GET /health", h.HealthCheckHandler)
 	mux.HandleFunc("GET /products", h.GetProductsHandler)
-	mux.HandleFunc("GET /orders", h.GetOrdersHandler)
+	mux.HandleFunc("GET /orders", h.requireScope(ScopeReadOrders, h.GetOrdersHandler))
 	mux.HandleFunc("GET /product/{productId}", h.GetProductByIDHandler)
-	mux.HandleFunc("POST /order", h.CreateOrderHandler)
+	mux.HandleFunc("GET /order/{orderId}", h.requireScope(ScopeReadOrders, h.GetOrderByIDHandler))
+	mux.HandleFunc("POST /order", h.requireScope(ScopeCreateOrder, h.idempotencyMiddleware(h.CreateOrderHandler)))
+	mux.HandleFunc("GET /coupon/{code}", h.GetCouponHandler)
+	mux.Handle("PATCH /order/{orderId}/status", h.adminAuthMiddleware(h.UpdateOrderStatusHandler))
+	mux.Handle("POST /order/{orderId}/cancel", h.adminAuthMiddleware(h.idempotencyMiddleware(h.CancelOrderHandler)))
+	mux.HandleFunc("GET /order/{orderId}/refunds", h.requireScope(ScopeReadOrders, h.GetOrderRefundsHandler))
+
+	// Admin routes
+	mux.Handle("GET /admin/coupon-sources", h.adminAuthMiddleware(h.couponSourcesMiddleware(h.ListCouponSourcesHandler)))
+	mux.Handle("POST /admin/coupon-sources/{name}", h.adminAuthMiddleware(h.couponSourcesMiddleware(h.UploadCouponSourceHandler)))
+	mux.Handle("DELETE /admin/coupon-sources/{name}", h.adminAuthMiddleware(h.couponSourcesMiddleware(h.DeleteCouponSourceHandler)))
+	mux.Handle("GET /admin/api-keys", h.adminAuthMiddleware(h.ListAPIKeysHandler))
+	mux.Handle("POST /admin/api-keys", h.adminAuthMiddleware(h.CreateAPIKeyHandler))
+	mux.Handle("POST /admin/api-keys/{name}/rotate", h.adminAuthMiddleware(h.RotateAPIKeyHandler))
+	mux.Handle("POST /admin/api-keys/{name}/revoke", h.adminAuthMiddleware(h.RevokeAPIKeyHandler))
+	mux.Handle("PUT /admin/api-keys/{name}/expiry", h.adminAuthMiddleware(h.SetAPIKeyExpiryHandler))
 
 	return handler
 }
@@ -59,8 +134,8 @@ func (h *RequestHandler) HealthCheckHandler(w http.ResponseWriter, r *http.Reque
 }
 
 func (h *RequestHandler) GetProductsHandler(w http.ResponseWriter, r *http.Request) {
-	var products []Product
-	if err := h.db.Find(&products).Error; err != nil {
+	products, err := h.products.ListProducts()
+	if err != nil {
 		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
 		return
 	}
@@ -70,29 +145,71 @@ func (h *RequestHandler) GetProductsHandler(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(products)
 }
 
+// GetOrdersHandler lists a page of orders, newest first unless sorted otherwise.
+// The number of matching orders is sent in X-Total-Count, and X-Next-Cursor holds
+// the cursor of the next page when there is one.
 func (h *RequestHandler) GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	var placedOrders []Order
-	if err := h.db.Preload("Items").Preload("Products").Find(&placedOrders).Error; err != nil {
-		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+	query, err := parseOrderQuery(r.URL.Query(), h.location)
+	if err != nil {
+		writeValidationError(w, "Invalid order query", err)
 		return
 	}
 
+	page, err := h.orders.FindOrders(query)
+	if err != nil {
+		logger.Error("Failed to fetch orders:", err)
+		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
+	placedOrders := page.Orders
+	if placedOrders == nil {
+		placedOrders = []Order{}
+	}
+
+	w.Header().Set(totalCountHeader, strconv.FormatInt(page.Total, 10))
+	if page.More {
+		w.Header().Set(nextCursorHeader, encodeOrderCursor(query.cursorAfter(&placedOrders[len(placedOrders)-1])))
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(placedOrders)
 }
 
+// GetOrderByIDHandler returns an order along with its status history
+func (h *RequestHandler) GetOrderByIDHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseOrderID(r.PathValue("orderId"))
+	if !ok {
+		http.Error(w, "Invalid ID supplied", http.StatusBadRequest)
+		return
+	}
+
+	order, err := h.orders.GetOrder(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, fmt.Sprintf("No order found with id: %s", id), http.StatusNotFound)
+			return
+		}
+		logger.Error("Failed to fetch order:", err)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
 func (h *RequestHandler) GetProductByIDHandler(w http.ResponseWriter, r *http.Request) {
 	productId := r.PathValue("productId")
-	if productId == "" {
+	id, err := strconv.ParseUint(productId, 10, 0)
+	if err != nil {
 		http.Error(w, "Invalid ID supplied", http.StatusBadRequest)
 		return
 	}
 
-	var product Product
-	result := h.db.First(&product, productId)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+	product, err := h.products.GetProduct(uint(id))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
 			http.Error(w, fmt.Sprintf("No product found with id: %s", productId), http.StatusNotFound)
 			return
 		}
@@ -113,92 +230,352 @@ func (h *RequestHandler) CreateOrderHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if orderReq.CouponCode != "" && !h.isCouponValid(orderReq.CouponCode) {
-		http.Error(w, "Validation exception", http.StatusUnprocessableEntity)
-		return
+	var (
+		coupon       *Coupon
+		discountRule DiscountRule
+	)
+	if orderReq.CouponCode != "" {
+		var reason CouponRejection
+		var ok bool
+		coupon, reason, ok = h.isCouponValid(orderReq.CouponCode)
+		if !ok {
+			http.Error(w, couponValidationMessage(reason), http.StatusUnprocessableEntity)
+			return
+		}
+		discountRule = coupon.DiscountRule
 	}
 
-	if len(orderReq.Items) == 0 {
-		http.Error(w, "Order must contain at least one item", http.StatusBadRequest)
+	// Merge the items of the same product and check the requested quantities
+	lines, err := normalizeOrderItems(orderReq.Items, h.orderLimits)
+	if err != nil {
+		writeOrderValidationError(w, err)
 		return
 	}
-
-	// Get product IDs from request
-	var productIDs []string
-	for _, item := range orderReq.Items {
-		if item.Quantity <= 0 {
-			http.Error(w, "Quantity must be greater than zero", http.StatusBadRequest)
-			return
-		}
-		productIDs = append(productIDs, item.ProductID)
+	productIDs := make([]uint, 0, len(lines))
+	for _, line := range lines {
+		productIDs = append(productIDs, line.ProductID)
 	}
 
-	var products []Product
-	if err := h.db.Where("id IN ?", productIDs).Find(&products).Error; err != nil {
+	products, err := h.products.FindProducts(productIDs)
+	if err != nil {
 		logger.Error("Failed to fetch products:", err)
 		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
 		return
 	}
 
 	if len(products) != len(productIDs) {
-		http.Error(w, "One or more products not found", http.StatusBadRequest)
+		missing := &OrderValidationError{}
+		for _, line := range lines {
+			if !slices.ContainsFunc(products, func(product Product) bool { return product.ID == line.ProductID }) {
+				missing.add(fmt.Sprintf("items[%d].productId", line.Index), "product %d not found", line.ProductID)
+			}
+		}
+		writeOrderValidationError(w, missing)
 		return
 	}
 
-	var order Order
-	// Creating order in trasaction to avoid inconsistent state 
-	// and rollback on failed order items.
-	err := h.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Create(&order).Error; err != nil {
-			return err
+	pricing, err := priceOrder(lines, products)
+	if err != nil {
+		logger.Error("Failed to price order:", err)
+		http.Error(w, "One or more products not found", http.StatusBadRequest)
+		return
+	}
+	pricing.applyDiscount(discountRule)
+
+	placedAt := h.now()
+	order := Order{
+		Total:     pricing.Total,
+		Discounts: pricing.Discounts,
+		Status:    OrderPlaced,
+		StatusHistory: []OrderStatusChange{{
+			To:        OrderPlaced,
+			Actor:     orderPlacedBy,
+			CreatedAt: placedAt,
+		}},
+		CreatedAt: placedAt,
+	}
+	for _, line := range pricing.Lines {
+		order.Items = append(order.Items, OrderLine{
+			ProductID: line.Product.ID,
+			Name:      line.Product.Name,
+			UnitPrice: line.Product.Price,
+			Quantity:  line.Quantity,
+		})
+	}
+	// The redemption is stored together with the order, which also checks the usage
+	// limits of the coupon once more
+	var (
+		redemption *CouponRedemption
+		limits     CouponLimits
+	)
+	if coupon != nil {
+		limits = coupon.Limits
+		redemption = &CouponRedemption{
+			Code:     coupon.Code,
+			Customer: customerKey(r),
 		}
+	}
+	err = h.orders.CreateOrder(&order, redemption, limits)
 
-		for _, item := range orderReq.Items {
-			orderItem := OrderItem{
-				ProductID: item.ProductID,
-				Quantity:  item.Quantity,
-			}
-			if err := tx.Create(&orderItem).Error; err != nil {
-				return err
-			}
-		}
+	var rejected *CouponRejectedError
+	if errors.As(err, &rejected) {
+		logger.Info("Coupon code rejected:", orderReq.CouponCode, " reason: ", rejected.Reason)
+		http.Error(w, couponValidationMessage(rejected.Reason), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to create order:", err)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
 
-		if err := tx.Model(&order).Association("Items").Append(&orderReq.Items); err != nil {
-			return err
-		}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
 
-		if err := tx.Model(&order).Association("Products").Append(&products); err != nil {
-			return err
-		}
+// UpdateOrderStatusHandler moves an order through its lifecycle
+func (h *RequestHandler) UpdateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseOrderID(r.PathValue("orderId"))
+	if !ok {
+		http.Error(w, "Invalid ID supplied", http.StatusBadRequest)
+		return
+	}
 
-		return nil
-	})
+	var req OrderStatusReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("Failed to parse order status request body:", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateStatusChange(req); err != nil {
+		writeOrderValidationError(w, err)
+		return
+	}
 
-	if err != nil {
-		logger.Error("Failed to create order:", err)
-		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+	change := &OrderStatusChange{
+		To:        req.Status,
+		Actor:     req.Actor,
+		Reason:    req.Reason,
+		CreatedAt: h.now(),
+	}
+	order, err := h.orders.UpdateOrderStatus(id, change)
+	var transition *OrderTransitionError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, fmt.Sprintf("No order found with id: %s", id), http.StatusNotFound)
+		return
+	case errors.As(err, &transition):
+		http.Error(w, fmt.Sprintf("Order can't move from %s to %s", transition.From, transition.To), http.StatusConflict)
+		return
+	case err != nil:
+		logger.Error("Failed to update order status:", err)
+		http.Error(w, "Failed to update order status", http.StatusInternalServerError)
 		return
 	}
+	logger.Infof("Order %s moved from %s to %s by %s", order.PublicID, change.From, change.To, change.Actor)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(order)
 }
 
-func (h *RequestHandler) isCouponValid(code string) bool {
-	var coupon Coupon
-	result := h.db.Preload("SourceFile").Where("code = ?", code).First(&coupon)
-	if result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
-			logger.Info("Coupon not found:", code)
-			return false
+// CancelOrderHandler cancels the requested items of an order, or the whole order, and
+// refunds them
+func (h *RequestHandler) CancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseOrderID(r.PathValue("orderId"))
+	if !ok {
+		http.Error(w, "Invalid ID supplied", http.StatusBadRequest)
+		return
+	}
+
+	var req CancelOrderReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("Failed to parse cancellation request body:", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	refund, err := newRefund(req, h.now())
+	if err != nil {
+		writeValidationError(w, "Invalid cancellation", err)
+		return
+	}
+
+	order, err := h.orders.RefundOrder(id, refund)
+	var (
+		transition *OrderTransitionError
+		invalid    *OrderValidationError
+	)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, fmt.Sprintf("No order found with id: %s", id), http.StatusNotFound)
+		return
+	case errors.As(err, &transition):
+		http.Error(w, fmt.Sprintf("Order can't be cancelled once %s", transition.From), http.StatusConflict)
+		return
+	case errors.As(err, &invalid):
+		writeValidationError(w, "Invalid cancellation", err)
+		return
+	case err != nil:
+		logger.Error("Failed to cancel order:", err)
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("Refunded %.2f of order %s for %s by %s", refund.Amount, order.PublicID, refund.Reason, refund.Actor)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Order  *Order  `json:"order"`
+		Refund *Refund `json:"refund"`
+	}{Order: order, Refund: refund})
+}
+
+// GetOrderRefundsHandler lists the refunds of an order, oldest first
+func (h *RequestHandler) GetOrderRefundsHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseOrderID(r.PathValue("orderId"))
+	if !ok {
+		http.Error(w, "Invalid ID supplied", http.StatusBadRequest)
+		return
+	}
+
+	refunds, err := h.orders.ListRefunds(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, fmt.Sprintf("No order found with id: %s", id), http.StatusNotFound)
+			return
 		}
-		logger.Error("Failed to verify coupon:", result.Error)
-		return false
+		logger.Error("Failed to fetch refunds:", err)
+		http.Error(w, "Failed to fetch refunds", http.StatusInternalServerError)
+		return
 	}
-	if len(coupon.SourceFile) < 2 {
-		logger.Info("Invalid coupon code provided:", code)
-		return false
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(refunds)
+}
+
+// writeOrderValidationError reports the rejected fields of an order request
+func writeOrderValidationError(w http.ResponseWriter, err error) {
+	writeValidationError(w, "Invalid order", err)
+}
+
+// writeValidationError reports the rejected fields of a request under the message
+func writeValidationError(w http.ResponseWriter, message string, err error) {
+	var invalid *OrderValidationError
+	if !errors.As(err, &invalid) {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Message string       `json:"message"`
+		Errors  []FieldError `json:"errors"`
+	}{Message: message, Errors: invalid.Errors})
+}
+
+// checkCoupon validates the code and explains the outcome.
+// The coupon is only returned for valid codes.
+func (h *RequestHandler) checkCoupon(code string) (CouponCheck, *Coupon, error) {
+	check := CouponCheck{Code: code, Sources: []string{}}
+	if h.couponIndex == nil {
+		return check, nil, errors.New("coupon index is not configured")
+	}
+
+	var normalized string
+	err := h.couponIndex.WithIndex(func(index *CouponIndex) error {
+		if !index.Tokenizer().IsCode(code) {
+			check.Reason = CouponInvalidFormat
+			return nil
+		}
+		sources, found, err := index.Lookup(code)
+		if err != nil {
+			return err
+		}
+		if !found {
+			check.Reason = CouponNotFound
+			return nil
+		}
+		check.Sources = sources
+		if valid, reason := h.couponPolicy.Evaluate(sources); !valid {
+			check.Reason = reason
+			return nil
+		}
+		normalized = index.Tokenizer().Normalize(code)
+		return nil
+	})
+	if err != nil || check.Reason != "" {
+		return check, nil, err
 	}
-	return true
-}
\ No newline at end of file
+
+	// Coupons are only stored in the database when they carry a discount rule
+	coupon := Coupon{Code: normalized}
+	stored, err := h.coupons.GetCoupon(normalized)
+	switch {
+	case err == nil:
+		coupon = *stored
+	case !errors.Is(err, ErrNotFound):
+		return check, nil, utils.WrapError(err, "failed to fetch coupon")
+	}
+	if reason := coupon.Limits.checkPeriod(h.now()); reason != "" {
+		check.Reason = reason
+		return check, nil, nil
+	}
+	// The per customer limit is checked when the coupon is redeemed
+	reason, err := checkCouponUsage(coupon.Limits, coupon.Code, "", false, h.coupons.CountRedemptions)
+	if err != nil || reason != "" {
+		check.Reason = reason
+		return check, nil, err
+	}
+	coupon.SourceFile, err = h.coupons.FindSources(check.Sources)
+	if err != nil {
+		return check, nil, utils.WrapError(err, "failed to fetch coupon sources")
+	}
+	check.Valid = true
+	if coupon.DiscountRule.Type != DiscountNone {
+		check.Discount = &coupon.DiscountRule
+	}
+	return check, &coupon, nil
+}
+
+// now returns the current time in the store's timezone
+func (h *RequestHandler) now() time.Time {
+	return h.clock().In(h.location)
+}
+
+// isCouponValid reports whether the code is valid and returns the matching coupon
+// so the caller can apply its discount rule, or the reason it was rejected
+func (h *RequestHandler) isCouponValid(code string) (*Coupon, CouponRejection, bool) {
+	check, coupon, err := h.checkCoupon(code)
+	if err != nil {
+		logger.Error("Failed to verify coupon:", err)
+		return nil, "", false
+	}
+	if !check.Valid {
+		logger.Info("Invalid coupon code provided:", code, " reason: ", check.Reason)
+		return nil, check.Reason, false
+	}
+	return coupon, "", true
+}
+
+func couponValidationMessage(reason CouponRejection) string {
+	if reason == "" {
+		return "Validation exception"
+	}
+	return "Validation exception: " + string(reason)
+}
+
+func (h *RequestHandler) GetCouponHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	check, _, err := h.checkCoupon(code)
+	if err != nil {
+		logger.Error("Failed to verify coupon:", err)
+		http.Error(w, "Failed to verify coupon", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(check)
+}
@@ -3,43 +3,116 @@ package pkg
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	suite "github.com/stretchr/testify/suite"
-	gorm "gorm.io/gorm"
 )
 
+// HandlerTestSuite runs the handler tests against the gorm repositories, or the
+// in-memory repositories when inMemory is set
 type HandlerTestSuite struct {
 	suite.Suite
-	server *httptest.Server
-	db     *gorm.DB
+	inMemory    bool
+	server      *httptest.Server
+	repos       Repositories
+	couponIndex *CouponIndex
+	// apiKey is granted the create_order and read_orders scopes
+	apiKey string
 }
 
 func (suite *HandlerTestSuite) SetupSuite() {
 	var err error
-	suite.db, err = NewDB(WithSqliteInMemoryDB())
-	assert.NoError(suite.T(), err)
+	if suite.inMemory {
+		suite.repos, err = NewMemoryRepositories()
+		assert.NoError(suite.T(), err)
+	} else {
+		db, err := NewDB(WithSqliteInMemoryDB())
+		assert.NoError(suite.T(), err)
+		err = SeedDatabase(db)
+		assert.NoError(suite.T(), err)
+		suite.repos = NewGormRepositories(db)
+	}
 
-	err = SeedDatabase(suite.db)
+	// The sources of the data directory along with the codes of the built-in promotions
+	suite.couponIndex, err = NewCouponIndexBuilder().Build(filepath.Join("testdata", "promotions"))
 	assert.NoError(suite.T(), err)
+	err = SyncCouponSources(suite.repos.Coupons, suite.couponIndex)
+	assert.NoError(suite.T(), err)
+
+	suite.apiKey = suite.createAPIKey("orders", ScopeCreateOrder, ScopeReadOrders)
 
-	handler := NewRequestHandler(suite.db)
+	handler := NewRequestHandler(suite.repos, WithCouponIndex(suite.couponIndex))
 
 	suite.server = httptest.NewServer(handler.ServeHTTP())
 }
 
+// createAPIKey registers a key granted the scopes and returns it
+func (suite *HandlerTestSuite) createAPIKey(name string, scopes ...APIScope) string {
+	key := generateAPIKey()
+	err := suite.repos.APIKeys.CreateAPIKey(&APIKey{Name: name, KeyHash: hashAPIKey(key), Scopes: scopes})
+	require.NoError(suite.T(), err)
+	return key
+}
+
+// orderRequest returns a request placing the order, for handlers served with httptest
+func (suite *HandlerTestSuite) orderRequest(jsonData []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/order", bytes.NewBuffer(jsonData))
+	req.Header.Set("api_key", suite.apiKey)
+	return req
+}
+
+// readRequest returns a request reading orders, for handlers served with httptest
+func (suite *HandlerTestSuite) readRequest(target string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("api_key", suite.apiKey)
+	return req
+}
+
+// getOrders reads orders from the suite's server
+func (suite *HandlerTestSuite) getOrders(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, suite.server.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("api_key", suite.apiKey)
+	return http.DefaultClient.Do(req)
+}
+
+// postOrder places the order on the suite's server
+func (suite *HandlerTestSuite) postOrder(jsonData []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, suite.server.URL+"/order", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api_key", suite.apiKey)
+	return http.DefaultClient.Do(req)
+}
+
 func (suite *HandlerTestSuite) TearDownSuite() {
 	suite.server.Close()
+	suite.couponIndex.Close()
 }
 
 func TestHandlerTestSuite(t *testing.T) {
 	suite.Run(t, new(HandlerTestSuite))
 }
 
+func TestHandlerTestSuiteInMemory(t *testing.T) {
+	suite.Run(t, &HandlerTestSuite{inMemory: true})
+}
+
 func (suite *HandlerTestSuite) TestHealthCheck() {
 	resp, err := http.Get(suite.server.URL + "/health")
 	assert.NoError(suite.T(), err)
@@ -110,15 +183,76 @@ func (suite *HandlerTestSuite) TestCreateOrder() {
 	assert.NoError(suite.T(), err)
 
 	// Test creating order
-	resp, err = http.Post(suite.server.URL+"/order", "application/json", bytes.NewBuffer(jsonData))
+	resp, err = suite.postOrder(jsonData)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+
+	var order Order
+	err = json.NewDecoder(resp.Body).Decode(&order)
+	assert.NoError(suite.T(), err)
+	_, valid := parseOrderID(order.PublicID)
+	assert.True(suite.T(), valid, "order id %q", order.PublicID)
+	assert.Equal(suite.T(), []OrderLine{{
+		ProductID: products[0].ID,
+		Name:      products[0].Name,
+		UnitPrice: products[0].Price,
+		Quantity:  2,
+	}}, order.Items)
+	assert.Equal(suite.T(), roundAmount(products[0].Price*2), order.Total)
+	assert.Zero(suite.T(), order.Discounts)
+
+	// The order is listed with the same lines
+	resp, err = suite.getOrders("/orders")
+	assert.NoError(suite.T(), err)
+	var orders []Order
+	err = json.NewDecoder(resp.Body).Decode(&orders)
+	assert.NoError(suite.T(), err)
+	index := slices.IndexFunc(orders, func(placed Order) bool { return placed.PublicID == order.PublicID })
+	if assert.NotEqual(suite.T(), -1, index) {
+		assert.Equal(suite.T(), order.Items, orders[index].Items)
+	}
+}
+
+func (suite *HandlerTestSuite) TestCreateOrderWithCoupon() {
+	resp, err := http.Get(suite.server.URL + "/products")
+	assert.NoError(suite.T(), err)
+	var products []Product
+	err = json.NewDecoder(resp.Body).Decode(&products)
+	assert.NoError(suite.T(), err)
+	assert.Greater(suite.T(), len(products), 0)
+
+	orderReq := OrderReq{
+		CouponCode: "HAPPYHOURS",
+		Items: []OrderItem{
+			{
+				ProductID: fmt.Sprintf("%d", products[0].ID),
+				Quantity:  2,
+			},
+		},
+	}
+
+	jsonData, err := json.Marshal(orderReq)
+	assert.NoError(suite.T(), err)
+
+	resp, err = suite.postOrder(jsonData)
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
 
 	var order Order
 	err = json.NewDecoder(resp.Body).Decode(&order)
 	assert.NoError(suite.T(), err)
-	assert.NotZero(suite.T(), order.ID)
-	assert.Equal(suite.T(), 1, len(order.Items))
+	subtotal := roundAmount(products[0].Price * 2)
+	assert.Equal(suite.T(), roundAmount(subtotal*0.18), order.Discounts)
+	assert.Equal(suite.T(), roundAmount(subtotal-order.Discounts), order.Total)
+
+	// Test with a code that is only present in a single source
+	orderReq.CouponCode = "TENOFF60"
+	jsonData, err = json.Marshal(orderReq)
+	assert.NoError(suite.T(), err)
+
+	resp, err = suite.postOrder(jsonData)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
 }
 
 func (suite *HandlerTestSuite) TestCreateOrderWithInvalidData() {
@@ -130,7 +264,7 @@ func (suite *HandlerTestSuite) TestCreateOrderWithInvalidData() {
 	jsonData, err := json.Marshal(orderReq)
 	assert.NoError(suite.T(), err)
 
-	resp, err := http.Post(suite.server.URL+"/order", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := suite.postOrder(jsonData)
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), http.StatusBadRequest, resp.StatusCode)
 
@@ -147,17 +281,248 @@ func (suite *HandlerTestSuite) TestCreateOrderWithInvalidData() {
 	jsonData, err = json.Marshal(orderReq)
 	assert.NoError(suite.T(), err)
 
-	resp, err = http.Post(suite.server.URL+"/order", "application/json", bytes.NewBuffer(jsonData))
+	resp, err = suite.postOrder(jsonData)
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), http.StatusBadRequest, resp.StatusCode)
 }
 
+func (suite *HandlerTestSuite) TestCreateOrderMergesDuplicateProducts() {
+	jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{
+		{ProductID: "1", Quantity: 1},
+		{ProductID: "3", Quantity: 1},
+		{ProductID: "1", Quantity: 2},
+	}})
+	assert.NoError(suite.T(), err)
+
+	resp, err := suite.postOrder(jsonData)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+
+	var order Order
+	err = json.NewDecoder(resp.Body).Decode(&order)
+	assert.NoError(suite.T(), err)
+	if assert.Len(suite.T(), order.Items, 2) {
+		assert.Equal(suite.T(), uint(1), order.Items[0].ProductID)
+		assert.Equal(suite.T(), 3, order.Items[0].Quantity)
+		assert.Equal(suite.T(), uint(3), order.Items[1].ProductID)
+		assert.Equal(suite.T(), 1, order.Items[1].Quantity)
+	}
+}
+
+func (suite *HandlerTestSuite) TestCreateOrderFieldErrors() {
+	handler := NewRequestHandler(suite.repos, WithOrderLimits(OrderLimits{MaxLineQuantity: 3})).ServeHTTP()
+	order := func(items ...OrderItem) (int, []FieldError) {
+		jsonData, err := json.Marshal(OrderReq{Items: items})
+		assert.NoError(suite.T(), err)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, suite.orderRequest(jsonData))
+		var body struct {
+			Errors []FieldError `json:"errors"`
+		}
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Code, body.Errors
+	}
+
+	status, fields := order(OrderItem{ProductID: "1", Quantity: 1}, OrderItem{ProductID: "1 ", Quantity: 1})
+	assert.Equal(suite.T(), http.StatusBadRequest, status)
+	assert.Equal(suite.T(), []FieldError{{Field: "items[1].productId", Message: `must be a positive integer, got "1 "`}}, fields)
+
+	status, fields = order(OrderItem{ProductID: "2", Quantity: 1}, OrderItem{ProductID: "999", Quantity: 1})
+	assert.Equal(suite.T(), http.StatusBadRequest, status)
+	assert.Equal(suite.T(), []FieldError{{Field: "items[1].productId", Message: "product 999 not found"}}, fields)
+
+	status, fields = order(OrderItem{ProductID: "2", Quantity: 2}, OrderItem{ProductID: "2", Quantity: 2})
+	assert.Equal(suite.T(), http.StatusBadRequest, status)
+	assert.Equal(suite.T(), []FieldError{{Field: "items[1].quantity", Message: "must not exceed 3 for product 2, got 2 on top of 2"}}, fields)
+
+	// Huge quantities of the same product are rejected instead of overflowing
+	handler = NewRequestHandler(suite.repos, WithOrderLimits(OrderLimits{})).ServeHTTP()
+	status, fields = order(OrderItem{ProductID: "2", Quantity: math.MaxInt}, OrderItem{ProductID: "2", Quantity: math.MaxInt})
+	assert.Equal(suite.T(), http.StatusBadRequest, status)
+	assert.Equal(suite.T(), []FieldError{{Field: "items[1].quantity",
+		Message: fmt.Sprintf("must not exceed %d for product 2, got %d on top of %d", math.MaxInt, math.MaxInt, math.MaxInt)}}, fields)
+}
+
 func (suite *HandlerTestSuite) TestGetOrders() {
-	resp, err := http.Get(suite.server.URL + "/orders")
+	resp, err := suite.getOrders("/orders")
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
 
 	var orders []Order
 	err = json.NewDecoder(resp.Body).Decode(&orders)
 	assert.NoError(suite.T(), err)
-}
\ No newline at end of file
+}
+
+func (suite *HandlerTestSuite) TestGetCoupon() {
+	tests := []struct {
+		code     string
+		valid    bool
+		reason   CouponRejection
+		sources  []string
+		discount *DiscountRule
+	}{
+		{code: "HAPPYHOURS", valid: true, sources: []string{"c1.txt", "c3.txt"}, discount: &DiscountRule{Type: DiscountPercentage, Value: 18}},
+		{code: "FIFTYOFF", valid: true, sources: []string{"c1.txt", "c2.txt", "c3.txt"}},
+		{code: "NINTYOFF", reason: CouponTooFewSources, sources: []string{"c3.txt"}},
+		{code: "NOTACOUPON", reason: CouponNotFound, sources: []string{}},
+		{code: "SUPER100", reason: CouponInvalidFormat, sources: []string{}},
+		{code: "SHORT", reason: CouponInvalidFormat, sources: []string{}},
+	}
+
+	for _, tc := range tests {
+		suite.Run(tc.code, func() {
+			resp, err := http.Get(suite.server.URL + "/coupon/" + tc.code)
+			assert.NoError(suite.T(), err)
+			assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+
+			var check CouponCheck
+			err = json.NewDecoder(resp.Body).Decode(&check)
+			assert.NoError(suite.T(), err)
+			assert.Equal(suite.T(), tc.code, check.Code)
+			assert.Equal(suite.T(), tc.valid, check.Valid)
+			assert.Equal(suite.T(), tc.reason, check.Reason)
+			assert.Equal(suite.T(), tc.sources, check.Sources)
+			assert.Equal(suite.T(), tc.discount, check.Discount)
+		})
+	}
+}
+func (suite *HandlerTestSuite) TestCreateOrderWithCouponLimits() {
+	err := ConfigureCouponLimits(suite.repos.Coupons, suite.couponIndex.Tokenizer(), map[string]CouponLimits{
+		"HAPPYHRS": {MaxUses: 2, MaxUsesPerCustomer: 1},
+	})
+	assert.NoError(suite.T(), err)
+
+	alice := suite.createAPIKey("alice", ScopeCreateOrder)
+	order := func(apiKey string) (int, string) {
+		orderReq := OrderReq{
+			CouponCode: "HAPPYHRS",
+			Items:      []OrderItem{{ProductID: "1", Quantity: 1}},
+		}
+		jsonData, err := json.Marshal(orderReq)
+		assert.NoError(suite.T(), err)
+		req, err := http.NewRequest(http.MethodPost, suite.server.URL+"/order", bytes.NewBuffer(jsonData))
+		assert.NoError(suite.T(), err)
+		if apiKey != "" {
+			req.Header.Set("api_key", apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(suite.T(), err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(suite.T(), err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := order(alice)
+	assert.Equal(suite.T(), http.StatusOK, status)
+	status, body := order(alice)
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, status)
+	assert.Contains(suite.T(), body, string(CouponCustomerLimitReached))
+	status, _ = order("")
+	assert.Equal(suite.T(), http.StatusUnauthorized, status)
+	status, _ = order(suite.createAPIKey("bob", ScopeCreateOrder))
+	assert.Equal(suite.T(), http.StatusOK, status)
+	status, body = order(suite.createAPIKey("carol", ScopeCreateOrder))
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, status)
+	assert.Contains(suite.T(), body, string(CouponUsageLimitReached))
+
+	// Rejected orders are not stored and every order records its redemption
+	redemptions, err := suite.repos.Coupons.CountRedemptions("HAPPYHRS", "")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), redemptions)
+	key, err := suite.repos.APIKeys.FindAPIKey(hashAPIKey(alice))
+	assert.NoError(suite.T(), err)
+	redemptions, err = suite.repos.Coupons.CountRedemptions("HAPPYHRS", fmt.Sprintf("api_key:%d", key.ID))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), redemptions)
+
+	resp, err := http.Get(suite.server.URL + "/coupon/HAPPYHRS")
+	assert.NoError(suite.T(), err)
+	var check CouponCheck
+	err = json.NewDecoder(resp.Body).Decode(&check)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), check.Valid)
+	assert.Equal(suite.T(), CouponUsageLimitReached, check.Reason)
+}
+
+func (suite *HandlerTestSuite) TestCreateOrderWithCouponSchedule() {
+	err := ConfigureCouponLimits(suite.repos.Coupons, suite.couponIndex.Tokenizer(), map[string]CouponLimits{
+		"BUYGETONE": {Schedule: &CouponSchedule{
+			Recurring: []RecurringWindow{{Weekdays: []string{"fri"}, Start: "17:00", End: "19:00"}},
+		}},
+	})
+	assert.NoError(suite.T(), err)
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.NoError(suite.T(), err)
+	// Friday 2025-06-06, 18:00 in Tokyo
+	now := time.Date(2025, 6, 6, 9, 0, 0, 0, time.UTC)
+	handler := NewRequestHandler(suite.repos,
+		WithCouponIndex(suite.couponIndex),
+		WithClock(func() time.Time { return now }),
+		WithStoreLocation(tokyo),
+	).ServeHTTP()
+
+	order := func() *httptest.ResponseRecorder {
+		jsonData, err := json.Marshal(OrderReq{
+			CouponCode: "BUYGETONE",
+			Items:      []OrderItem{{ProductID: "1", Quantity: 2}},
+		})
+		assert.NoError(suite.T(), err)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, suite.orderRequest(jsonData))
+		return rec
+	}
+
+	rec := order()
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	var placed Order
+	assert.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&placed))
+	assert.NotZero(suite.T(), placed.Discounts)
+
+	// An hour later the happy hour is over
+	now = now.Add(time.Hour)
+	rec = order()
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), string(CouponOutsideSchedule))
+}
+
+func TestConcurrentOrdersWithSqliteFileDB(t *testing.T) {
+	db, err := NewDB(WithSqliteFileDB(filepath.Join(t.TempDir(), "orders.db"), WithSqliteBusyTimeout(time.Second)))
+	require.NoError(t, err)
+	require.NoError(t, SeedDatabase(db))
+	repos := NewGormRepositories(db)
+	apiKey := generateAPIKey()
+	require.NoError(t, repos.APIKeys.CreateAPIKey(&APIKey{Name: "orders", KeyHash: hashAPIKey(apiKey), Scopes: []APIScope{ScopeCreateOrder}}))
+	server := httptest.NewServer(NewRequestHandler(repos).ServeHTTP())
+	defer server.Close()
+
+	const orders = 20
+	statuses := make(chan int, orders)
+	var wg sync.WaitGroup
+	for i := 0; i < orders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jsonData, _ := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "1", Quantity: 1}, {ProductID: "2", Quantity: 2}}})
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/order", bytes.NewBuffer(jsonData))
+			req.Header.Set("api_key", apiKey)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		assert.Equal(t, http.StatusOK, status)
+	}
+
+	var count int64
+	require.NoError(t, db.Model(&Order{}).Count(&count).Error)
+	assert.Equal(t, int64(orders), count)
+}
@@ -0,0 +1,190 @@
+package pkg
+
+// idempotency.go lets clients retry requests safely. A request sent with an
+// Idempotency-Key header has its response stored along with a hash of its method,
+// path and body. Retrying the request with the same key replays the stored response
+// instead of running the request again, while reusing the key for a different
+// request, e.g. cancelling another order, is rejected. Requests sharing a key are
+// served one after the other, so a retry arriving while the original request is
+// still running waits for its response.
+//
+// Keys are scoped by the customer sending them, and responses are only kept for the
+// configured TTL. Server errors are not stored, so such requests can be retried.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+)
+
+// IdempotencyRecord stores the response of a request sent with an Idempotency-Key
+type IdempotencyRecord struct {
+	ID          uint   `gorm:"primaryKey"`
+	Key         string `gorm:"column:idempotency_key;not null;uniqueIndex:idx_idempotency_records_key"`
+	Customer    string `gorm:"not null;default:'';uniqueIndex:idx_idempotency_records_key"`
+	RequestHash string `gorm:"not null"`
+	StatusCode  int    `gorm:"not null"`
+	ContentType string `gorm:"not null;default:''"`
+	Body        []byte
+	CreatedAt   time.Time `gorm:"autoCreateTime"`
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+// WithIdempotencyTTL sets how long the responses of requests with an Idempotency-Key are kept
+func WithIdempotencyTTL(ttl time.Duration) func(*RequestHandler) {
+	return func(h *RequestHandler) {
+		if ttl > 0 {
+			h.idempotencyTTL = ttl
+		}
+	}
+}
+
+// idempotencyMiddleware replays the stored response of requests retried with the same
+// Idempotency-Key. Requests without the header are passed on untouched.
+func (h *RequestHandler) idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || h.idempotency == nil {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key must not be longer than 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error("Failed to read request body:", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+		customer := customerKey(r)
+
+		unlock := h.idempotencyLocks.lock(customer + "\x00" + key)
+		defer unlock()
+
+		record, err := h.idempotency.GetIdempotencyRecord(customer, key)
+		switch {
+		case err == nil && h.now().Before(record.ExpiresAt):
+			if record.RequestHash != requestHash {
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if record.ContentType != "" {
+				w.Header().Set("Content-Type", record.ContentType)
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Body)
+			return
+		case err != nil && !errors.Is(err, ErrNotFound):
+			logger.Error("Failed to fetch idempotency record:", err)
+			http.Error(w, "Failed to process request", http.StatusInternalServerError)
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		next(capture, r)
+		if capture.status() >= http.StatusInternalServerError {
+			return
+		}
+		now := h.now()
+		err = h.idempotency.SaveIdempotencyRecord(&IdempotencyRecord{
+			Key:         key,
+			Customer:    customer,
+			RequestHash: requestHash,
+			StatusCode:  capture.status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        capture.body.Bytes(),
+			ExpiresAt:   now.Add(h.idempotencyTTL),
+		}, now)
+		if err != nil {
+			// The response was sent already, a retry will run the request again
+			logger.Error("Failed to store idempotency record:", err)
+		}
+	}
+}
+
+// responseCapture copies the response written to the client
+type responseCapture struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(statusCode int) {
+	if c.statusCode == 0 {
+		c.statusCode = statusCode
+	}
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *responseCapture) Write(data []byte) (int, error) {
+	if c.statusCode == 0 {
+		c.statusCode = http.StatusOK
+	}
+	c.body.Write(data)
+	return c.ResponseWriter.Write(data)
+}
+
+func (c *responseCapture) status() int {
+	if c.statusCode == 0 {
+		return http.StatusOK
+	}
+	return c.statusCode
+}
+
+// keyedMutex serializes the holders of the same key
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	holders int
+}
+
+// lock blocks until the key is free and returns the function releasing it
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	entry, ok := m.locks[key]
+	if !ok {
+		entry = &keyedLock{}
+		m.locks[key] = entry
+	}
+	entry.holders++
+	m.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		m.mu.Lock()
+		entry.holders--
+		if entry.holders == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *HandlerTestSuite) TestCreateOrderIdempotency() {
+	now := time.Date(2025, 6, 6, 9, 0, 0, 0, time.UTC)
+	handler := NewRequestHandler(suite.repos,
+		WithIdempotencyTTL(time.Hour),
+		WithClock(func() time.Time { return now }),
+	).ServeHTTP()
+	order := func(key string, quantity int) *httptest.ResponseRecorder {
+		jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "2", Quantity: quantity}}})
+		assert.NoError(suite.T(), err)
+		req := suite.orderRequest(jsonData)
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	countOrders := func() int {
+		orders, err := suite.repos.Orders.FindOrders(OrderQuery{})
+		assert.NoError(suite.T(), err)
+		return int(orders.Total)
+	}
+
+	first := order("retry-1", 1)
+	assert.Equal(suite.T(), http.StatusOK, first.Code)
+	placed := countOrders()
+
+	replay := order("retry-1", 1)
+	assert.Equal(suite.T(), http.StatusOK, replay.Code)
+	assert.Equal(suite.T(), "true", replay.Header().Get("Idempotent-Replayed"))
+	assert.Equal(suite.T(), "application/json", replay.Header().Get("Content-Type"))
+	assert.Equal(suite.T(), first.Body.String(), replay.Body.String())
+	assert.Equal(suite.T(), placed, countOrders())
+
+	// The key can't be reused for a different order
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, order("retry-1", 2).Code)
+	assert.Equal(suite.T(), placed, countOrders())
+
+	// Rejected orders are replayed as well
+	rejected := order("retry-2", 0)
+	assert.Equal(suite.T(), http.StatusBadRequest, rejected.Code)
+	assert.Equal(suite.T(), rejected.Body.String(), order("retry-2", 0).Body.String())
+
+	// Once the response expired the order is placed again
+	now = now.Add(time.Hour)
+	expired := order("retry-1", 1)
+	assert.Equal(suite.T(), http.StatusOK, expired.Code)
+	assert.Empty(suite.T(), expired.Header().Get("Idempotent-Replayed"))
+	assert.NotEqual(suite.T(), first.Body.String(), expired.Body.String())
+	assert.Equal(suite.T(), placed+1, countOrders())
+}
+
+func (suite *HandlerTestSuite) TestCancelOrderIdempotency() {
+	handler := NewRequestHandler(suite.repos, WithAdminToken(testAdminToken)).ServeHTTP()
+	place := func() Order {
+		jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "2", Quantity: 1}}})
+		assert.NoError(suite.T(), err)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, suite.orderRequest(jsonData))
+		var order Order
+		assert.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&order))
+		return order
+	}
+	cancel := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/order/%s/cancel", id), bytes.NewBufferString(`{"reason": "other", "actor": "support"}`))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		req.Header.Set("Idempotency-Key", "cancel-1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first, second := place(), place()
+	assert.Equal(suite.T(), http.StatusOK, cancel(first.PublicID).Code)
+	assert.Equal(suite.T(), "true", cancel(first.PublicID).Header().Get("Idempotent-Replayed"))
+
+	// The same key and body can't cancel another order
+	assert.Equal(suite.T(), http.StatusUnprocessableEntity, cancel(second.PublicID).Code)
+	order, err := suite.repos.Orders.GetOrder(second.PublicID)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), OrderPlaced, order.Status)
+}
+
+func (suite *HandlerTestSuite) TestConcurrentIdempotentOrders() {
+	placed, err := suite.repos.Orders.FindOrders(OrderQuery{})
+	assert.NoError(suite.T(), err)
+
+	const retries = 10
+	bodies := make(chan string, retries)
+	var wg sync.WaitGroup
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jsonData, _ := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "4", Quantity: 3}}})
+			req, _ := http.NewRequest(http.MethodPost, suite.server.URL+"/order", bytes.NewBuffer(jsonData))
+			req.Header.Set("api_key", suite.apiKey)
+			req.Header.Set("Idempotency-Key", "concurrent")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				bodies <- ""
+				return
+			}
+			defer resp.Body.Close()
+			var body bytes.Buffer
+			body.ReadFrom(resp.Body)
+			bodies <- body.String()
+		}()
+	}
+	wg.Wait()
+	close(bodies)
+
+	var first string
+	for body := range bodies {
+		if first == "" {
+			first = body
+		}
+		assert.NotEmpty(suite.T(), body)
+		assert.Equal(suite.T(), first, body)
+	}
+	orders, err := suite.repos.Orders.FindOrders(OrderQuery{})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), placed.Total+1, orders.Total)
+}
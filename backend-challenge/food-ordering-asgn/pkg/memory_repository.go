@@ -0,0 +1,542 @@
+package pkg
+
+// memory_repository.go implements the repositories in memory. Nothing is persisted,
+// which makes it a fit for tests and trying the API out. Records are copied in and
+// out, so callers can't change the stored records behind the repository's back.
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+// memoryStore holds the records shared by the in-memory repositories
+type memoryStore struct {
+	mu          sync.Mutex
+	products    []Product
+	orders      []Order
+	coupons     map[string]Coupon
+	sources     []CouponSource
+	redemptions []CouponRedemption
+	refunds     []Refund
+	apiKeys     []APIKey
+	idempotency map[string]IdempotencyRecord
+	nextID      struct {
+		order, line, statusChange, coupon, source, redemption, refund, refundLine, apiKey, idempotency uint
+	}
+}
+
+type memoryProductRepository struct {
+	store *memoryStore
+}
+
+type memoryOrderRepository struct {
+	store *memoryStore
+}
+
+type memoryCouponRepository struct {
+	store *memoryStore
+}
+
+type memoryIdempotencyRepository struct {
+	store *memoryStore
+}
+
+type memoryAPIKeyRepository struct {
+	store *memoryStore
+}
+
+// NewMemoryRepositories creates repositories keeping their records in memory, seeded
+// with the default products and the built-in discount rules
+func NewMemoryRepositories() (Repositories, error) {
+	store := &memoryStore{
+		coupons:     map[string]Coupon{},
+		idempotency: map[string]IdempotencyRecord{},
+	}
+	now := time.Now()
+	for i, product := range defaultProducts() {
+		product.ID = uint(i + 1)
+		product.CreatedAt, product.UpdatedAt = now, now
+		store.products = append(store.products, product)
+	}
+	repos := Repositories{
+		Products:    &memoryProductRepository{store: store},
+		Orders:      &memoryOrderRepository{store: store},
+		Coupons:     &memoryCouponRepository{store: store},
+		APIKeys:     &memoryAPIKeyRepository{store: store},
+		Idempotency: &memoryIdempotencyRepository{store: store},
+	}
+	if err := seedDiscountRules(repos.Coupons); err != nil {
+		return Repositories{}, utils.WrapError(err, "failed to seed discount rules")
+	}
+	return repos, nil
+}
+
+func (r *memoryProductRepository) ListProducts() ([]Product, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	return slices.Clone(r.store.products), nil
+}
+
+func (r *memoryProductRepository) GetProduct(id uint) (*Product, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, product := range r.store.products {
+		if product.ID == id {
+			return &product, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryProductRepository) FindProducts(ids []uint) ([]Product, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var products []Product
+	for _, product := range r.store.products {
+		if slices.Contains(ids, product.ID) {
+			products = append(products, product)
+		}
+	}
+	return products, nil
+}
+
+func (r *memoryOrderRepository) GetOrder(publicID string) (*Order, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for _, order := range r.store.orders {
+		if order.PublicID == publicID {
+			order = cloneOrder(order)
+			return &order, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// FindOrders returns an empty page when the order of the cursor doesn't exist
+func (r *memoryOrderRepository) FindOrders(query OrderQuery) (OrderPage, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	var page OrderPage
+	var matching []*Order
+	for i := range r.store.orders {
+		if query.matches(&r.store.orders[i]) {
+			matching = append(matching, &r.store.orders[i])
+		}
+	}
+	page.Total = int64(len(matching))
+
+	var cursorOrderID uint
+	if query.After != nil {
+		index := slices.IndexFunc(r.store.orders, func(order Order) bool { return order.PublicID == query.After.ID })
+		if index == -1 {
+			return page, nil
+		}
+		cursorOrderID = r.store.orders[index].ID
+	}
+	slices.SortFunc(matching, query.compare)
+	for _, order := range matching {
+		if !query.isAfterCursor(order, cursorOrderID) {
+			continue
+		}
+		if query.Limit > 0 && len(page.Orders) == query.Limit {
+			page.More = true
+			break
+		}
+		listed := cloneOrder(*order)
+		listed.StatusHistory = nil
+		page.Orders = append(page.Orders, listed)
+	}
+	return page, nil
+}
+
+// CreateOrder stores the order. The redemption is checked and recorded while the
+// store is locked, so concurrent orders can't exceed the limits of the coupon.
+func (r *memoryOrderRepository) CreateOrder(order *Order, redemption *CouponRedemption, limits CouponLimits) error {
+	store := r.store
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if redemption != nil {
+		if err := checkRedemption(limits, redemption, store.countRedemptions); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	store.nextID.order++
+	order.ID = store.nextID.order
+	if order.CreatedAt.IsZero() {
+		order.CreatedAt = now
+	}
+	if order.PublicID == "" {
+		order.PublicID = newOrderID(order.CreatedAt)
+	}
+	order.UpdatedAt = now
+	order.Items = slices.Clone(order.Items)
+	for i := range order.Items {
+		store.nextID.line++
+		order.Items[i].ID = store.nextID.line
+		order.Items[i].OrderID = order.ID
+		order.Items[i].Product = nil
+	}
+	order.StatusHistory = slices.Clone(order.StatusHistory)
+	for i := range order.StatusHistory {
+		store.nextID.statusChange++
+		order.StatusHistory[i].ID = store.nextID.statusChange
+		order.StatusHistory[i].OrderID = order.ID
+	}
+	store.orders = append(store.orders, cloneOrder(*order))
+
+	if redemption != nil {
+		store.nextID.redemption++
+		redemption.ID = store.nextID.redemption
+		redemption.OrderID = order.ID
+		redemption.CreatedAt = now
+		store.redemptions = append(store.redemptions, *redemption)
+	}
+	return nil
+}
+
+func (r *memoryOrderRepository) UpdateOrderStatus(publicID string, change *OrderStatusChange) (*Order, error) {
+	store := r.store
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	index := slices.IndexFunc(store.orders, func(order Order) bool { return order.PublicID == publicID })
+	if index == -1 {
+		return nil, ErrNotFound
+	}
+	order := &store.orders[index]
+	if err := checkTransition(order.Status, change); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	store.nextID.statusChange++
+	change.ID, change.OrderID = store.nextID.statusChange, order.ID
+	if change.CreatedAt.IsZero() {
+		change.CreatedAt = now
+	}
+	order.Status = change.To
+	order.UpdatedAt = now
+	order.StatusHistory = append(order.StatusHistory, *change)
+	if change.To == OrderRejected {
+		store.redemptions = slices.DeleteFunc(store.redemptions, func(redemption CouponRedemption) bool {
+			return redemption.OrderID == order.ID
+		})
+	}
+	updated := cloneOrder(*order)
+	return &updated, nil
+}
+
+func (r *memoryOrderRepository) RefundOrder(publicID string, refund *Refund) (*Order, error) {
+	store := r.store
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	index := slices.IndexFunc(store.orders, func(order Order) bool { return order.PublicID == publicID })
+	if index == -1 {
+		return nil, ErrNotFound
+	}
+	order := cloneOrder(store.orders[index])
+	status := order.Status
+	if err := applyRefund(&order, refund); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	store.nextID.refund++
+	refund.ID, refund.OrderID = store.nextID.refund, order.ID
+	if refund.CreatedAt.IsZero() {
+		refund.CreatedAt = now
+	}
+	for i := range refund.Lines {
+		store.nextID.refundLine++
+		refund.Lines[i].ID, refund.Lines[i].RefundID = store.nextID.refundLine, refund.ID
+	}
+	store.refunds = append(store.refunds, cloneRefund(*refund))
+	if refund.Full {
+		change := refund.cancellation(status)
+		store.nextID.statusChange++
+		change.ID, change.OrderID = store.nextID.statusChange, order.ID
+		order.StatusHistory = append(order.StatusHistory, change)
+		store.redemptions = slices.DeleteFunc(store.redemptions, func(redemption CouponRedemption) bool {
+			return redemption.OrderID == order.ID
+		})
+	}
+	order.UpdatedAt = now
+	store.orders[index] = order
+	updated := cloneOrder(order)
+	return &updated, nil
+}
+
+func (r *memoryOrderRepository) ListRefunds(publicID string) ([]Refund, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	index := slices.IndexFunc(r.store.orders, func(order Order) bool { return order.PublicID == publicID })
+	if index == -1 {
+		return nil, ErrNotFound
+	}
+	refunds := []Refund{}
+	for _, refund := range r.store.refunds {
+		if refund.OrderID == r.store.orders[index].ID {
+			refunds = append(refunds, cloneRefund(refund))
+		}
+	}
+	return refunds, nil
+}
+
+func cloneRefund(refund Refund) Refund {
+	refund.Lines = slices.Clone(refund.Lines)
+	return refund
+}
+
+func cloneOrder(order Order) Order {
+	order.Items = slices.Clone(order.Items)
+	order.StatusHistory = slices.Clone(order.StatusHistory)
+	return order
+}
+
+func (r *memoryCouponRepository) GetCoupon(code string) (*Coupon, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	coupon, ok := r.store.coupons[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	coupon.SourceFile = nil
+	return &coupon, nil
+}
+
+func (r *memoryCouponRepository) UpdateCoupon(code string, update func(*Coupon)) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	coupon, ok := r.store.coupons[code]
+	if !ok {
+		r.store.nextID.coupon++
+		coupon = Coupon{ID: r.store.nextID.coupon, Code: code}
+	}
+	update(&coupon)
+	coupon.SourceFile = nil
+	r.store.coupons[code] = coupon
+	return nil
+}
+
+func (r *memoryCouponRepository) CountRedemptions(code, customer string) (int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	return r.store.countRedemptions(code, customer)
+}
+
+func (r *memoryCouponRepository) MoveRedemptions(from, to string) (int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var moved int64
+	for i := range r.store.redemptions {
+		if r.store.redemptions[i].Customer == from {
+			r.store.redemptions[i].Customer = to
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// countRedemptions must be called with the store locked
+func (s *memoryStore) countRedemptions(code, customer string) (int64, error) {
+	var uses int64
+	for _, redemption := range s.redemptions {
+		if redemption.Code == code && (customer == "" || redemption.Customer == customer) {
+			uses++
+		}
+	}
+	return uses, nil
+}
+
+func (r *memoryCouponRepository) ListSources() ([]CouponSource, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	sources := slices.Clone(r.store.sources)
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Source < sources[j].Source
+	})
+	return sources, nil
+}
+
+func (r *memoryCouponRepository) FindSources(names []string) ([]CouponSource, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var sources []CouponSource
+	for _, source := range r.store.sources {
+		if slices.Contains(names, source.Source) {
+			sources = append(sources, source)
+		}
+	}
+	return sources, nil
+}
+
+func (r *memoryCouponRepository) SyncSources(names []string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	sources := r.store.sources[:0]
+	for _, source := range r.store.sources {
+		if slices.Contains(names, source.Source) {
+			sources = append(sources, source)
+		}
+	}
+	for _, name := range names {
+		if slices.ContainsFunc(sources, func(source CouponSource) bool { return source.Source == name }) {
+			continue
+		}
+		r.store.nextID.source++
+		sources = append(sources, CouponSource{ID: r.store.nextID.source, Source: name})
+	}
+	r.store.sources = sources
+	return nil
+}
+
+func (r *memoryIdempotencyRepository) GetIdempotencyRecord(customer, key string) (*IdempotencyRecord, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	record, ok := r.store.idempotency[customer+"\x00"+key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	record.Body = slices.Clone(record.Body)
+	return &record, nil
+}
+
+func (r *memoryIdempotencyRepository) SaveIdempotencyRecord(record *IdempotencyRecord, now time.Time) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for id, stored := range r.store.idempotency {
+		if !now.Before(stored.ExpiresAt) {
+			delete(r.store.idempotency, id)
+		}
+	}
+	id := record.Customer + "\x00" + record.Key
+	if _, ok := r.store.idempotency[id]; ok {
+		return fmt.Errorf("idempotency key %s is already stored", record.Key)
+	}
+	r.store.nextID.idempotency++
+	record.ID = r.store.nextID.idempotency
+	record.CreatedAt = time.Now()
+	stored := *record
+	stored.Body = slices.Clone(record.Body)
+	r.store.idempotency[id] = stored
+	return nil
+}
+
+func (r *memoryAPIKeyRepository) FindAPIKey(keyHash string) (*APIKey, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	index := slices.IndexFunc(r.store.apiKeys, func(key APIKey) bool {
+		return key.KeyHash == keyHash || key.PreviousKeyHash != nil && *key.PreviousKeyHash == keyHash
+	})
+	if index == -1 {
+		return nil, ErrNotFound
+	}
+	key := cloneAPIKey(r.store.apiKeys[index])
+	return &key, nil
+}
+
+func (r *memoryAPIKeyRepository) ListAPIKeys() ([]APIKey, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	keys := make([]APIKey, 0, len(r.store.apiKeys))
+	for _, key := range r.store.apiKeys {
+		keys = append(keys, cloneAPIKey(key))
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int { return strings.Compare(a.Name, b.Name) })
+	return keys, nil
+}
+
+func (r *memoryAPIKeyRepository) CreateAPIKey(key *APIKey) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if slices.ContainsFunc(r.store.apiKeys, func(stored APIKey) bool { return stored.Name == key.Name }) {
+		return ErrAPIKeyExists
+	}
+	if err := r.checkUniqueHashes(*key); err != nil {
+		return err
+	}
+	r.store.nextID.apiKey++
+	key.ID = r.store.nextID.apiKey
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	r.store.apiKeys = append(r.store.apiKeys, cloneAPIKey(*key))
+	return nil
+}
+
+func (r *memoryAPIKeyRepository) UpdateAPIKey(name string, update func(*APIKey) error) (*APIKey, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	index := slices.IndexFunc(r.store.apiKeys, func(key APIKey) bool { return key.Name == name })
+	if index == -1 {
+		return nil, ErrNotFound
+	}
+	key := cloneAPIKey(r.store.apiKeys[index])
+	if err := update(&key); err != nil {
+		return nil, err
+	}
+	if err := r.checkUniqueHashes(key); err != nil {
+		return nil, err
+	}
+	r.store.apiKeys[index] = cloneAPIKey(key)
+	return &key, nil
+}
+
+func (r *memoryAPIKeyRepository) RecordAPIKeyUse(id uint, previous bool, usedAt time.Time) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	index := slices.IndexFunc(r.store.apiKeys, func(key APIKey) bool { return key.ID == id })
+	if index == -1 {
+		return ErrNotFound
+	}
+	key := &r.store.apiKeys[index]
+	key.LastUsedAt = &usedAt
+	if previous {
+		key.PreviousLastUsedAt = &usedAt
+	}
+	key.UseCount++
+	return nil
+}
+
+// checkUniqueHashes enforces the unique indexes of the hashes, like the database does
+func (r *memoryAPIKeyRepository) checkUniqueHashes(key APIKey) error {
+	hashes := []string{key.KeyHash}
+	if key.PreviousKeyHash != nil {
+		hashes = append(hashes, *key.PreviousKeyHash)
+	}
+	for _, stored := range r.store.apiKeys {
+		if stored.Name == key.Name {
+			continue
+		}
+		if slices.Contains(hashes, stored.KeyHash) || stored.PreviousKeyHash != nil && slices.Contains(hashes, *stored.PreviousKeyHash) {
+			return fmt.Errorf("API key %s has the same hash as %s", key.Name, stored.Name)
+		}
+	}
+	return nil
+}
+
+// cloneAPIKey copies the key, so the stored key can't be changed through the copy
+func cloneAPIKey(key APIKey) APIKey {
+	key.Scopes = slices.Clone(key.Scopes)
+	for _, at := range []**time.Time{&key.PreviousExpiresAt, &key.RotatedAt, &key.ExpiresAt, &key.RevokedAt, &key.LastUsedAt, &key.PreviousLastUsedAt} {
+		if *at != nil {
+			copied := **at
+			*at = &copied
+		}
+	}
+	if key.PreviousKeyHash != nil {
+		hash := *key.PreviousKeyHash
+		key.PreviousKeyHash = &hash
+	}
+	return key
+}
@@ -0,0 +1,403 @@
+package pkg
+
+// migrations.go versions the database schema. Every migration has a number, an up
+// step applying it and a down step reverting it. Applied migrations are recorded in
+// the schema_migrations table, so a database is only ever migrated forward from the
+// version it is at, and every step runs in a transaction of its own.
+//
+// Migrations are append only: once released, a migration must not change. Schema
+// changes go into a new migration, and the models must match the migrated schema,
+// which is verified by the tests.
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/parvez0/food-ordering-asgn/utils"
+)
+
+// Migration changes the schema from the previous version to Version
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationStatus tells whether a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// execStatements returns a migration step executing the statements in order
+func execStatements(statements ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// schemaMigrations are the migrations of the schema, in order
+var schemaMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_products_and_orders",
+		Up: execStatements(
+			"CREATE TABLE `products` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text NOT NULL,`price` real NOT NULL,`category` text NOT NULL,`created_at` datetime,`updated_at` datetime)",
+			"CREATE TABLE `orders` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime)",
+			"CREATE TABLE `product_list` (`order_id` integer,`product_id` integer,PRIMARY KEY (`order_id`,`product_id`),CONSTRAINT `fk_product_list_order` FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`),CONSTRAINT `fk_product_list_product` FOREIGN KEY (`product_id`) REFERENCES `products`(`id`))",
+			"CREATE TABLE `order_items` (`id` integer PRIMARY KEY AUTOINCREMENT,`product_id` text,`quantity` integer,CONSTRAINT `fk_orders_items` FOREIGN KEY (`id`) REFERENCES `orders`(`id`))",
+		),
+		Down: execStatements(
+			"DROP TABLE `order_items`",
+			"DROP TABLE `product_list`",
+			"DROP TABLE `orders`",
+			"DROP TABLE `products`",
+		),
+	},
+	{
+		Version: 2,
+		Name:    "create_coupons",
+		Up: execStatements(
+			"CREATE TABLE `coupon_source` (`id` integer PRIMARY KEY AUTOINCREMENT,`source` text NOT NULL,CONSTRAINT `uni_coupon_source_source` UNIQUE (`source`))",
+			"CREATE TABLE `coupons` (`id` integer PRIMARY KEY AUTOINCREMENT,`code` text NOT NULL,CONSTRAINT `uni_coupons_code` UNIQUE (`code`))",
+			"CREATE TABLE `coupon_sources` (`coupon_id` integer,`coupon_source_id` integer,PRIMARY KEY (`coupon_id`,`coupon_source_id`),CONSTRAINT `fk_coupon_sources_coupon` FOREIGN KEY (`coupon_id`) REFERENCES `coupons`(`id`) ON DELETE CASCADE,CONSTRAINT `fk_coupon_sources_coupon_source` FOREIGN KEY (`coupon_source_id`) REFERENCES `coupon_source`(`id`) ON DELETE CASCADE)",
+		),
+		Down: execStatements(
+			"DROP TABLE `coupon_sources`",
+			"DROP TABLE `coupons`",
+			"DROP TABLE `coupon_source`",
+		),
+	},
+	{
+		Version: 3,
+		Name:    "add_order_totals_and_discount_rules",
+		Up: execStatements(
+			"ALTER TABLE `orders` ADD `total` real NOT NULL DEFAULT 0",
+			"ALTER TABLE `orders` ADD `discounts` real NOT NULL DEFAULT 0",
+			"ALTER TABLE `coupons` ADD `discount_type` text NOT NULL DEFAULT ''",
+			"ALTER TABLE `coupons` ADD `discount_value` real NOT NULL DEFAULT 0",
+			"ALTER TABLE `coupons` ADD `discount_category` text NOT NULL DEFAULT ''",
+		),
+		Down: execStatements(
+			"ALTER TABLE `coupons` DROP COLUMN `discount_category`",
+			"ALTER TABLE `coupons` DROP COLUMN `discount_value`",
+			"ALTER TABLE `coupons` DROP COLUMN `discount_type`",
+			"ALTER TABLE `orders` DROP COLUMN `discounts`",
+			"ALTER TABLE `orders` DROP COLUMN `total`",
+		),
+	},
+	{
+		Version: 4,
+		Name:    "create_coupon_redemptions",
+		Up: execStatements(
+			"ALTER TABLE `coupons` ADD `max_uses` integer NOT NULL DEFAULT 0",
+			"ALTER TABLE `coupons` ADD `max_uses_per_customer` integer NOT NULL DEFAULT 0",
+			"ALTER TABLE `coupons` ADD `starts_at` datetime",
+			"ALTER TABLE `coupons` ADD `expires_at` datetime",
+			"ALTER TABLE `coupons` ADD `schedule` text",
+			"CREATE TABLE `coupon_redemptions` (`id` integer PRIMARY KEY AUTOINCREMENT,`code` text NOT NULL,`order_id` integer NOT NULL,`customer` text NOT NULL DEFAULT '',`created_at` datetime)",
+			"CREATE INDEX `idx_coupon_redemptions_code` ON `coupon_redemptions`(`code`)",
+			"CREATE INDEX `idx_coupon_redemptions_order_id` ON `coupon_redemptions`(`order_id`)",
+			"CREATE INDEX `idx_coupon_redemptions_customer` ON `coupon_redemptions`(`customer`)",
+		),
+		Down: execStatements(
+			"DROP TABLE `coupon_redemptions`",
+			"ALTER TABLE `coupons` DROP COLUMN `schedule`",
+			"ALTER TABLE `coupons` DROP COLUMN `expires_at`",
+			"ALTER TABLE `coupons` DROP COLUMN `starts_at`",
+			"ALTER TABLE `coupons` DROP COLUMN `max_uses_per_customer`",
+			"ALTER TABLE `coupons` DROP COLUMN `max_uses`",
+		),
+	},
+	{
+		// Sqlite can't drop a constraint, so the table is rebuilt without it
+		Version: 5,
+		Name:    "drop_order_items_order_fk",
+		Up: execStatements(
+			"CREATE TABLE `order_items_new` (`id` integer PRIMARY KEY AUTOINCREMENT,`product_id` text,`quantity` integer)",
+			"INSERT INTO `order_items_new` (`id`,`product_id`,`quantity`) SELECT `id`,`product_id`,`quantity` FROM `order_items`",
+			"DROP TABLE `order_items`",
+			"ALTER TABLE `order_items_new` RENAME TO `order_items`",
+		),
+		Down: execStatements(
+			"CREATE TABLE `order_items_old` (`id` integer PRIMARY KEY AUTOINCREMENT,`product_id` text,`quantity` integer,CONSTRAINT `fk_orders_items` FOREIGN KEY (`id`) REFERENCES `orders`(`id`))",
+			"INSERT INTO `order_items_old` (`id`,`product_id`,`quantity`) SELECT `id`,`product_id`,`quantity` FROM `order_items`",
+			"DROP TABLE `order_items`",
+			"ALTER TABLE `order_items_old` RENAME TO `order_items`",
+		),
+	},
+	{
+		// Orders used to keep their products in product_list, without quantities, and
+		// a single order_items row sharing the id of the order. The lines are rebuilt
+		// from both: the quantity is taken from order_items when it matches the product
+		// and is 1 otherwise, the name and unit price are the current ones.
+		Version: 6,
+		Name:    "create_order_lines",
+		Up: execStatements(
+			"CREATE TABLE `order_lines` (`id` integer PRIMARY KEY AUTOINCREMENT,`order_id` integer NOT NULL,`product_id` integer NOT NULL,`name` text NOT NULL,`unit_price` real NOT NULL,`quantity` integer NOT NULL,CONSTRAINT `fk_orders_items` FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`) ON DELETE CASCADE,CONSTRAINT `fk_order_lines_product` FOREIGN KEY (`product_id`) REFERENCES `products`(`id`))",
+			"CREATE INDEX `idx_order_lines_order_id` ON `order_lines`(`order_id`)",
+			"CREATE INDEX `idx_order_lines_product_id` ON `order_lines`(`product_id`)",
+			"INSERT INTO `order_lines` (`order_id`,`product_id`,`name`,`unit_price`,`quantity`) SELECT `product_list`.`order_id`,`product_list`.`product_id`,`products`.`name`,`products`.`price`,COALESCE((SELECT `order_items`.`quantity` FROM `order_items` WHERE `order_items`.`id` = `product_list`.`order_id` AND `order_items`.`product_id` = CAST(`product_list`.`product_id` AS text) AND `order_items`.`quantity` > 0),1) FROM `product_list` JOIN `products` ON `products`.`id` = `product_list`.`product_id` ORDER BY `product_list`.`order_id`,`product_list`.`product_id`",
+			"DROP TABLE `product_list`",
+			"DROP TABLE `order_items`",
+		),
+		// Reverting restores the previous layout, keeping the last line of every order in order_items
+		Down: execStatements(
+			"CREATE TABLE `product_list` (`order_id` integer,`product_id` integer,PRIMARY KEY (`order_id`,`product_id`),CONSTRAINT `fk_product_list_order` FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`),CONSTRAINT `fk_product_list_product` FOREIGN KEY (`product_id`) REFERENCES `products`(`id`))",
+			"CREATE TABLE `order_items` (`id` integer PRIMARY KEY AUTOINCREMENT,`product_id` text,`quantity` integer)",
+			"INSERT INTO `product_list` (`order_id`,`product_id`) SELECT DISTINCT `order_id`,`product_id` FROM `order_lines`",
+			"INSERT INTO `order_items` (`id`,`product_id`,`quantity`) SELECT `order_id`,CAST(`product_id` AS text),`quantity` FROM `order_lines` WHERE `id` IN (SELECT MAX(`id`) FROM `order_lines` GROUP BY `order_id`)",
+			"DROP TABLE `order_lines`",
+		),
+	},
+	{
+		Version: 7,
+		Name:    "create_idempotency_records",
+		Up: execStatements(
+			"CREATE TABLE `idempotency_records` (`id` integer PRIMARY KEY AUTOINCREMENT,`idempotency_key` text NOT NULL,`customer` text NOT NULL DEFAULT '',`request_hash` text NOT NULL,`status_code` integer NOT NULL,`content_type` text NOT NULL DEFAULT '',`body` blob,`created_at` datetime,`expires_at` datetime NOT NULL)",
+			"CREATE UNIQUE INDEX `idx_idempotency_records_key` ON `idempotency_records`(`idempotency_key`,`customer`)",
+			"CREATE INDEX `idx_idempotency_records_expires_at` ON `idempotency_records`(`expires_at`)",
+		),
+		Down: execStatements(
+			"DROP TABLE `idempotency_records`",
+		),
+	},
+	{
+		// Existing orders start out placed by their customer
+		Version: 8,
+		Name:    "add_order_status",
+		Up: execStatements(
+			"ALTER TABLE `orders` ADD `status` text NOT NULL DEFAULT 'placed'",
+			"CREATE TABLE `order_status_changes` (`id` integer PRIMARY KEY AUTOINCREMENT,`order_id` integer NOT NULL,`from_status` text NOT NULL DEFAULT '',`to_status` text NOT NULL,`actor` text NOT NULL,`reason` text NOT NULL DEFAULT '',`created_at` datetime,CONSTRAINT `fk_orders_status_history` FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`) ON DELETE CASCADE)",
+			"CREATE INDEX `idx_order_status_changes_order_id` ON `order_status_changes`(`order_id`)",
+			"INSERT INTO `order_status_changes` (`order_id`,`to_status`,`actor`,`created_at`) SELECT `id`,'placed','customer',`created_at` FROM `orders` ORDER BY `id`",
+		),
+		Down: execStatements(
+			"DROP TABLE `order_status_changes`",
+			"ALTER TABLE `orders` DROP COLUMN `status`",
+		),
+	},
+	{
+		// Existing orders get a public id derived from the time they were placed
+		Version: 9,
+		Name:    "add_order_public_ids",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("ALTER TABLE `orders` ADD `public_id` text NOT NULL DEFAULT ''").Error; err != nil {
+				return err
+			}
+			var orders []struct {
+				ID        uint
+				CreatedAt *time.Time
+			}
+			if err := tx.Raw("SELECT `id`, `created_at` FROM `orders` ORDER BY `id`").Scan(&orders).Error; err != nil {
+				return err
+			}
+			for _, order := range orders {
+				placedAt := time.Now()
+				if order.CreatedAt != nil {
+					placedAt = *order.CreatedAt
+				}
+				if err := tx.Exec("UPDATE `orders` SET `public_id` = ? WHERE `id` = ?", newOrderID(placedAt), order.ID).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Exec("CREATE UNIQUE INDEX `idx_orders_public_id` ON `orders`(`public_id`)").Error
+		},
+		Down: execStatements(
+			"DROP INDEX `idx_orders_public_id`",
+			"ALTER TABLE `orders` DROP COLUMN `public_id`",
+		),
+	},
+	{
+		Version: 10,
+		Name:    "create_refunds",
+		Up: execStatements(
+			"ALTER TABLE `orders` ADD `refunded` real NOT NULL DEFAULT 0",
+			"ALTER TABLE `order_lines` ADD `refunded_quantity` integer NOT NULL DEFAULT 0",
+			"CREATE TABLE `refunds` (`id` integer PRIMARY KEY AUTOINCREMENT,`order_id` integer NOT NULL,`reason` text NOT NULL,`actor` text NOT NULL,`note` text NOT NULL DEFAULT '',`amount` real NOT NULL,`full` numeric NOT NULL DEFAULT false,`created_at` datetime)",
+			"CREATE INDEX `idx_refunds_order_id` ON `refunds`(`order_id`)",
+			"CREATE TABLE `refund_lines` (`id` integer PRIMARY KEY AUTOINCREMENT,`refund_id` integer NOT NULL,`order_line_id` integer NOT NULL,`product_id` integer NOT NULL,`quantity` integer NOT NULL,`amount` real NOT NULL,CONSTRAINT `fk_refunds_lines` FOREIGN KEY (`refund_id`) REFERENCES `refunds`(`id`) ON DELETE CASCADE)",
+			"CREATE INDEX `idx_refund_lines_refund_id` ON `refund_lines`(`refund_id`)",
+			"CREATE INDEX `idx_refund_lines_order_line_id` ON `refund_lines`(`order_line_id`)",
+		),
+		Down: execStatements(
+			"DROP TABLE `refund_lines`",
+			"DROP TABLE `refunds`",
+			"ALTER TABLE `order_lines` DROP COLUMN `refunded_quantity`",
+			"ALTER TABLE `orders` DROP COLUMN `refunded`",
+		),
+	},
+	{
+		Version: 11,
+		Name:    "create_api_keys",
+		Up: execStatements(
+			"CREATE TABLE `api_keys` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text NOT NULL,`key_hash` text NOT NULL,`scopes` text NOT NULL,`created_at` datetime)",
+			"CREATE UNIQUE INDEX `idx_api_keys_name` ON `api_keys`(`name`)",
+			"CREATE UNIQUE INDEX `idx_api_keys_key_hash` ON `api_keys`(`key_hash`)",
+		),
+		Down: execStatements(
+			"DROP TABLE `api_keys`",
+		),
+	},
+	{
+		Version: 12,
+		Name:    "add_api_key_lifecycle",
+		Up: execStatements(
+			"ALTER TABLE `api_keys` ADD `previous_key_hash` text",
+			"ALTER TABLE `api_keys` ADD `previous_expires_at` datetime",
+			"ALTER TABLE `api_keys` ADD `rotated_at` datetime",
+			"ALTER TABLE `api_keys` ADD `expires_at` datetime",
+			"ALTER TABLE `api_keys` ADD `revoked_at` datetime",
+			"ALTER TABLE `api_keys` ADD `last_used_at` datetime",
+			"ALTER TABLE `api_keys` ADD `previous_last_used_at` datetime",
+			"ALTER TABLE `api_keys` ADD `use_count` integer NOT NULL DEFAULT 0",
+			"CREATE UNIQUE INDEX `idx_api_keys_previous_key_hash` ON `api_keys`(`previous_key_hash`)",
+		),
+		Down: execStatements(
+			"DROP INDEX `idx_api_keys_previous_key_hash`",
+			"ALTER TABLE `api_keys` DROP COLUMN `use_count`",
+			"ALTER TABLE `api_keys` DROP COLUMN `previous_last_used_at`",
+			"ALTER TABLE `api_keys` DROP COLUMN `last_used_at`",
+			"ALTER TABLE `api_keys` DROP COLUMN `revoked_at`",
+			"ALTER TABLE `api_keys` DROP COLUMN `expires_at`",
+			"ALTER TABLE `api_keys` DROP COLUMN `rotated_at`",
+			"ALTER TABLE `api_keys` DROP COLUMN `previous_expires_at`",
+			"ALTER TABLE `api_keys` DROP COLUMN `previous_key_hash`",
+		),
+	},
+}
+
+// Migrator applies and reverts schema migrations
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// WithMigrations replaces the schema migrations, e.g. to test the migrator itself
+func WithMigrations(migrations []Migration) func(*Migrator) {
+	return func(m *Migrator) {
+		m.migrations = migrations
+	}
+}
+
+func NewMigrator(db *gorm.DB, opts ...func(*Migrator)) *Migrator {
+	migrator := &Migrator{db: db, migrations: schemaMigrations}
+	for _, opt := range opts {
+		opt(migrator)
+	}
+	return migrator
+}
+
+// Up applies every pending migration and returns the number of migrations applied
+func (m *Migrator) Up() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now().UTC(),
+			}).Error
+		})
+		if err != nil {
+			return count, utils.WrapError(err, fmt.Sprintf("failed to apply migration %d_%s", migration.Version, migration.Name))
+		}
+		logger.Infof("Applied migration %d_%s", migration.Version, migration.Name)
+		count++
+	}
+	return count, nil
+}
+
+// Down reverts the last steps applied migrations and returns the number of migrations reverted
+func (m *Migrator) Down(steps int) (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, migration := range slices.Backward(m.migrations) {
+		if count == steps {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{Version: migration.Version}).Error
+		})
+		if err != nil {
+			return count, utils.WrapError(err, fmt.Sprintf("failed to revert migration %d_%s", migration.Version, migration.Name))
+		}
+		logger.Infof("Reverted migration %d_%s", migration.Version, migration.Name)
+		count++
+	}
+	return count, nil
+}
+
+// Status lists every migration and when it was applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// applied returns the applied migrations by version, creating the schema_migrations table if needed
+func (m *Migrator) applied() (map[int]SchemaMigration, error) {
+	err := m.db.Exec("CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` integer PRIMARY KEY,`name` text NOT NULL,`applied_at` datetime NOT NULL)").Error
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to create schema_migrations table")
+	}
+	var records []SchemaMigration
+	if err := m.db.Find(&records).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to fetch applied migrations")
+	}
+	applied := make(map[int]SchemaMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gormsqlite "gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+// schemaModels are the models stored in the database
+var schemaModels = []any{
+	&Product{}, &Order{}, &OrderLine{}, &OrderStatusChange{}, &CouponSource{}, &Coupon{}, &CouponRedemption{}, &IdempotencyRecord{},
+	&Refund{}, &RefundLine{}, &APIKey{},
+}
+
+func openTestDB(t *testing.T, name string) *gorm.DB {
+	db, err := gorm.Open(gormsqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+type tableColumn struct {
+	Name         string
+	Type         string
+	NotNull      bool
+	DefaultValue *string `gorm:"column:dflt_value"`
+	PK           int
+}
+
+// describeSchema returns the columns and indexes of every table, except schema_migrations
+func describeSchema(t *testing.T, db *gorm.DB) map[string][]string {
+	var tables []string
+	require.NoError(t, db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT IN ('sqlite_sequence', 'schema_migrations')").Scan(&tables).Error)
+
+	schema := make(map[string][]string, len(tables))
+	for _, table := range tables {
+		var columns []tableColumn
+		require.NoError(t, db.Raw("SELECT name, type, `notnull` AS not_null, dflt_value, pk FROM pragma_table_info(?)", table).Scan(&columns).Error)
+		var description []string
+		for _, column := range columns {
+			defaultValue := "<none>"
+			if column.DefaultValue != nil {
+				// gorm quotes empty string defaults with double quotes
+				defaultValue = strings.ReplaceAll(*column.DefaultValue, `"`, `'`)
+			}
+			description = append(description, strings.Join([]string{
+				"column", column.Name, strings.ToLower(column.Type),
+				map[bool]string{true: "not null", false: "null"}[column.NotNull],
+				"default " + defaultValue, map[bool]string{true: "pk", false: ""}[column.PK > 0],
+			}, " "))
+		}
+
+		var indexes []struct {
+			Name   string
+			Unique bool
+		}
+		require.NoError(t, db.Raw("SELECT name, `unique` FROM pragma_index_list(?) WHERE origin = 'c'", table).Scan(&indexes).Error)
+		for _, index := range indexes {
+			var columns []string
+			require.NoError(t, db.Raw("SELECT name FROM pragma_index_info(?)", index.Name).Scan(&columns).Error)
+			description = append(description, strings.Join([]string{"index", index.Name, strings.Join(columns, ","),
+				map[bool]string{true: "unique", false: ""}[index.Unique]}, " "))
+		}
+
+		var foreignKeys []struct {
+			Table string
+			From  string
+			To    string
+		}
+		require.NoError(t, db.Raw("SELECT `table`, `from`, `to` FROM pragma_foreign_key_list(?)", table).Scan(&foreignKeys).Error)
+		for _, key := range foreignKeys {
+			description = append(description, "foreign key "+key.From+" references "+key.Table+"."+key.To)
+		}
+		sort.Strings(description)
+		schema[table] = description
+	}
+	return schema
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	migrated := openTestDB(t, "migrated")
+	applied, err := NewMigrator(migrated).Up()
+	require.NoError(t, err)
+	assert.Equal(t, len(schemaMigrations), applied)
+
+	expected := openTestDB(t, "automigrated")
+	require.NoError(t, expected.AutoMigrate(schemaModels...))
+
+	assert.Equal(t, describeSchema(t, expected), describeSchema(t, migrated))
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	db := openTestDB(t, t.Name())
+	migrator := NewMigrator(db)
+
+	_, err := migrator.Up()
+	require.NoError(t, err)
+	applied, err := migrator.Up()
+	require.NoError(t, err)
+	assert.Zero(t, applied, "migrations must only be applied once")
+
+	// Rolling back the last migration removes its changes
+	reverted, err := migrator.Down(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reverted)
+	previous := openTestDB(t, t.Name()+"_previous")
+	_, err = NewMigrator(previous, WithMigrations(schemaMigrations[:len(schemaMigrations)-1])).Up()
+	require.NoError(t, err)
+	assert.Equal(t, describeSchema(t, previous), describeSchema(t, db))
+
+	statuses, err := migrator.Status()
+	require.NoError(t, err)
+	require.Len(t, statuses, len(schemaMigrations))
+	for _, status := range statuses[:len(statuses)-1] {
+		assert.NotNil(t, status.AppliedAt, "migration %d", status.Version)
+	}
+	assert.Nil(t, statuses[len(statuses)-1].AppliedAt)
+
+	reverted, err = migrator.Down(len(schemaMigrations))
+	require.NoError(t, err)
+	assert.Equal(t, len(schemaMigrations)-1, reverted)
+	assert.Empty(t, describeSchema(t, db))
+
+	applied, err = migrator.Up()
+	require.NoError(t, err)
+	assert.Equal(t, len(schemaMigrations), applied)
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	db := openTestDB(t, t.Name())
+	migrator := NewMigrator(db, WithMigrations([]Migration{
+		{Version: 1, Name: "create_a", Up: execStatements("CREATE TABLE a (id integer)"), Down: execStatements("DROP TABLE a")},
+		{Version: 2, Name: "create_b", Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("CREATE TABLE b (id integer)").Error; err != nil {
+				return err
+			}
+			return errors.New("broken migration")
+		}},
+	}))
+
+	applied, err := migrator.Up()
+	assert.Error(t, err)
+	assert.Equal(t, 1, applied)
+	assert.True(t, db.Migrator().HasTable("a"))
+	assert.False(t, db.Migrator().HasTable("b"))
+
+	statuses, err := migrator.Status()
+	require.NoError(t, err)
+	assert.NotNil(t, statuses[0].AppliedAt)
+	assert.Nil(t, statuses[1].AppliedAt)
+}
+
+func TestOrderLinesMigrationConvertsOrders(t *testing.T) {
+	db := openTestDB(t, t.Name())
+	_, err := NewMigrator(db, WithMigrations(schemaMigrations[:5])).Up()
+	require.NoError(t, err)
+
+	// Order 1 holds two pizzas and a salad, its order_items row only remembers the salad
+	require.NoError(t, execStatements(
+		"INSERT INTO `products` (`id`,`name`,`price`,`category`) VALUES (1,'Margherita Pizza',12.99,'Pizza'),(3,'Caesar Salad',8.99,'Salad')",
+		"INSERT INTO `orders` (`id`,`total`,`discounts`) VALUES (1,43.96,0)",
+		"INSERT INTO `product_list` (`order_id`,`product_id`) VALUES (1,1),(1,3)",
+		"INSERT INTO `order_items` (`id`,`product_id`,`quantity`) VALUES (1,'3',2),(2,'1',2)",
+	)(db))
+
+	// Only up to the order lines, so later migrations don't affect the reverted schema
+	migrator := NewMigrator(db, WithMigrations(schemaMigrations[:6]))
+	applied, err := migrator.Up()
+	require.NoError(t, err)
+	assert.Equal(t, 1, applied)
+
+	var lines []OrderLine
+	require.NoError(t, db.Order("id").Find(&lines).Error)
+	assert.Equal(t, []OrderLine{
+		{ID: 1, OrderID: 1, ProductID: 1, Name: "Margherita Pizza", UnitPrice: 12.99, Quantity: 1},
+		{ID: 2, OrderID: 1, ProductID: 3, Name: "Caesar Salad", UnitPrice: 8.99, Quantity: 2},
+	}, lines)
+
+	// Reverting keeps the products of the order
+	_, err = migrator.Down(1)
+	require.NoError(t, err)
+	var products []uint
+	require.NoError(t, db.Raw("SELECT `product_id` FROM `product_list` WHERE `order_id` = 1 ORDER BY `product_id`").Scan(&products).Error)
+	assert.Equal(t, []uint{1, 3}, products)
+}
+
+func TestOrderPublicIDsMigration(t *testing.T) {
+	db := openTestDB(t, t.Name())
+	_, err := NewMigrator(db, WithMigrations(schemaMigrations[:8])).Up()
+	require.NoError(t, err)
+
+	placedAt := time.Date(2025, 6, 6, 9, 0, 0, 0, time.UTC)
+	require.NoError(t, db.Exec("INSERT INTO `orders` (`id`,`total`,`discounts`,`created_at`) VALUES (1,12.99,0,?),(2,4.99,0,?)", placedAt, placedAt.Add(time.Minute)).Error)
+
+	migrator := NewMigrator(db, WithMigrations(schemaMigrations[:9]))
+	applied, err := migrator.Up()
+	require.NoError(t, err)
+	assert.Equal(t, 1, applied)
+
+	var publicIDs []string
+	require.NoError(t, db.Raw("SELECT `public_id` FROM `orders` ORDER BY `id`").Scan(&publicIDs).Error)
+	require.Len(t, publicIDs, 2)
+	for _, id := range publicIDs {
+		_, ok := parseOrderID(id)
+		assert.True(t, ok, id)
+	}
+	assert.True(t, strings.HasPrefix(publicIDs[0], newOrderID(placedAt)[:13]))
+	assert.Less(t, publicIDs[0], publicIDs[1])
+
+	_, err = migrator.Down(1)
+	require.NoError(t, err)
+	assert.False(t, db.Migrator().HasColumn("orders", "public_id"))
+}
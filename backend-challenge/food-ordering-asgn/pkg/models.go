@@ -19,21 +19,40 @@ type Product struct {
 	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"-"`
 }
 
+// OrderItem is an item requested by an order
 type OrderItem struct {
-	ID        uint   `gorm:"primaryKey" json:"-"`
 	ProductID string `json:"productId"`
 	Quantity  int    `json:"quantity"`
 }
 
-func(o *OrderItem) TableName() string {
-	return "order_items"
+// OrderLine is a product of a placed order with its quantity. The name and unit price
+// of the product are copied when the order is placed, so the order keeps describing
+// what was sold when the product changes later on.
+type OrderLine struct {
+	ID        uint     `gorm:"primaryKey" json:"-"`
+	OrderID   uint     `gorm:"not null;index" json:"-"`
+	ProductID uint     `gorm:"not null;index" json:"productId"`
+	Product   *Product `json:"-"`
+	Name      string   `gorm:"not null" json:"name"`
+	UnitPrice float64  `gorm:"not null" json:"unitPrice"`
+	Quantity  int      `gorm:"not null" json:"quantity"`
+	// RefundedQuantity is the part of the quantity which was cancelled and refunded
+	RefundedQuantity int `gorm:"not null;default:0" json:"refundedQuantity"`
 }
 
 type Order struct {
-	ID        uint        `gorm:"primaryKey" json:"id"`
-	Items     []OrderItem `gorm:"foreignKey:id" json:"items"`
-	Products  []Product   `gorm:"many2many:product_list;" json:"products"`
-	CreatedAt time.Time   `gorm:"autoCreateTime" json:"-"`
+	// ID is only used to join orders with their lines, clients know orders by their PublicID
+	ID        uint        `gorm:"primaryKey" json:"-"`
+	PublicID  string      `gorm:"not null;default:'';uniqueIndex" json:"id"`
+	Items     []OrderLine `gorm:"constraint:OnDelete:CASCADE" json:"items"`
+	Total     float64     `gorm:"not null;default:0" json:"total"`
+	Discounts float64     `gorm:"not null;default:0" json:"discounts"`
+	// Refunded is the part of the total which was refunded
+	Refunded float64 `gorm:"not null;default:0" json:"refunded"`
+	Status    OrderStatus `gorm:"not null;default:'placed'" json:"status"`
+	// StatusHistory lists the transitions of the order, oldest first. It is left out of order lists.
+	StatusHistory []OrderStatusChange `gorm:"constraint:OnDelete:CASCADE" json:"statusHistory,omitempty"`
+	CreatedAt time.Time   `gorm:"autoCreateTime" json:"createdAt"`
 	UpdatedAt time.Time   `gorm:"autoUpdateTime" json:"-"`
 }
 
@@ -42,6 +61,13 @@ type OrderReq struct {
 	Items      []OrderItem `json:"items"`
 }
 
+// OrderStatusReq requests a transition of an order
+type OrderStatusReq struct {
+	Status OrderStatus `json:"status"`
+	Actor  string      `json:"actor"`
+	Reason string      `json:"reason"`
+}
+
 type ApiResonse struct {
 	StatusCode int
 	Type string
@@ -53,11 +79,22 @@ func (res *ApiResonse) Serialize() []byte {
 	return bytes
 }
 
+// CouponCheck explains whether a coupon code is valid
+type CouponCheck struct {
+	Code     string          `json:"code"`
+	Valid    bool            `json:"valid"`
+	Reason   CouponRejection `json:"reason,omitempty"`
+	Sources  []string        `json:"sources"`
+	Discount *DiscountRule   `json:"discount,omitempty"`
+}
+
 // Each coupon has a unique code and can be associated with multiple source files
 type Coupon struct {
 	ID         uint          `gorm:"primaryKey"`                    
 	Code       string        `gorm:"unique;not null"`              
 	SourceFile []CouponSource `gorm:"many2many:coupon_sources;constraint:OnDelete:CASCADE"`    
+	DiscountRule DiscountRule `gorm:"embedded"`
+	Limits       CouponLimits `gorm:"embedded"`
 }
 
 // A source can contain multiple coupons, and coupons can come from multiple sources
@@ -69,4 +106,10 @@ type CouponSource struct {
 
 func (CouponSource) TableName() string {
 	return "coupon_source"
-}
\ No newline at end of file
+}
+// CouponSourceSummary describes a coupon source and the number of distinct codes found in it
+type CouponSourceSummary struct {
+	ID     uint   `json:"id"`
+	Source string `json:"source"`
+	Codes  int64  `json:"codes"`
+}
@@ -0,0 +1,55 @@
+package pkg
+
+// order_id.go generates the public identifiers of orders. Orders keep their numeric
+// primary key for joins, but it is never exposed: it would reveal how many orders are
+// placed and let anyone guess the ids of other customers' orders. Clients only see a
+// UUIDv7, which starts with the time the order was placed followed by random bits.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// newOrderID returns a version 7 UUID for an order placed at the time, as described by RFC 9562
+func newOrderID(placedAt time.Time) string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(placedAt.UnixMilli())<<16)
+	rand.Read(id[6:])
+	id[6] = id[6]&0x0f | 0x70
+	id[8] = id[8]&0x3f | 0x80
+
+	var text [36]byte
+	hex.Encode(text[0:8], id[0:4])
+	text[8] = '-'
+	hex.Encode(text[9:13], id[4:6])
+	text[13] = '-'
+	hex.Encode(text[14:18], id[6:8])
+	text[18] = '-'
+	hex.Encode(text[19:23], id[8:10])
+	text[23] = '-'
+	hex.Encode(text[24:36], id[10:16])
+	return string(text[:])
+}
+
+// parseOrderID checks that the id is formatted as a UUID and returns it in lower case
+func parseOrderID(id string) (string, bool) {
+	if len(id) != 36 {
+		return "", false
+	}
+	for i := 0; i < len(id); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if id[i] != '-' {
+				return "", false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", rune(id[i])) {
+				return "", false
+			}
+		}
+	}
+	return strings.ToLower(id), true
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOrderID(t *testing.T) {
+	placedAt := time.Date(2025, 6, 6, 9, 0, 0, 0, time.UTC)
+	id := newOrderID(placedAt)
+	require.Len(t, id, 36)
+	assert.NotEqual(t, id, newOrderID(placedAt))
+
+	parsed, ok := parseOrderID(id)
+	require.True(t, ok)
+	assert.Equal(t, id, parsed)
+
+	// The first 48 bits are the time in milliseconds, followed by the version and variant
+	raw, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+	require.NoError(t, err)
+	var millis int64
+	for _, b := range raw[:6] {
+		millis = millis<<8 | int64(b)
+	}
+	assert.Equal(t, placedAt.UnixMilli(), millis)
+	assert.Equal(t, byte(0x70), raw[6]&0xf0)
+	assert.Equal(t, byte(0x80), raw[8]&0xc0)
+
+	// Orders placed later sort after
+	assert.Less(t, id, newOrderID(placedAt.Add(time.Millisecond)))
+}
+
+func (suite *HandlerTestSuite) TestOrderIDFollowsPlacementTime() {
+	placedAt := time.Date(2030, 4, 1, 12, 0, 0, 0, time.UTC)
+	order := &Order{
+		Status:    OrderPlaced,
+		Items:     []OrderLine{{ProductID: 1, Name: "Margherita Pizza", UnitPrice: 12.99, Quantity: 1}},
+		Total:     12.99,
+		CreatedAt: placedAt,
+	}
+	require.NoError(suite.T(), suite.repos.Orders.CreateOrder(order, nil, CouponLimits{}))
+	// The first 48 bits hold the time, which spans the first 13 characters
+	assert.Equal(suite.T(), newOrderID(placedAt)[:13], order.PublicID[:13])
+}
+
+func TestParseOrderID(t *testing.T) {
+	id, ok := parseOrderID("0197440D-2A80-7B3C-9F1E-4A5B6C7D8E9F")
+	assert.True(t, ok)
+	assert.Equal(t, "0197440d-2a80-7b3c-9f1e-4a5b6c7d8e9f", id)
+
+	for _, invalid := range []string{"", "1", "0000-0000-0000-0000", "0197440d2a807b3c9f1e4a5b6c7d8e9f0000", "0197440d-2a80-7b3c-9f1e-4a5b6c7d8e9g"} {
+		_, ok := parseOrderID(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
@@ -0,0 +1,249 @@
+package pkg
+
+// order_query.go parses the filters, sorting and pagination of GET /orders.
+// Orders are paginated with a cursor rather than an offset: the cursor holds the sort
+// key and id of the last order of a page, and the next page starts right after it.
+// Pages stay consistent while new orders are placed, and the database seeks to the
+// next page instead of skipping over the previous ones.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+	totalCountHeader     = "X-Total-Count"
+	nextCursorHeader     = "X-Next-Cursor"
+)
+
+// OrderSort orders a list of orders. Orders placed later have larger ids, so sorting
+// by creation time sorts by id.
+type OrderSort string
+
+const (
+	OrderSortCreatedAsc  OrderSort = "createdAt"
+	OrderSortCreatedDesc OrderSort = "-createdAt"
+	OrderSortTotalAsc    OrderSort = "total"
+	OrderSortTotalDesc   OrderSort = "-total"
+)
+
+var orderSorts = []OrderSort{OrderSortCreatedAsc, OrderSortCreatedDesc, OrderSortTotalAsc, OrderSortTotalDesc}
+
+// Descending reports whether larger values come first
+func (s OrderSort) Descending() bool {
+	return strings.HasPrefix(string(s), "-")
+}
+
+// byTotal reports whether orders are sorted by their total
+func (s OrderSort) byTotal() bool {
+	return s == OrderSortTotalAsc || s == OrderSortTotalDesc
+}
+
+// OrderCursor points right after the last order of a page. It holds the public id
+// of the order, the repositories look up its position.
+type OrderCursor struct {
+	Sort  OrderSort `json:"s"`
+	Total float64   `json:"t,omitempty"`
+	ID    string    `json:"id"`
+}
+
+// OrderQuery selects a page of orders. Zero values don't filter.
+type OrderQuery struct {
+	// From and To limit the orders to those placed in [From, To)
+	From *time.Time
+	To   *time.Time
+	// Statuses keeps the orders in any of the statuses
+	Statuses []OrderStatus
+	// ProductIDs keeps the orders with a line of any of the products
+	ProductIDs []uint
+	Sort       OrderSort
+	Limit      int
+	// After continues the list after the order of the cursor
+	After *OrderCursor
+}
+
+// OrderPage is a page of orders
+type OrderPage struct {
+	Orders []Order
+	// Total counts every order matching the filters, across all pages
+	Total int64
+	// More tells whether there are orders after the page
+	More bool
+}
+
+// matches reports whether the order passes the filters of the query, ignoring the cursor
+func (q OrderQuery) matches(order *Order) bool {
+	if q.From != nil && order.CreatedAt.Before(*q.From) {
+		return false
+	}
+	if q.To != nil && !order.CreatedAt.Before(*q.To) {
+		return false
+	}
+	if len(q.Statuses) > 0 && !slices.Contains(q.Statuses, order.Status) {
+		return false
+	}
+	if len(q.ProductIDs) > 0 && !slices.ContainsFunc(order.Items, func(line OrderLine) bool {
+		return slices.Contains(q.ProductIDs, line.ProductID)
+	}) {
+		return false
+	}
+	return true
+}
+
+// compare orders a and b by the sort of the query, breaking ties by id
+func (q OrderQuery) compare(a, b *Order) int {
+	result := 0
+	if q.Sort.byTotal() {
+		switch {
+		case a.Total < b.Total:
+			result = -1
+		case a.Total > b.Total:
+			result = 1
+		}
+	}
+	if result == 0 {
+		switch {
+		case a.ID < b.ID:
+			result = -1
+		case a.ID > b.ID:
+			result = 1
+		}
+	}
+	if q.Sort.Descending() {
+		return -result
+	}
+	return result
+}
+
+// cursorAfter returns the cursor continuing the list after the order
+func (q OrderQuery) cursorAfter(order *Order) OrderCursor {
+	cursor := OrderCursor{Sort: q.Sort, ID: order.PublicID}
+	if q.Sort.byTotal() {
+		cursor.Total = order.Total
+	}
+	return cursor
+}
+
+// isAfterCursor reports whether the order comes after the cursor of the query,
+// cursorOrderID being the primary key of the order of the cursor
+func (q OrderQuery) isAfterCursor(order *Order, cursorOrderID uint) bool {
+	if q.After == nil {
+		return true
+	}
+	return q.compare(&Order{ID: cursorOrderID, Total: q.After.Total}, order) < 0
+}
+
+func encodeOrderCursor(cursor OrderCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseOrderQuery reads the query of GET /orders. Dates without a time are days in
+// the store's timezone, and a to date includes the whole day.
+func parseOrderQuery(values url.Values, location *time.Location) (OrderQuery, error) {
+	query := OrderQuery{Sort: OrderSortCreatedDesc, Limit: defaultOrderPageSize}
+	invalid := &OrderValidationError{}
+
+	if value := values.Get("sort"); value != "" {
+		query.Sort = OrderSort(value)
+		if !slices.Contains(orderSorts, query.Sort) {
+			invalid.add("sort", "must be one of createdAt, -createdAt, total, -total, got %q", value)
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxOrderPageSize {
+			invalid.add("limit", "must be a number between 1 and %d, got %q", maxOrderPageSize, value)
+		}
+		query.Limit = limit
+	}
+	if value := values.Get("from"); value != "" {
+		from, err := parseOrderQueryTime(value, location, false)
+		if err != nil {
+			invalid.add("from", "must be a date or an RFC 3339 timestamp, got %q", value)
+		} else {
+			query.From = &from
+		}
+	}
+	if value := values.Get("to"); value != "" {
+		to, err := parseOrderQueryTime(value, location, true)
+		if err != nil {
+			invalid.add("to", "must be a date or an RFC 3339 timestamp, got %q", value)
+		} else {
+			query.To = &to
+		}
+	}
+	if query.From != nil && query.To != nil && !query.From.Before(*query.To) {
+		invalid.add("to", "must be after from")
+	}
+	for _, value := range splitQueryValues(values["status"]) {
+		status := OrderStatus(value)
+		if !status.Valid() {
+			invalid.add("status", "unknown status %q", value)
+			continue
+		}
+		query.Statuses = append(query.Statuses, status)
+	}
+	for _, value := range splitQueryValues(values["productId"]) {
+		id, err := strconv.ParseUint(value, 10, 0)
+		if err != nil || id == 0 {
+			invalid.add("productId", "must be a positive integer, got %q", value)
+			continue
+		}
+		query.ProductIDs = append(query.ProductIDs, uint(id))
+	}
+	if value := values.Get("cursor"); value != "" {
+		var cursor OrderCursor
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err == nil {
+			err = json.Unmarshal(data, &cursor)
+		}
+		id, ok := parseOrderID(cursor.ID)
+		switch {
+		case err != nil || !ok:
+			invalid.add("cursor", "is malformed")
+		case cursor.Sort != query.Sort:
+			invalid.add("cursor", "was issued for sort %q", cursor.Sort)
+		default:
+			cursor.ID = id
+			query.After = &cursor
+		}
+	}
+
+	if len(invalid.Errors) > 0 {
+		return OrderQuery{}, invalid
+	}
+	return query, nil
+}
+
+// parseOrderQueryTime parses a date or an RFC 3339 timestamp. Dates are moved to
+// the end of the day when endOfDay is set.
+func parseOrderQueryTime(value string, location *time.Location, endOfDay bool) (time.Time, error) {
+	if day, err := time.ParseInLocation(time.DateOnly, value, location); err == nil {
+		if endOfDay {
+			return day.AddDate(0, 0, 1), nil
+		}
+		return day, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// splitQueryValues accepts both repeated and comma separated query parameters
+func splitQueryValues(values []string) []string {
+	var split []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				split = append(split, part)
+			}
+		}
+	}
+	return split
+}
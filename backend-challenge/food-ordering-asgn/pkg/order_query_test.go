@@ -0,0 +1,233 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOrderQuery(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	require.NoError(t, err)
+
+	query, err := parseOrderQuery(url.Values{}, tokyo)
+	require.NoError(t, err)
+	assert.Equal(t, OrderQuery{Sort: OrderSortCreatedDesc, Limit: defaultOrderPageSize}, query)
+
+	orderID := newOrderID(time.Now())
+	cursor := encodeOrderCursor(OrderCursor{Sort: OrderSortTotalAsc, Total: 12.5, ID: strings.ToUpper(orderID)})
+	query, err = parseOrderQuery(url.Values{
+		"sort":      {"total"},
+		"limit":     {"5"},
+		"from":      {"2025-06-01"},
+		"to":        {"2025-06-07T12:00:00Z"},
+		"status":    {"placed,ready", "completed"},
+		"productId": {"3", "1, 2"},
+		"cursor":    {cursor},
+	}, tokyo)
+	require.NoError(t, err)
+	assert.Equal(t, OrderSortTotalAsc, query.Sort)
+	assert.Equal(t, 5, query.Limit)
+	assert.True(t, time.Date(2025, 5, 31, 15, 0, 0, 0, time.UTC).Equal(*query.From))
+	assert.True(t, time.Date(2025, 6, 7, 12, 0, 0, 0, time.UTC).Equal(*query.To))
+	assert.Equal(t, []OrderStatus{OrderPlaced, OrderReady, OrderCompleted}, query.Statuses)
+	assert.Equal(t, []uint{3, 1, 2}, query.ProductIDs)
+	assert.Equal(t, &OrderCursor{Sort: OrderSortTotalAsc, Total: 12.5, ID: orderID}, query.After)
+
+	// A to date includes the whole day
+	query, err = parseOrderQuery(url.Values{"from": {"2025-06-06"}, "to": {"2025-06-06"}}, tokyo)
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, query.To.Sub(*query.From))
+
+	_, err = parseOrderQuery(url.Values{
+		"sort":      {"name"},
+		"limit":     {"101"},
+		"from":      {"yesterday"},
+		"status":    {"lost"},
+		"productId": {"0"},
+		"cursor":    {encodeOrderCursor(OrderCursor{Sort: OrderSortTotalAsc, ID: "7"})},
+	}, tokyo)
+	var invalid *OrderValidationError
+	require.ErrorAs(t, err, &invalid)
+	assert.Equal(t, []FieldError{
+		{Field: "sort", Message: `must be one of createdAt, -createdAt, total, -total, got "name"`},
+		{Field: "limit", Message: `must be a number between 1 and 100, got "101"`},
+		{Field: "from", Message: `must be a date or an RFC 3339 timestamp, got "yesterday"`},
+		{Field: "status", Message: `unknown status "lost"`},
+		{Field: "productId", Message: `must be a positive integer, got "0"`},
+		{Field: "cursor", Message: "is malformed"},
+	}, invalid.Errors)
+
+	_, err = parseOrderQuery(url.Values{"from": {"2025-06-07"}, "to": {"2025-06-01"}, "cursor": {cursor}}, tokyo)
+	require.ErrorAs(t, err, &invalid)
+	assert.Equal(t, []FieldError{
+		{Field: "to", Message: "must be after from"},
+		{Field: "cursor", Message: `was issued for sort "total"`},
+	}, invalid.Errors)
+}
+
+func (suite *HandlerTestSuite) TestListOrders() {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	require.NoError(suite.T(), err)
+	// Orders are placed far from the orders of the other tests, which share the repositories
+	now := time.Date(2031, 3, 3, 9, 0, 0, 0, time.UTC)
+	handler := NewRequestHandler(suite.repos,
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+		WithStoreLocation(tokyo),
+	).ServeHTTP()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	placeOrder := func(productID string, quantity int) Order {
+		jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: productID, Quantity: quantity}}})
+		require.NoError(suite.T(), err)
+		rec := serve(suite.orderRequest(jsonData))
+		require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+		var order Order
+		require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&order))
+		return order
+	}
+	listOrders := func(query url.Values) ([]Order, *httptest.ResponseRecorder) {
+		rec := serve(suite.readRequest("/orders?" + query.Encode()))
+		var orders []Order
+		if rec.Code == http.StatusOK {
+			require.NoError(suite.T(), json.Unmarshal(rec.Body.Bytes(), &orders))
+		}
+		return orders, rec
+	}
+	ids := func(orders []Order) []string {
+		ids := make([]string, 0, len(orders))
+		for _, order := range orders {
+			ids = append(ids, order.PublicID)
+		}
+		return ids
+	}
+
+	// Five orders on March 3rd and one on the 4th, in Tokyo
+	var placed []Order
+	for _, quantity := range []int{3, 1, 4, 1, 5} {
+		placed = append(placed, placeOrder("2", quantity))
+		now = now.Add(time.Minute)
+	}
+	now = now.Add(24 * time.Hour)
+	nextDay := placeOrder("3", 2)
+	march := url.Values{"from": {"2031-03-03"}, "to": {"2031-03-04"}}
+
+	// Pages are walked with the cursor until there is no next page
+	walk := func(sort string) []string {
+		var walked []string
+		query := url.Values{"from": march["from"], "to": march["to"], "sort": {sort}, "limit": {"2"}}
+		for pages := 0; pages < 5; pages++ {
+			orders, rec := listOrders(query)
+			require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+			assert.Equal(suite.T(), "6", rec.Header().Get("X-Total-Count"))
+			assert.LessOrEqual(suite.T(), len(orders), 2)
+			walked = append(walked, ids(orders)...)
+			cursor := rec.Header().Get("X-Next-Cursor")
+			if cursor == "" {
+				return walked
+			}
+			query.Set("cursor", cursor)
+		}
+		assert.Fail(suite.T(), "pagination did not end")
+		return walked
+	}
+	all := append(ids(placed), nextDay.PublicID)
+	assert.Equal(suite.T(), all, walk("createdAt"))
+	assert.Equal(suite.T(), []string{all[5], all[4], all[3], all[2], all[1], all[0]}, walk("-createdAt"))
+	// Orders with the same total are sorted by id
+	assert.Equal(suite.T(), []string{all[1], all[3], all[5], all[0], all[2], all[4]}, walk("total"))
+	assert.Equal(suite.T(), []string{all[4], all[2], all[0], all[5], all[3], all[1]}, walk("-total"))
+
+	// A cursor of an unknown order ends the walk, whatever the sort
+	for _, sort := range []OrderSort{OrderSortCreatedAsc, OrderSortTotalAsc, OrderSortTotalDesc} {
+		cursor := encodeOrderCursor(OrderCursor{Sort: sort, Total: 1, ID: newOrderID(now)})
+		orders, rec := listOrders(url.Values{"from": march["from"], "to": march["to"], "sort": {string(sort)}, "cursor": {cursor}})
+		require.Equal(suite.T(), http.StatusOK, rec.Code, rec.Body.String())
+		assert.Equal(suite.T(), "6", rec.Header().Get("X-Total-Count"))
+		assert.Empty(suite.T(), orders, sort)
+	}
+
+	// Lists leave out the status history
+	orders, rec := listOrders(url.Values{"from": {"2031-03-03"}, "to": {"2031-03-03"}})
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	assert.Equal(suite.T(), "5", rec.Header().Get("X-Total-Count"))
+	assert.Empty(suite.T(), rec.Header().Get("X-Next-Cursor"))
+	assert.Equal(suite.T(), []string{all[4], all[3], all[2], all[1], all[0]}, ids(orders))
+	require.NotEmpty(suite.T(), orders)
+	assert.NotEmpty(suite.T(), orders[0].Items)
+	assert.Nil(suite.T(), orders[0].StatusHistory)
+	assert.NotContains(suite.T(), rec.Body.String(), "statusHistory")
+
+	jsonData, err := json.Marshal(OrderStatusReq{Status: OrderAccepted, Actor: "kitchen"})
+	require.NoError(suite.T(), err)
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/order/%s/status", placed[1].PublicID), bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	require.Equal(suite.T(), http.StatusOK, serve(req).Code)
+
+	orders, rec = listOrders(url.Values{"from": march["from"], "to": march["to"], "status": {"accepted"}})
+	assert.Equal(suite.T(), "1", rec.Header().Get("X-Total-Count"))
+	assert.Equal(suite.T(), []string{placed[1].PublicID}, ids(orders))
+
+	orders, rec = listOrders(url.Values{"from": march["from"], "to": march["to"], "productId": {"3"}})
+	assert.Equal(suite.T(), "1", rec.Header().Get("X-Total-Count"))
+	assert.Equal(suite.T(), []string{nextDay.PublicID}, ids(orders))
+
+	// Timestamps are compared as instants, whatever their timezone
+	orders, _ = listOrders(url.Values{"from": {"2031-03-03T18:01:00+09:00"}, "to": {"2031-03-03T09:03:00Z"}})
+	assert.Equal(suite.T(), []string{placed[2].PublicID, placed[1].PublicID}, ids(orders))
+
+	orders, rec = listOrders(url.Values{"from": {"2031-03-05"}})
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	assert.Equal(suite.T(), "0", rec.Header().Get("X-Total-Count"))
+	assert.Equal(suite.T(), "[]\n", rec.Body.String())
+	assert.Empty(suite.T(), orders)
+
+	_, rec = listOrders(url.Values{"sort": {"-total"}, "status": {"lost"}})
+	assert.Equal(suite.T(), http.StatusBadRequest, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), "Invalid order query")
+	assert.Contains(suite.T(), rec.Body.String(), `"field":"status"`)
+}
+
+func (suite *HandlerTestSuite) TestGetOrderByID() {
+	jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "4", Quantity: 2}}})
+	require.NoError(suite.T(), err)
+	resp, err := suite.postOrder(jsonData)
+	require.NoError(suite.T(), err)
+	var placed Order
+	require.NoError(suite.T(), json.NewDecoder(resp.Body).Decode(&placed))
+	resp.Body.Close()
+
+	resp, err = suite.getOrders("/order/" + placed.PublicID)
+	require.NoError(suite.T(), err)
+	defer resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+	var order Order
+	require.NoError(suite.T(), json.NewDecoder(resp.Body).Decode(&order))
+	assert.Equal(suite.T(), placed.PublicID, order.PublicID)
+	assert.Equal(suite.T(), placed.Items, order.Items)
+	require.Len(suite.T(), order.StatusHistory, 1)
+	assert.Equal(suite.T(), OrderPlaced, order.StatusHistory[0].To)
+
+	resp, err = suite.getOrders("/order/" + newOrderID(time.Now()))
+	require.NoError(suite.T(), err)
+	defer resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusNotFound, resp.StatusCode)
+
+	resp, err = suite.getOrders("/order/1")
+	require.NoError(suite.T(), err)
+	defer resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusBadRequest, resp.StatusCode)
+}
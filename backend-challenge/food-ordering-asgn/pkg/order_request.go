@@ -0,0 +1,135 @@
+package pkg
+
+// order_request.go normalizes the items of an order request before it is priced.
+// Items of the same product are merged into a single line, and every problem found
+// is reported against the field of the request causing it, so clients can point
+// their users to what needs fixing.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxLineQuantity  = 100
+	defaultMaxOrderQuantity = 500
+)
+
+// OrderLimits caps the quantities of an order. Zero values mean no limit.
+type OrderLimits struct {
+	// MaxLineQuantity is the largest quantity of a single product
+	MaxLineQuantity int `json:"maxLineQuantity"`
+	// MaxOrderQuantity is the largest quantity of all products together
+	MaxOrderQuantity int `json:"maxOrderQuantity"`
+}
+
+func DefaultOrderLimits() OrderLimits {
+	return OrderLimits{
+		MaxLineQuantity:  defaultMaxLineQuantity,
+		MaxOrderQuantity: defaultMaxOrderQuantity,
+	}
+}
+
+// Validate checks that the limits can be satisfied
+func (l OrderLimits) Validate() error {
+	if l.MaxLineQuantity < 0 || l.MaxOrderQuantity < 0 {
+		return fmt.Errorf("order quantity limits must not be negative, got %d and %d", l.MaxLineQuantity, l.MaxOrderQuantity)
+	}
+	return nil
+}
+
+// FieldError rejects a single field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// OrderValidationError lists every field of an order request which was rejected
+type OrderValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *OrderValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, field := range e.Errors {
+		messages = append(messages, field.Field+": "+field.Message)
+	}
+	return "invalid order: " + strings.Join(messages, "; ")
+}
+
+func (e *OrderValidationError) add(field, format string, args ...any) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// orderRequestLine is the requested quantity of a product. Index is the position
+// of the first item of the product in the request, which errors are reported against.
+type orderRequestLine struct {
+	Index     int
+	ProductID uint
+	Quantity  int
+}
+
+// normalizeOrderItems merges the items of the same product, in the order the products
+// were first requested, and checks them against the limits. Quantities are checked
+// before they are added up, so huge quantities are rejected rather than overflowing.
+// It returns an *OrderValidationError when any item is invalid.
+func normalizeOrderItems(items []OrderItem, limits OrderLimits) ([]orderRequestLine, error) {
+	invalid := &OrderValidationError{}
+	if len(items) == 0 {
+		invalid.add("items", "order must contain at least one item")
+		return nil, invalid
+	}
+	maxLine, maxOrder := quantityLimit(limits.MaxLineQuantity), quantityLimit(limits.MaxOrderQuantity)
+
+	var lines []orderRequestLine
+	positions := make(map[uint]int, len(items))
+	for i, item := range items {
+		field, previousErrors := fmt.Sprintf("items[%d].quantity", i), len(invalid.Errors)
+		id, err := strconv.ParseUint(item.ProductID, 10, 0)
+		if err != nil || id == 0 {
+			invalid.add(fmt.Sprintf("items[%d].productId", i), "must be a positive integer, got %q", item.ProductID)
+		}
+		if item.Quantity <= 0 {
+			invalid.add(field, "must be greater than zero")
+		}
+		if len(invalid.Errors) > previousErrors {
+			continue
+		}
+		position, merged := positions[uint(id)]
+		switch {
+		case item.Quantity > maxLine:
+			invalid.add(field, "must not exceed %d for product %d, got %d", maxLine, id, item.Quantity)
+		case merged && item.Quantity > maxLine-lines[position].Quantity:
+			invalid.add(field, "must not exceed %d for product %d, got %d on top of %d",
+				maxLine, id, item.Quantity, lines[position].Quantity)
+		case merged:
+			lines[position].Quantity += item.Quantity
+		default:
+			positions[uint(id)] = len(lines)
+			lines = append(lines, orderRequestLine{Index: i, ProductID: uint(id), Quantity: item.Quantity})
+		}
+	}
+	if len(invalid.Errors) > 0 {
+		return nil, invalid
+	}
+
+	total := 0
+	for _, line := range lines {
+		if line.Quantity > maxOrder-total {
+			invalid.add("items", "order must not contain more than %d items", maxOrder)
+			return nil, invalid
+		}
+		total += line.Quantity
+	}
+	return lines, nil
+}
+
+// quantityLimit returns the largest quantity allowed by a limit, zero meaning no limit
+func quantityLimit(limit int) int {
+	if limit == 0 {
+		return math.MaxInt
+	}
+	return limit
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeOrderItems(t *testing.T) {
+	limits := OrderLimits{MaxLineQuantity: 5, MaxOrderQuantity: 8}
+
+	tests := []struct {
+		name   string
+		items  []OrderItem
+		want   []orderRequestLine
+		errors []FieldError
+	}{
+		{
+			name:  "distinct products",
+			items: []OrderItem{{ProductID: "2", Quantity: 1}, {ProductID: "1", Quantity: 3}},
+			want:  []orderRequestLine{{Index: 0, ProductID: 2, Quantity: 1}, {Index: 1, ProductID: 1, Quantity: 3}},
+		},
+		{
+			name:  "duplicate products are merged",
+			items: []OrderItem{{ProductID: "1", Quantity: 1}, {ProductID: "2", Quantity: 2}, {ProductID: "01", Quantity: 2}},
+			want:  []orderRequestLine{{Index: 0, ProductID: 1, Quantity: 3}, {Index: 1, ProductID: 2, Quantity: 2}},
+		},
+		{
+			name:   "no items",
+			errors: []FieldError{{Field: "items", Message: "order must contain at least one item"}},
+		},
+		{
+			name:  "malformed items",
+			items: []OrderItem{{ProductID: "pizza", Quantity: 1}, {ProductID: "0", Quantity: 1}, {ProductID: "-3", Quantity: 1}, {ProductID: "4", Quantity: 0}},
+			errors: []FieldError{
+				{Field: "items[0].productId", Message: `must be a positive integer, got "pizza"`},
+				{Field: "items[1].productId", Message: `must be a positive integer, got "0"`},
+				{Field: "items[2].productId", Message: `must be a positive integer, got "-3"`},
+				{Field: "items[3].quantity", Message: "must be greater than zero"},
+			},
+		},
+		{
+			name:   "merged line above the limit",
+			items:  []OrderItem{{ProductID: "3", Quantity: 1}, {ProductID: "1", Quantity: 3}, {ProductID: "1", Quantity: 3}},
+			errors: []FieldError{{Field: "items[2].quantity", Message: "must not exceed 5 for product 1, got 3 on top of 3"}},
+		},
+		{
+			name:   "item above the limit",
+			items:  []OrderItem{{ProductID: "1", Quantity: 6}},
+			errors: []FieldError{{Field: "items[0].quantity", Message: "must not exceed 5 for product 1, got 6"}},
+		},
+		{
+			name:  "limits are checked after an invalid item",
+			items: []OrderItem{{ProductID: "pizza", Quantity: 1}, {ProductID: "2", Quantity: 6}},
+			errors: []FieldError{
+				{Field: "items[0].productId", Message: `must be a positive integer, got "pizza"`},
+				{Field: "items[1].quantity", Message: "must not exceed 5 for product 2, got 6"},
+			},
+		},
+		{
+			name:   "order above the limit",
+			items:  []OrderItem{{ProductID: "1", Quantity: 5}, {ProductID: "2", Quantity: 4}},
+			errors: []FieldError{{Field: "items", Message: "order must not contain more than 8 items"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lines, err := normalizeOrderItems(tc.items, limits)
+			if tc.errors == nil {
+				require.NoError(t, err)
+				assert.Equal(t, tc.want, lines)
+				return
+			}
+			var invalid *OrderValidationError
+			require.ErrorAs(t, err, &invalid)
+			assert.Equal(t, tc.errors, invalid.Errors)
+		})
+	}
+
+	// Without limits any quantity is accepted
+	lines, err := normalizeOrderItems([]OrderItem{{ProductID: "1", Quantity: 1000}}, OrderLimits{})
+	require.NoError(t, err)
+	assert.Equal(t, 1000, lines[0].Quantity)
+
+	// Merged quantities are rejected rather than overflowing
+	huge := []OrderItem{{ProductID: "1", Quantity: math.MaxInt}, {ProductID: "1", Quantity: math.MaxInt}}
+	_, err = normalizeOrderItems(huge, OrderLimits{})
+	var invalid *OrderValidationError
+	require.ErrorAs(t, err, &invalid)
+	assert.Equal(t, "items[1].quantity", invalid.Errors[0].Field)
+	_, err = normalizeOrderItems(huge[:1], OrderLimits{MaxLineQuantity: 5})
+	assert.ErrorAs(t, err, &invalid)
+}
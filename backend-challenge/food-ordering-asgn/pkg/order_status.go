@@ -0,0 +1,107 @@
+package pkg
+
+// order_status.go defines the lifecycle of an order. An order is placed by a customer,
+// accepted or rejected by the kitchen, prepared, made ready and finally completed once
+// it was handed over. Until it is ready it can still be cancelled. Every transition
+// is recorded with the time it happened and who made it.
+//
+// The legal transitions are only defined here. The repositories check them with
+// checkTransition in the same transaction that changes the status.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+type OrderStatus string
+
+const (
+	OrderPlaced    OrderStatus = "placed"
+	OrderAccepted  OrderStatus = "accepted"
+	OrderPreparing OrderStatus = "preparing"
+	OrderReady     OrderStatus = "ready"
+	OrderCompleted OrderStatus = "completed"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderRejected  OrderStatus = "rejected"
+)
+
+// orderStatuses lists every status in lifecycle order
+var orderStatuses = []OrderStatus{
+	OrderPlaced, OrderAccepted, OrderPreparing, OrderReady, OrderCompleted, OrderCancelled, OrderRejected,
+}
+
+// orderTransitions maps every status to the statuses an order can move to from it.
+// Completed, cancelled and rejected orders are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPlaced:    {OrderAccepted, OrderRejected, OrderCancelled},
+	OrderAccepted:  {OrderPreparing, OrderCancelled},
+	OrderPreparing: {OrderReady, OrderCancelled},
+	OrderReady:     {OrderCompleted},
+}
+
+// orderPlacedBy is the actor of the first transition of every order
+const orderPlacedBy = "customer"
+
+// Valid reports whether the status is one of the known statuses
+func (s OrderStatus) Valid() bool {
+	return slices.Contains(orderStatuses, s)
+}
+
+// CanTransition reports whether an order can move from the status to next
+func (s OrderStatus) CanTransition(next OrderStatus) bool {
+	return slices.Contains(orderTransitions[s], next)
+}
+
+// OrderStatusChange records a transition of an order
+type OrderStatusChange struct {
+	ID        uint        `gorm:"primaryKey" json:"-"`
+	OrderID   uint        `gorm:"not null;index" json:"-"`
+	From      OrderStatus `gorm:"column:from_status;not null;default:''" json:"from,omitempty"`
+	To        OrderStatus `gorm:"column:to_status;not null" json:"to"`
+	Actor     string      `gorm:"not null" json:"actor"`
+	Reason    string      `gorm:"not null;default:''" json:"reason,omitempty"`
+	CreatedAt time.Time   `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// OrderTransitionError rejects a status change which isn't allowed from the current status
+type OrderTransitionError struct {
+	From OrderStatus
+	To   OrderStatus
+}
+
+func (e *OrderTransitionError) Error() string {
+	return fmt.Sprintf("order can't move from %s to %s", e.From, e.To)
+}
+
+// checkTransition returns an *OrderTransitionError unless the order can move from its current status
+func checkTransition(current OrderStatus, change *OrderStatusChange) error {
+	if !current.CanTransition(change.To) {
+		return &OrderTransitionError{From: current, To: change.To}
+	}
+	change.From = current
+	return nil
+}
+
+// validateStatusChange checks a status change requested by a client
+func validateStatusChange(req OrderStatusReq) error {
+	invalid := &OrderValidationError{}
+	if !req.Status.Valid() {
+		names := make([]string, 0, len(orderStatuses))
+		for _, status := range orderStatuses {
+			names = append(names, string(status))
+		}
+		invalid.add("status", "must be one of %s, got %q", strings.Join(names, ", "), req.Status)
+	} else if req.Status == OrderCancelled {
+		// Cancelling refunds the order, which needs a reason code
+		invalid.add("status", "orders are cancelled with POST /order/{orderId}/cancel")
+	}
+	if strings.TrimSpace(req.Actor) == "" {
+		invalid.add("actor", "must not be empty")
+	}
+	if len(invalid.Errors) > 0 {
+		return invalid
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderStatusTransitions(t *testing.T) {
+	lifecycle := []OrderStatus{OrderPlaced, OrderAccepted, OrderPreparing, OrderReady, OrderCompleted}
+	for i := 1; i < len(lifecycle); i++ {
+		assert.True(t, lifecycle[i-1].CanTransition(lifecycle[i]), "%s to %s", lifecycle[i-1], lifecycle[i])
+		assert.False(t, lifecycle[i].CanTransition(lifecycle[i-1]), "%s to %s", lifecycle[i], lifecycle[i-1])
+	}
+
+	assert.True(t, OrderPlaced.CanTransition(OrderRejected))
+	assert.False(t, OrderAccepted.CanTransition(OrderRejected))
+	assert.True(t, OrderPreparing.CanTransition(OrderCancelled))
+	assert.False(t, OrderReady.CanTransition(OrderCancelled))
+	assert.False(t, OrderPlaced.CanTransition(OrderReady))
+	assert.False(t, OrderPlaced.CanTransition(OrderPlaced))
+	for _, final := range []OrderStatus{OrderCompleted, OrderCancelled, OrderRejected} {
+		for _, status := range orderStatuses {
+			assert.False(t, final.CanTransition(status), "%s to %s", final, status)
+		}
+	}
+
+	assert.True(t, OrderReady.Valid())
+	assert.False(t, OrderStatus("lost").Valid())
+
+	change := &OrderStatusChange{To: OrderReady}
+	assert.Equal(t, &OrderTransitionError{From: OrderAccepted, To: OrderReady}, checkTransition(OrderAccepted, change))
+	assert.NoError(t, checkTransition(OrderPreparing, change))
+	assert.Equal(t, OrderPreparing, change.From)
+}
+
+func (suite *HandlerTestSuite) TestUpdateOrderStatus() {
+	now := time.Date(2025, 6, 6, 9, 0, 0, 0, time.UTC)
+	handler := NewRequestHandler(suite.repos,
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+	).ServeHTTP()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	updateStatus := func(id string, req OrderStatusReq) *httptest.ResponseRecorder {
+		jsonData, err := json.Marshal(req)
+		assert.NoError(suite.T(), err)
+		httpReq := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/order/%s/status", id), bytes.NewBuffer(jsonData))
+		httpReq.Header.Set("Authorization", "Bearer "+testAdminToken)
+		return serve(httpReq)
+	}
+
+	jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "5", Quantity: 1}}})
+	assert.NoError(suite.T(), err)
+	rec := serve(suite.orderRequest(jsonData))
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	var order Order
+	assert.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(suite.T(), OrderPlaced, order.Status)
+
+	// Status changes are reserved to the staff
+	rec = serve(httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/order/%s/status", order.PublicID), bytes.NewBufferString(`{"status": "accepted", "actor": "kitchen"}`)))
+	assert.Equal(suite.T(), http.StatusUnauthorized, rec.Code)
+
+	now = now.Add(time.Minute)
+	rec = updateStatus(order.PublicID, OrderStatusReq{Status: OrderAccepted, Actor: "kitchen"})
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	assert.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(suite.T(), OrderAccepted, order.Status)
+
+	// Steps of the lifecycle can't be skipped
+	rec = updateStatus(order.PublicID, OrderStatusReq{Status: OrderReady, Actor: "kitchen"})
+	assert.Equal(suite.T(), http.StatusConflict, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), "accepted to ready")
+
+	// Cancelling refunds the order, which is done with its own endpoint
+	rec = updateStatus(order.PublicID, OrderStatusReq{Status: OrderCancelled, Actor: "support"})
+	assert.Equal(suite.T(), http.StatusBadRequest, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), "/cancel")
+
+	now = now.Add(time.Minute)
+	jsonData, err = json.Marshal(CancelOrderReq{Reason: CancelCustomerRequest, Actor: "support", Note: "customer called"})
+	assert.NoError(suite.T(), err)
+	httpReq := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/order/%s/cancel", order.PublicID), bytes.NewBuffer(jsonData))
+	httpReq.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec = serve(httpReq)
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	rec = serve(suite.readRequest("/order/" + order.PublicID))
+	assert.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(suite.T(), OrderCancelled, order.Status)
+	assert.Equal(suite.T(), []OrderStatusChange{
+		{To: OrderPlaced, Actor: "customer", CreatedAt: now.Add(-2 * time.Minute)},
+		{From: OrderPlaced, To: OrderAccepted, Actor: "kitchen", CreatedAt: now.Add(-time.Minute)},
+		{From: OrderAccepted, To: OrderCancelled, Actor: "support", Reason: "customer_request: customer called", CreatedAt: now},
+	}, normalizeStatusHistory(order.StatusHistory))
+
+	// Cancelled orders are final
+	rec = updateStatus(order.PublicID, OrderStatusReq{Status: OrderAccepted, Actor: "kitchen"})
+	assert.Equal(suite.T(), http.StatusConflict, rec.Code)
+
+	rec = updateStatus(order.PublicID, OrderStatusReq{Status: "lost"})
+	assert.Equal(suite.T(), http.StatusBadRequest, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), `"field":"status"`)
+	assert.Contains(suite.T(), rec.Body.String(), `"field":"actor"`)
+
+	rec = updateStatus(newOrderID(now), OrderStatusReq{Status: OrderAccepted, Actor: "kitchen"})
+	assert.Equal(suite.T(), http.StatusNotFound, rec.Code)
+}
+
+func (suite *HandlerTestSuite) TestRejectedOrderReleasesCouponRedemption() {
+	limits := CouponLimits{MaxUses: 1}
+	place := func() (*Order, error) {
+		order := &Order{
+			Status: OrderPlaced,
+			Items:  []OrderLine{{ProductID: 1, Name: "Margherita Pizza", UnitPrice: 12.99, Quantity: 1}},
+			Total:  12.99,
+		}
+		return order, suite.repos.Orders.CreateOrder(order, &CouponRedemption{Code: "REJECTED", Customer: "alice"}, limits)
+	}
+
+	order, err := place()
+	assert.NoError(suite.T(), err)
+	_, err = place()
+	var rejected *CouponRejectedError
+	assert.ErrorAs(suite.T(), err, &rejected)
+
+	_, err = suite.repos.Orders.UpdateOrderStatus(order.PublicID, &OrderStatusChange{To: OrderRejected, Actor: "kitchen"})
+	assert.NoError(suite.T(), err)
+	redemptions, err := suite.repos.Coupons.CountRedemptions("REJECTED", "")
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), redemptions)
+	_, err = place()
+	assert.NoError(suite.T(), err)
+}
+
+// normalizeStatusHistory converts the timestamps to UTC, whatever timezone they were stored in
+func normalizeStatusHistory(history []OrderStatusChange) []OrderStatusChange {
+	normalized := make([]OrderStatusChange, 0, len(history))
+	for _, change := range history {
+		change.CreatedAt = change.CreatedAt.UTC()
+		normalized = append(normalized, change)
+	}
+	return normalized
+}
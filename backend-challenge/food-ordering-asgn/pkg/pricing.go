@@ -0,0 +1,62 @@
+package pkg
+
+// pricing.go computes order totals on the server from the stored product prices,
+// so clients never have to be trusted with the arithmetic of an order.
+
+import (
+	"fmt"
+	"math"
+)
+
+// PricedLine is a single order item resolved against its product
+type PricedLine struct {
+	Product  Product
+	Quantity int
+	Amount   float64
+}
+
+// OrderPricing holds the monetary breakdown of an order
+type OrderPricing struct {
+	Lines     []PricedLine
+	Subtotal  float64
+	Discounts float64
+	Total     float64
+}
+
+// priceOrder prices every line as Product.Price * Quantity.
+// Every line must reference one of the supplied products.
+func priceOrder(lines []orderRequestLine, products []Product) (OrderPricing, error) {
+	productsByID := make(map[uint]Product, len(products))
+	for _, product := range products {
+		productsByID[product.ID] = product
+	}
+
+	var pricing OrderPricing
+	for _, item := range lines {
+		product, ok := productsByID[item.ProductID]
+		if !ok {
+			return OrderPricing{}, fmt.Errorf("product %d not found for pricing", item.ProductID)
+		}
+		amount := roundAmount(product.Price * float64(item.Quantity))
+		pricing.Lines = append(pricing.Lines, PricedLine{
+			Product:  product,
+			Quantity: item.Quantity,
+			Amount:   amount,
+		})
+		pricing.Subtotal += amount
+	}
+	pricing.Subtotal = roundAmount(pricing.Subtotal)
+	pricing.Total = pricing.Subtotal
+	return pricing, nil
+}
+
+// applyDiscount deducts the discount granted by the rule, never letting the total go below zero
+func (p *OrderPricing) applyDiscount(rule DiscountRule) {
+	p.Discounts = roundAmount(math.Min(p.Discounts+rule.Evaluate(p.Lines), p.Subtotal))
+	p.Total = roundAmount(p.Subtotal - p.Discounts)
+}
+
+// roundAmount rounds a monetary amount to cents
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,178 @@
+package pkg
+
+// refund.go cancels orders, in full or line by line. Every cancellation records a
+// refund of the lines it removes from the order. A line is refunded at its share of
+// the order total, so discounts are deducted proportionally, and the refund cancelling
+// the last remaining line refunds whatever is left of the total. The refunds of an
+// order therefore never add up to more than was charged.
+//
+// Once every line is refunded, the order is cancelled and its coupon redemption is
+// released, so the coupon can be used again. Lines can only be refunded while the
+// order can still be cancelled.
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CancelReason explains why an order, or some of its lines, were cancelled
+type CancelReason string
+
+const (
+	CancelCustomerRequest CancelReason = "customer_request"
+	CancelItemUnavailable CancelReason = "item_unavailable"
+	CancelStoreClosed     CancelReason = "store_closed"
+	CancelDuplicateOrder  CancelReason = "duplicate_order"
+	CancelPaymentFailed   CancelReason = "payment_failed"
+	CancelOther           CancelReason = "other"
+)
+
+var cancelReasons = []CancelReason{
+	CancelCustomerRequest, CancelItemUnavailable, CancelStoreClosed, CancelDuplicateOrder, CancelPaymentFailed, CancelOther,
+}
+
+// Valid reports whether the reason is one of the known reasons
+func (r CancelReason) Valid() bool {
+	return slices.Contains(cancelReasons, r)
+}
+
+// CancelOrderReq cancels the items of an order, or the whole order when no items are given
+type CancelOrderReq struct {
+	Reason CancelReason `json:"reason"`
+	Actor  string       `json:"actor"`
+	Note   string       `json:"note"`
+	Items  []OrderItem  `json:"items"`
+}
+
+// Refund records the lines removed from an order by a cancellation and the amount refunded for them
+type Refund struct {
+	ID      uint         `gorm:"primaryKey" json:"-"`
+	OrderID uint         `gorm:"not null;index" json:"-"`
+	Reason  CancelReason `gorm:"not null" json:"reason"`
+	Actor   string       `gorm:"not null" json:"actor"`
+	Note    string       `gorm:"not null;default:''" json:"note,omitempty"`
+	Amount  float64      `gorm:"not null" json:"amount"`
+	// Full is set on the refund which cancelled the order
+	Full      bool         `gorm:"not null;default:false" json:"full"`
+	Lines     []RefundLine `gorm:"constraint:OnDelete:CASCADE" json:"lines"`
+	CreatedAt time.Time    `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// RefundLine is the refunded quantity of an order line
+type RefundLine struct {
+	ID          uint    `gorm:"primaryKey" json:"-"`
+	RefundID    uint    `gorm:"not null;index" json:"-"`
+	OrderLineID uint    `gorm:"not null;index" json:"-"`
+	ProductID   uint    `gorm:"not null" json:"productId"`
+	Quantity    int     `gorm:"not null" json:"quantity"`
+	Amount      float64 `gorm:"not null" json:"amount"`
+
+	// requestIndex is the position of the line in the request, which errors are reported against
+	requestIndex int
+}
+
+// newRefund returns the refund requested by a client, without its amounts. It returns
+// an *OrderValidationError when the request is invalid.
+func newRefund(req CancelOrderReq, now time.Time) (*Refund, error) {
+	invalid := &OrderValidationError{}
+	if !req.Reason.Valid() {
+		names := make([]string, 0, len(cancelReasons))
+		for _, reason := range cancelReasons {
+			names = append(names, string(reason))
+		}
+		invalid.add("reason", "must be one of %s, got %q", strings.Join(names, ", "), req.Reason)
+	}
+	if strings.TrimSpace(req.Actor) == "" {
+		invalid.add("actor", "must not be empty")
+	}
+	refund := &Refund{Reason: req.Reason, Actor: req.Actor, Note: req.Note, CreatedAt: now}
+	if len(req.Items) > 0 {
+		lines, err := normalizeOrderItems(req.Items, OrderLimits{})
+		var items *OrderValidationError
+		if errors.As(err, &items) {
+			invalid.Errors = append(invalid.Errors, items.Errors...)
+		}
+		for _, line := range lines {
+			refund.Lines = append(refund.Lines, RefundLine{ProductID: line.ProductID, Quantity: line.Quantity, requestIndex: line.Index})
+		}
+	}
+	if len(invalid.Errors) > 0 {
+		return nil, invalid
+	}
+	return refund, nil
+}
+
+// applyRefund checks the refund against the order, fills in the refunded amounts and
+// deducts the refunded lines from the order. A refund without lines refunds every
+// remaining line. The order is cancelled, and the refund marked as full, when no line
+// remains. It returns an *OrderTransitionError when the order can't be cancelled
+// anymore and an *OrderValidationError when the lines don't match the order.
+func applyRefund(order *Order, refund *Refund) error {
+	if !order.Status.CanTransition(OrderCancelled) {
+		return &OrderTransitionError{From: order.Status, To: OrderCancelled}
+	}
+
+	if len(refund.Lines) == 0 {
+		for _, line := range order.Items {
+			if remaining := line.Quantity - line.RefundedQuantity; remaining > 0 {
+				refund.Lines = append(refund.Lines, RefundLine{ProductID: line.ProductID, Quantity: remaining})
+			}
+		}
+	}
+
+	invalid := &OrderValidationError{}
+	subtotal := 0.0
+	for _, line := range order.Items {
+		subtotal += line.UnitPrice * float64(line.Quantity)
+	}
+	for i := range refund.Lines {
+		refunded := &refund.Lines[i]
+		index := slices.IndexFunc(order.Items, func(line OrderLine) bool { return line.ProductID == refunded.ProductID })
+		if index == -1 {
+			invalid.add(fmt.Sprintf("items[%d].productId", refunded.requestIndex), "product %d is not part of the order", refunded.ProductID)
+			continue
+		}
+		line := &order.Items[index]
+		if remaining := line.Quantity - line.RefundedQuantity; refunded.Quantity > remaining {
+			invalid.add(fmt.Sprintf("items[%d].quantity", refunded.requestIndex),
+				"must not exceed the %d remaining of product %d, got %d", remaining, refunded.ProductID, refunded.Quantity)
+			continue
+		}
+		refunded.OrderLineID = line.ID
+		if subtotal > 0 {
+			refunded.Amount = roundAmount(line.UnitPrice * float64(refunded.Quantity) * order.Total / subtotal)
+		}
+		line.RefundedQuantity += refunded.Quantity
+	}
+	if len(invalid.Errors) > 0 {
+		return invalid
+	}
+
+	refund.Amount = 0
+	for _, line := range refund.Lines {
+		refund.Amount += line.Amount
+	}
+	refund.Amount = roundAmount(refund.Amount)
+	refund.Full = !slices.ContainsFunc(order.Items, func(line OrderLine) bool { return line.RefundedQuantity < line.Quantity })
+	if refund.Full {
+		// The last refund settles the rounding of the previous ones
+		settled := roundAmount(order.Total - order.Refunded)
+		refund.Lines[len(refund.Lines)-1].Amount = roundAmount(refund.Lines[len(refund.Lines)-1].Amount + settled - refund.Amount)
+		refund.Amount = settled
+		order.Status = OrderCancelled
+	}
+	order.Refunded = roundAmount(order.Refunded + refund.Amount)
+	return nil
+}
+
+// cancellation returns the status change recording the cancellation of the order by the refund
+func (r *Refund) cancellation(from OrderStatus) OrderStatusChange {
+	reason := string(r.Reason)
+	if r.Note != "" {
+		reason += ": " + r.Note
+	}
+	return OrderStatusChange{From: from, To: OrderCancelled, Actor: r.Actor, Reason: reason, CreatedAt: r.CreatedAt}
+}
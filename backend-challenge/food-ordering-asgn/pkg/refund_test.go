@@ -0,0 +1,241 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gormsqlite "gorm.io/driver/sqlite"
+	gorm "gorm.io/gorm"
+)
+
+func TestApplyRefund(t *testing.T) {
+	// Two pizzas and a salad with 3.50 off
+	newOrder := func() *Order {
+		return &Order{
+			Status: OrderAccepted,
+			Items: []OrderLine{
+				{ID: 1, ProductID: 1, UnitPrice: 12.99, Quantity: 2},
+				{ID: 2, ProductID: 3, UnitPrice: 8.99, Quantity: 1},
+			},
+			Total:     31.47,
+			Discounts: 3.50,
+		}
+	}
+
+	order := newOrder()
+	pizza := &Refund{Lines: []RefundLine{{ProductID: 1, Quantity: 1}}}
+	require.NoError(t, applyRefund(order, pizza))
+	assert.Equal(t, []RefundLine{{OrderLineID: 1, ProductID: 1, Quantity: 1, Amount: 11.69}}, pizza.Lines)
+	assert.Equal(t, 11.69, pizza.Amount)
+	assert.False(t, pizza.Full)
+	assert.Equal(t, OrderAccepted, order.Status)
+	assert.Equal(t, 11.69, order.Refunded)
+	assert.Equal(t, 1, order.Items[0].RefundedQuantity)
+
+	// The last refund takes the rest of the total
+	rest := &Refund{}
+	require.NoError(t, applyRefund(order, rest))
+	assert.Equal(t, []RefundLine{
+		{OrderLineID: 1, ProductID: 1, Quantity: 1, Amount: 11.69},
+		{OrderLineID: 2, ProductID: 3, Quantity: 1, Amount: 8.09},
+	}, rest.Lines)
+	assert.Equal(t, 19.78, rest.Amount)
+	assert.True(t, rest.Full)
+	assert.Equal(t, OrderCancelled, order.Status)
+	assert.Equal(t, order.Total, order.Refunded)
+
+	// Cancelled orders can't be refunded again
+	assert.Equal(t, &OrderTransitionError{From: OrderCancelled, To: OrderCancelled}, applyRefund(order, &Refund{}))
+
+	order = newOrder()
+	err := applyRefund(order, &Refund{Lines: []RefundLine{
+		{ProductID: 2, Quantity: 1, requestIndex: 0},
+		{ProductID: 1, Quantity: 3, requestIndex: 2},
+	}})
+	var invalid *OrderValidationError
+	require.ErrorAs(t, err, &invalid)
+	assert.Equal(t, []FieldError{
+		{Field: "items[0].productId", Message: "product 2 is not part of the order"},
+		{Field: "items[2].quantity", Message: "must not exceed the 2 remaining of product 1, got 3"},
+	}, invalid.Errors)
+
+	order = newOrder()
+	order.Status = OrderReady
+	assert.Equal(t, &OrderTransitionError{From: OrderReady, To: OrderCancelled}, applyRefund(order, &Refund{}))
+}
+
+func TestNewRefund(t *testing.T) {
+	now := time.Date(2025, 6, 6, 9, 0, 0, 0, time.UTC)
+	refund, err := newRefund(CancelOrderReq{
+		Reason: CancelItemUnavailable,
+		Actor:  "kitchen",
+		Items:  []OrderItem{{ProductID: "1", Quantity: 1}, {ProductID: "3", Quantity: 1}, {ProductID: "1", Quantity: 1}},
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, &Refund{
+		Reason: CancelItemUnavailable,
+		Actor:  "kitchen",
+		Lines: []RefundLine{
+			{ProductID: 1, Quantity: 2, requestIndex: 0},
+			{ProductID: 3, Quantity: 1, requestIndex: 1},
+		},
+		CreatedAt: now,
+	}, refund)
+
+	_, err = newRefund(CancelOrderReq{Reason: "changed_mind", Items: []OrderItem{{ProductID: "1", Quantity: 0}}}, now)
+	var invalid *OrderValidationError
+	require.ErrorAs(t, err, &invalid)
+	assert.Equal(t, []FieldError{
+		{Field: "reason", Message: `must be one of customer_request, item_unavailable, store_closed, duplicate_order, payment_failed, other, got "changed_mind"`},
+		{Field: "actor", Message: "must not be empty"},
+		{Field: "items[0].quantity", Message: "must be greater than zero"},
+	}, invalid.Errors)
+}
+
+func TestRefundOrderReleasesCouponRedemption(t *testing.T) {
+	gormRepos := func(t *testing.T) Repositories {
+		db, err := gorm.Open(gormsqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+		require.NoError(t, err)
+		_, err = NewMigrator(db).Up()
+		require.NoError(t, err)
+		return NewGormRepositories(db)
+	}
+	memoryRepos := func(t *testing.T) Repositories {
+		repos, err := NewMemoryRepositories()
+		require.NoError(t, err)
+		return repos
+	}
+
+	for name, newRepos := range map[string]func(t *testing.T) Repositories{"gorm": gormRepos, "memory": memoryRepos} {
+		t.Run(name, func(t *testing.T) {
+			repos := newRepos(t)
+			order := &Order{
+				Status: OrderPlaced,
+				Items: []OrderLine{
+					{ProductID: 1, Name: "Margherita Pizza", UnitPrice: 12.99, Quantity: 2},
+					{ProductID: 4, Name: "Garlic Bread", UnitPrice: 4.99, Quantity: 1},
+				},
+				Total: 30.97,
+			}
+			require.NoError(t, repos.Orders.CreateOrder(order, &CouponRedemption{Code: "HAPPYHRS", Customer: "alice"}, CouponLimits{MaxUses: 1}))
+
+			// A partial refund keeps the coupon redeemed
+			refund := &Refund{Reason: CancelItemUnavailable, Actor: "kitchen", Lines: []RefundLine{{ProductID: 4, Quantity: 1}}}
+			updated, err := repos.Orders.RefundOrder(order.PublicID, refund)
+			require.NoError(t, err)
+			assert.Equal(t, OrderPlaced, updated.Status)
+			assert.Equal(t, 4.99, updated.Refunded)
+			assert.Equal(t, []int{0, 1}, []int{updated.Items[0].RefundedQuantity, updated.Items[1].RefundedQuantity})
+			redemptions, err := repos.Coupons.CountRedemptions("HAPPYHRS", "")
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), redemptions)
+
+			_, err = repos.Orders.RefundOrder(order.PublicID, &Refund{Reason: CancelItemUnavailable, Actor: "kitchen", Lines: []RefundLine{{ProductID: 4, Quantity: 1}}})
+			var invalid *OrderValidationError
+			assert.ErrorAs(t, err, &invalid)
+
+			refund = &Refund{Reason: CancelCustomerRequest, Actor: "support"}
+			updated, err = repos.Orders.RefundOrder(order.PublicID, refund)
+			require.NoError(t, err)
+			assert.True(t, refund.Full)
+			assert.Equal(t, 25.98, refund.Amount)
+			assert.Equal(t, OrderCancelled, updated.Status)
+			assert.Equal(t, 30.97, updated.Refunded)
+			require.NotEmpty(t, updated.StatusHistory)
+			assert.Equal(t, "customer_request", updated.StatusHistory[len(updated.StatusHistory)-1].Reason)
+			redemptions, err = repos.Coupons.CountRedemptions("HAPPYHRS", "")
+			require.NoError(t, err)
+			assert.Zero(t, redemptions)
+
+			refunds, err := repos.Orders.ListRefunds(order.PublicID)
+			require.NoError(t, err)
+			require.Len(t, refunds, 2)
+			assert.Equal(t, []float64{4.99, 25.98}, []float64{refunds[0].Amount, refunds[1].Amount})
+			assert.Equal(t, []RefundLine{{ID: refunds[1].Lines[0].ID, RefundID: refunds[1].ID, OrderLineID: updated.Items[0].ID, ProductID: 1, Quantity: 2, Amount: 25.98}}, refunds[1].Lines)
+
+			_, err = repos.Orders.RefundOrder(newOrderID(time.Now()), &Refund{})
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = repos.Orders.ListRefunds(newOrderID(time.Now()))
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func (suite *HandlerTestSuite) TestCancelOrder() {
+	handler := NewRequestHandler(suite.repos, WithAdminToken(testAdminToken)).ServeHTTP()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	cancel := func(id string, req CancelOrderReq) *httptest.ResponseRecorder {
+		jsonData, err := json.Marshal(req)
+		require.NoError(suite.T(), err)
+		httpReq := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/order/%s/cancel", id), bytes.NewBuffer(jsonData))
+		httpReq.Header.Set("Authorization", "Bearer "+testAdminToken)
+		return serve(httpReq)
+	}
+
+	jsonData, err := json.Marshal(OrderReq{Items: []OrderItem{{ProductID: "1", Quantity: 2}, {ProductID: "3", Quantity: 1}}})
+	require.NoError(suite.T(), err)
+	rec := serve(suite.orderRequest(jsonData))
+	require.Equal(suite.T(), http.StatusOK, rec.Code)
+	var order Order
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&order))
+
+	// Refunds are reserved to the staff
+	rec = serve(httptest.NewRequest(http.MethodPost, fmt.Sprintf("/order/%s/cancel", order.PublicID), bytes.NewBufferString(`{"reason": "other", "actor": "me"}`)))
+	assert.Equal(suite.T(), http.StatusUnauthorized, rec.Code)
+
+	rec = cancel(order.PublicID, CancelOrderReq{Reason: CancelItemUnavailable, Actor: "kitchen", Note: "out of salad", Items: []OrderItem{{ProductID: "3", Quantity: 1}}})
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	var cancelled struct {
+		Order  Order  `json:"order"`
+		Refund Refund `json:"refund"`
+	}
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&cancelled))
+	assert.Equal(suite.T(), OrderPlaced, cancelled.Order.Status)
+	assert.Equal(suite.T(), 8.99, cancelled.Order.Refunded)
+	assert.Equal(suite.T(), []RefundLine{{ProductID: 3, Quantity: 1, Amount: 8.99}}, cancelled.Refund.Lines)
+
+	rec = cancel(order.PublicID, CancelOrderReq{Reason: CancelItemUnavailable, Actor: "kitchen", Items: []OrderItem{{ProductID: "3", Quantity: 1}, {ProductID: "5", Quantity: 1}}})
+	assert.Equal(suite.T(), http.StatusBadRequest, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), `"field":"items[0].quantity"`)
+	assert.Contains(suite.T(), rec.Body.String(), `"field":"items[1].productId"`)
+
+	rec = cancel(order.PublicID, CancelOrderReq{Reason: "changed_mind", Actor: "kitchen"})
+	assert.Equal(suite.T(), http.StatusBadRequest, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), `"field":"reason"`)
+
+	rec = cancel(order.PublicID, CancelOrderReq{Reason: CancelCustomerRequest, Actor: "support"})
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&cancelled))
+	assert.Equal(suite.T(), OrderCancelled, cancelled.Order.Status)
+	assert.Equal(suite.T(), cancelled.Order.Total, cancelled.Order.Refunded)
+	assert.True(suite.T(), cancelled.Refund.Full)
+
+	rec = cancel(order.PublicID, CancelOrderReq{Reason: CancelCustomerRequest, Actor: "support"})
+	assert.Equal(suite.T(), http.StatusConflict, rec.Code)
+	assert.Contains(suite.T(), rec.Body.String(), "can't be cancelled once cancelled")
+
+	rec = serve(suite.readRequest(fmt.Sprintf("/order/%s/refunds", order.PublicID)))
+	assert.Equal(suite.T(), http.StatusOK, rec.Code)
+	var refunds []Refund
+	require.NoError(suite.T(), json.NewDecoder(rec.Body).Decode(&refunds))
+	require.Len(suite.T(), refunds, 2)
+	assert.Equal(suite.T(), []CancelReason{CancelItemUnavailable, CancelCustomerRequest}, []CancelReason{refunds[0].Reason, refunds[1].Reason})
+	assert.Equal(suite.T(), "out of salad", refunds[0].Note)
+	assert.InDelta(suite.T(), cancelled.Order.Total, refunds[0].Amount+refunds[1].Amount, 0.001)
+
+	rec = cancel(newOrderID(time.Now()), CancelOrderReq{Reason: CancelCustomerRequest, Actor: "support"})
+	assert.Equal(suite.T(), http.StatusNotFound, rec.Code)
+	rec = serve(suite.readRequest("/order/" + newOrderID(time.Now()) + "/refunds"))
+	assert.Equal(suite.T(), http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,102 @@
+package pkg
+
+// repository.go declares the storage used by the request handlers. The handlers only
+// depend on these interfaces, so the business rules can be tested without a database
+// and the storage can be swapped. gorm_repository.go implements them on top of gorm,
+// memory_repository.go keeps everything in memory.
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by the repositories when a record doesn't exist
+var ErrNotFound = errors.New("record not found")
+
+// ProductRepository stores the products on sale
+type ProductRepository interface {
+	ListProducts() ([]Product, error)
+	// GetProduct returns the product with the id or ErrNotFound
+	GetProduct(id uint) (*Product, error)
+	// FindProducts returns the existing products among the ids, each of them once
+	FindProducts(ids []uint) ([]Product, error)
+}
+
+// OrderRepository stores the placed orders
+type OrderRepository interface {
+	// GetOrder returns the order with the public id, with its lines and status history,
+	// or ErrNotFound
+	GetOrder(publicID string) (*Order, error)
+	// FindOrders returns a page of the orders matching the query, with their lines
+	FindOrders(query OrderQuery) (OrderPage, error)
+	// CreateOrder stores the order with its items and products, and assigns the order a
+	// public id unless it has one already. When a redemption is given, it is recorded in
+	// the same transaction provided the limits of the coupon still allow it. Otherwise a
+	// *CouponRejectedError is returned and nothing is stored.
+	CreateOrder(order *Order, redemption *CouponRedemption, limits CouponLimits) error
+	// UpdateOrderStatus moves the order to change.To and records the change, filling in
+	// change.From, and returns the updated order. The coupon redemption of a rejected
+	// order is released. ErrNotFound is returned for unknown orders and an
+	// *OrderTransitionError when the transition isn't allowed.
+	UpdateOrderStatus(publicID string, change *OrderStatusChange) (*Order, error)
+	// RefundOrder records the refund, filling in its amounts with applyRefund, and returns
+	// the updated order. The order is cancelled and its coupon redemption released when
+	// the refund is full. ErrNotFound is returned for unknown orders and the errors of
+	// applyRefund when the refund doesn't apply to the order.
+	RefundOrder(publicID string, refund *Refund) (*Order, error)
+	// ListRefunds returns the refunds of the order, oldest first, or ErrNotFound
+	ListRefunds(publicID string) ([]Refund, error)
+}
+
+// CouponRepository stores the coupons, their sources and redemptions
+type CouponRepository interface {
+	// GetCoupon returns the coupon stored for the code or ErrNotFound
+	GetCoupon(code string) (*Coupon, error)
+	// UpdateCoupon applies update to the coupon stored for the code, creating it when missing
+	UpdateCoupon(code string, update func(*Coupon)) error
+	// CountRedemptions counts the redemptions of the code, only those of the customer when one is given
+	CountRedemptions(code, customer string) (int64, error)
+	// MoveRedemptions hands the redemptions of a customer over to another customer and
+	// returns how many were moved
+	MoveRedemptions(from, to string) (int64, error)
+	// ListSources returns every coupon source ordered by name
+	ListSources() ([]CouponSource, error)
+	// FindSources returns the existing sources among the names
+	FindSources(names []string) ([]CouponSource, error)
+	// SyncSources records the named sources and removes every other source along with
+	// its coupon associations
+	SyncSources(names []string) error
+}
+
+// IdempotencyRepository stores the responses of requests sent with an Idempotency-Key
+type IdempotencyRepository interface {
+	// GetIdempotencyRecord returns the record of the customer's key, expired or not, or ErrNotFound
+	GetIdempotencyRecord(customer, key string) (*IdempotencyRecord, error)
+	// SaveIdempotencyRecord stores the record after removing the records expired at now
+	SaveIdempotencyRecord(record *IdempotencyRecord, now time.Time) error
+}
+
+// APIKeyRepository stores the keys clients authenticate with
+type APIKeyRepository interface {
+	// FindAPIKey returns the key whose current or previous value has the hash, or ErrNotFound
+	FindAPIKey(keyHash string) (*APIKey, error)
+	// ListAPIKeys returns every key, revoked or not, ordered by name
+	ListAPIKeys() ([]APIKey, error)
+	// CreateAPIKey stores a new key, or returns ErrAPIKeyExists when the name is taken
+	CreateAPIKey(key *APIKey) error
+	// UpdateAPIKey applies update to the key with the name and stores it, or returns
+	// ErrNotFound. Nothing is stored when update returns an error, which is passed on.
+	UpdateAPIKey(name string, update func(*APIKey) error) (*APIKey, error)
+	// RecordAPIKeyUse counts a use of the key at the time, by its previous value when previous is set
+	RecordAPIKeyUse(id uint, previous bool, usedAt time.Time) error
+}
+
+// Repositories bundles the storage used by the request handlers
+type Repositories struct {
+	Products ProductRepository
+	Orders   OrderRepository
+	Coupons  CouponRepository
+	APIKeys  APIKeyRepository
+	// Idempotency is optional, requests are not deduplicated without it
+	Idempotency IdempotencyRepository
+}
@@ -2,15 +2,20 @@ package pkg
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
 
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 
 	"github.com/parvez0/food-ordering-asgn/utils"
 )
@@ -18,14 +23,15 @@ import (
 // seeder.go provides functions for setting up DB and populate data for the first run.
 // The current requiremnt is to fill order and product details. Read and fillup coupun codes
 
+const couponReadBufferSize = 64 * 1024
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // SeedDatabase initializes the database with initial data
 func SeedDatabase(db *gorm.DB) error {
-	// Migrate all tables in correct order
-	if err := db.AutoMigrate(&CouponSource{}, &Coupon{}); err != nil {
-		return utils.WrapError(err, "failed to migrate CouponSource table")
-	}
-	if err := db.AutoMigrate(&Product{}, &Order{}, &OrderItem{}); err != nil {
-		return utils.WrapError(err, "failed to migrate Product table")
+	// Bring the schema up to date
+	if _, err := NewMigrator(db).Up(); err != nil {
+		return utils.WrapError(err, "failed to migrate database")
 	}
 
 	// First seed products
@@ -39,17 +45,125 @@ func SeedDatabase(db *gorm.DB) error {
 		return utils.WrapError(nil, "no products available for seeding orders")
 	}
 
+	return seedDiscountRules(NewGormRepositories(db).Coupons)
+}
+
+// DefaultCouponDataDir returns the data directory shipped with the sources
+func DefaultCouponDataDir() (string, error) {
 	_, file, _, ok := runtime.Caller(0)
 	if !ok {
-		return errors.New("Could not get caller info")
+		return "", errors.New("Could not get caller info")
 	}
-	// Seed coupons from files  
-	return seedCoupons(filepath.Join(filepath.Dir(file), "../data"), db)
+	return filepath.Join(filepath.Dir(file), "../data"), nil
 }
 
-func seedProductData(db *gorm.DB) ([]Product, error) {
-	// Create initial products
-	products := []Product{
+// SyncCouponSources creates a CouponSource record for every source of the index
+// and removes the records of sources which no longer exist
+func SyncCouponSources(coupons CouponRepository, index *CouponIndex) error {
+	return coupons.SyncSources(index.Sources())
+}
+
+// seedDiscountRules attaches the built-in discount rules to their coupons.
+// Whether a code is valid is still decided by the coupon sources.
+func seedDiscountRules(coupons CouponRepository) error {
+	for code, rule := range builtinDiscountRules {
+		if err := rule.Validate(); err != nil {
+			return utils.WrapError(err, "invalid discount rule for coupon: "+code)
+		}
+		err := coupons.UpdateCoupon(code, func(coupon *Coupon) {
+			coupon.DiscountRule = rule
+		})
+		if err != nil {
+			return utils.WrapError(err, "failed to attach discount rule to coupon: "+code)
+		}
+	}
+	return nil
+}
+
+// ConfigureCouponLimits applies the configured usage limits to their coupons. Codes
+// are normalized with the tokenizer, as coupons are looked up by their normalized
+// code, so codes which aren't well formed or normalize to the same code are rejected.
+func ConfigureCouponLimits(coupons CouponRepository, tokenizer *CouponTokenizer, limits map[string]CouponLimits) error {
+	configured := make(map[string]string, len(limits))
+	for _, code := range slices.Sorted(maps.Keys(limits)) {
+		if !tokenizer.IsCode(code) {
+			return fmt.Errorf("invalid limits for coupon %s: not a coupon code", code)
+		}
+		if err := limits[code].Validate(); err != nil {
+			return utils.WrapError(err, "invalid limits for coupon: "+code)
+		}
+		normalized := tokenizer.Normalize(code)
+		if other, ok := configured[normalized]; ok {
+			return fmt.Errorf("limits for coupons %s and %s apply to the same code %s", other, code, normalized)
+		}
+		configured[normalized] = code
+	}
+	for normalized, code := range configured {
+		limit := limits[code]
+		err := coupons.UpdateCoupon(normalized, func(coupon *Coupon) {
+			coupon.Limits = limit
+		})
+		if err != nil {
+			return utils.WrapError(err, "failed to attach limits to coupon: "+code)
+		}
+	}
+	return nil
+}
+
+// ConfigureAPIKeys registers the configured keys. Keys with the same names get the
+// configured scopes, and the configured hash unless they were ever rotated.
+func ConfigureAPIKeys(keys APIKeyRepository, configs []APIKeyConfig) error {
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return utils.WrapError(err, "invalid API key: "+config.Name)
+		}
+		ignored := false
+		_, err := keys.UpdateAPIKey(config.Name, func(key *APIKey) error {
+			ignored = key.reconfigure(config)
+			return nil
+		})
+		if ignored {
+			logger.Warnf("API key %s was rotated, its configured hash is ignored", config.Name)
+		}
+		if errors.Is(err, ErrNotFound) {
+			err = keys.CreateAPIKey(&APIKey{Name: config.Name, KeyHash: strings.ToLower(config.KeyHash), Scopes: config.Scopes})
+		}
+		if err != nil {
+			return utils.WrapError(err, "failed to register API key: "+config.Name)
+		}
+	}
+	return nil
+}
+
+// ClaimLegacyRedemptions hands the coupon redemptions recorded under the legacy
+// customer key of every registered key over to the key, so they keep counting
+// against the per customer limits. Keys without legacy redemptions are left alone.
+func ClaimLegacyRedemptions(coupons CouponRepository, keys APIKeyRepository) error {
+	registered, err := keys.ListAPIKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range registered {
+		hashes := []string{key.KeyHash}
+		if key.PreviousKeyHash != nil {
+			hashes = append(hashes, *key.PreviousKeyHash)
+		}
+		for _, hash := range hashes {
+			moved, err := coupons.MoveRedemptions(legacyCustomerKey(hash), apiKeyCustomerKey(key.ID))
+			if err != nil {
+				return utils.WrapError(err, "failed to claim coupon redemptions of API key: "+key.Name)
+			}
+			if moved > 0 {
+				logger.Infof("Moved %d coupon redemptions to API key %s", moved, key.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// defaultProducts are the products on sale in a new store
+func defaultProducts() []Product {
+	return []Product{
 		{
 			Name:     "Margherita Pizza",
 			Price:    12.99,
@@ -81,10 +195,21 @@ func seedProductData(db *gorm.DB) ([]Product, error) {
 			Category: "Waffle",
 		},
 	}
+}
+
+func seedProductData(db *gorm.DB) ([]Product, error) {
+	// Create initial products
+	products := defaultProducts()
 
-	// Create products in database
-	if err := db.Create(&products).Error; err != nil {
-		return nil, utils.WrapError(err, "failed to create new products")
+	// Create products in database, unless a persistent database was seeded already
+	var existing int64
+	if err := db.Model(&Product{}).Count(&existing).Error; err != nil {
+		return nil, utils.WrapError(err, "failed to count products")
+	}
+	if existing == 0 {
+		if err := db.Create(&products).Error; err != nil {
+			return nil, utils.WrapError(err, "failed to create new products")
+		}
 	}
 
 	// Fetch all products to get their IDs
@@ -96,86 +221,63 @@ func seedProductData(db *gorm.DB) ([]Product, error) {
 	return results, nil
 }
 
-func seedCoupons(dirPath string, db *gorm.DB) error {
-	files, err := getFilesInDirectory(dirPath)
+// openCouponSource opens a coupon source file for reading. Gzip compressed files,
+// detected by their extension or magic bytes, are decompressed while streaming.
+// When bytesRead is set, it is incremented by the bytes read from the file.
+func openCouponSource(filePath string, bytesRead *atomic.Int64) (io.ReadCloser, error) {
+	fd, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, utils.WrapError(err, "failed to open file")
 	}
 
-	// Regex for matching only string coupons
-	stringPattern := regexp.MustCompile(`[A-Za-z]{8,10}`)
-
-	for _, file := range files {
-		// Create source record for the file
-		source := &CouponSource{
-			Source: filepath.Base(file),
-		}
-		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(source).Error; err != nil {
-			return utils.WrapError(err, "failed to create couponSource record")
-		}
+	var raw io.Reader = fd
+	if bytesRead != nil {
+		raw = &countingReader{Reader: fd, count: bytesRead}
+	}
+	buffered := bufio.NewReaderSize(raw, couponReadBufferSize)
+	magic, err := buffered.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		fd.Close()
+		return nil, utils.WrapError(err, "failed to read file header")
+	}
 
-		// Read and process the file
-		scanner, err := fileScanner(file)
+	if strings.EqualFold(filepath.Ext(filePath), ".gz") || bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(buffered)
 		if err != nil {
-			return utils.WrapError(err, "failed to read file: "+file)
-		}
-
-		// Process each line in the file
-		for scanner.Scan() {
-			couponCode := scanner.Text()
-			if couponCode == "" || !stringPattern.MatchString(couponCode) {
-				continue
-			}
-
-			// Create or find coupon record
-			var coupon Coupon
-			result := db.Where("code = ?", couponCode).First(&coupon)
-			if result.Error != nil {
-				if result.Error == gorm.ErrRecordNotFound {
-					// Create new coupon
-					coupon = Coupon{
-						Code: couponCode,
-					}
-					if err := db.Create(&coupon).Error; err != nil {
-						return utils.WrapError(err, "failed to create coupon record")
-					}
-				} else {
-					return utils.WrapError(result.Error, "failed to check existing coupon")
-				}
-			}
-
-			if err := db.Model(&coupon).Association("SourceFile").Append(source); err != nil {
-				return utils.WrapError(err, "failed to create association for coupon: "+couponCode)
-			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			return utils.WrapError(err, "error reading file: "+file)
+			fd.Close()
+			return nil, utils.WrapError(err, "failed to open gzip stream")
 		}
+		return &sourceReader{Reader: gz, closers: []io.Closer{gz, fd}}, nil
 	}
+	return &sourceReader{Reader: buffered, closers: []io.Closer{fd}}, nil
+}
 
+// sourceReader closes every layer of a coupon source stream
+type sourceReader struct {
+	io.Reader
+	closers []io.Closer
+}
 
-	var coupons []Coupon
-	if err := db.Preload("SourceFile").Find(&coupons).Error; err != nil {
-		return utils.WrapError(err, "Failed to fetch coupons")
-	}
-	for _, c := range coupons {
-		logger.Info(c.Code, c.SourceFile)
+func (r *sourceReader) Close() error {
+	var lastErr error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil {
+			lastErr = err
+		}
 	}
-
-	return nil
+	return lastErr
 }
 
-// fileScanner creates a new scanner for reading a file line by line
-func fileScanner(filePath string) (*bufio.Scanner, error) {
-	fd, err := os.Open(filePath)
-	if err != nil {
-		return nil, utils.WrapError(err, "failed to open file")
-	}
-	return bufio.NewScanner(fd), nil
+// fileScanner creates a new scanner yielding the candidate coupon codes of a source
+func fileScanner(reader io.Reader, tokenizer *CouponTokenizer) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, couponReadBufferSize), couponReadBufferSize)
+	scanner.Split(tokenizer.SplitFunc())
+	return scanner
 }
 
-// getFilesInDirectory returns a list of all files in the specified directory at 1 level
+// getFilesInDirectory returns a list of all files in the specified directory at 1 level,
+// skipping hidden files
 func getFilesInDirectory(dirPath string) ([]string, error) {
 	var files []string
 
@@ -192,7 +294,8 @@ func getFilesInDirectory(dirPath string) ([]string, error) {
 			return filepath.SkipDir
 		}
 
-		if !info.IsDir() {
+		// Hidden files, like uploads in progress, are not sources
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
 			files = append(files, path)
 		}
 